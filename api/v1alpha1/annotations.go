@@ -0,0 +1,163 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import "strings"
+
+const (
+	// TunnelsAnnotation is the service annotation the controller records the running tunnels in,
+	// as a versioned JSON registry of the tunnels of the service ports.
+	TunnelsAnnotation = "service.k-ngrok.io/tunnels"
+
+	// TunnelHashesAnnotation is the service annotation the controller recorded the
+	// config hash of the running tunnels in, keyed by the tunnel name.
+	//
+	// Deprecated: the config hashes are recorded in the TunnelsAnnotation registry,
+	// this annotation is only read to migrate the services.
+	TunnelHashesAnnotation = "service.k-ngrok.io/tunnel-hashes"
+
+	// AppliedDefaultsAnnotation is the service annotation the webhook records the tunnel
+	// annotations it defaulted from the namespace annotations in, as a JSON object of
+	// the annotation values keyed by the annotation key.
+	AppliedDefaultsAnnotation = "service.k-ngrok.io/applied-defaults"
+
+	// OptedOutDefaultsAnnotation is the service annotation the webhook records the defaulted
+	// annotations removed from the service in, as a JSON array of the annotation keys, so
+	// that they are not defaulted again while the namespace declares them.
+	OptedOutDefaultsAnnotation = "service.k-ngrok.io/opted-out-defaults"
+
+	// TunnelURLsHashAnnotation is the annotation the controller records the hash of the
+	// public URLs of the tunnels of a service in, on the ConfigMap the URLs are published
+	// in. The pod template of the workloads the URLs are injected into records it in the
+	// annotation of each service, see ServiceTunnelURLsHashAnnotation.
+	TunnelURLsHashAnnotation = "service.k-ngrok.io/tunnel-urls-hash"
+
+	// TunnelURLsLabel is the label of the ConfigMap the public URLs of the tunnels of a
+	// service are published in, set to the service name. Only the labeled ConfigMaps are
+	// cached by the controller.
+	TunnelURLsLabel = "service.k-ngrok.io/tunnel-urls"
+
+	// InjectTunnelURLsLabel is the pod label that opts in to the injection of the public
+	// URLs of the tunnels of the services selecting the pod, when set to "true".
+	InjectTunnelURLsLabel = "k-ngrok.io/inject-tunnel-urls"
+
+	// TunnelQuotaAnnotation is the namespace annotation that limits the number of tunnels
+	// the services in the namespace may use. Each port of a service uses a tunnel.
+	TunnelQuotaAnnotation = "k-ngrok.io/tunnel-quota"
+
+	// TunnelAnnotationPrefix is the prefix of the service annotations that configure the tunnels.
+	// The name following the prefix is the tunnel option name. The option of a single named
+	// port is set through the annotation whose prefix is preceded by the port name and a dot,
+	// e.g. http.tunnel.k-ngrok.io/basic-auth.
+	TunnelAnnotationPrefix = "tunnel.k-ngrok.io/"
+)
+
+// Tunnel option names. The option is set on a service through the annotation with
+// TunnelAnnotationPrefix, and its default is set through the TunnelClass options.
+// Except RegionOption, the options can be overridden for a named port.
+const (
+	// ProtocolOption is the tunnel protocol of the service ports, one of tcp, http or tls.
+	ProtocolOption = "protocol"
+
+	// RegionOption is the ngrok region the tunnels are started in, e.g. us, eu or ap.
+	// The tunnels are started on an agent connected to the region.
+	RegionOption = "region"
+
+	// BasicAuthOption is the name of a kubernetes.io/basic-auth Secret, in the service
+	// namespace, whose credentials protect the http tunnels with basic auth.
+	BasicAuthOption = "basic-auth"
+
+	// OAuthProviderOption is the identity provider that protects the http tunnels with
+	// OAuth, e.g. google, github or microsoft, or OIDCProvider for OpenID Connect.
+	OAuthProviderOption = "oauth-provider"
+
+	// OAuthAllowEmailsOption is the comma-separated list of emails allowed by OAuth or OIDC.
+	OAuthAllowEmailsOption = "oauth-allow-emails"
+
+	// OAuthAllowDomainsOption is the comma-separated list of email domains allowed by OAuth or OIDC.
+	OAuthAllowDomainsOption = "oauth-allow-domains"
+
+	// OAuthScopesOption is the comma-separated list of scopes requested by OAuth or OIDC.
+	OAuthScopesOption = "oauth-scopes"
+
+	// OAuthSecretOption is the name of a Secret, in the service namespace, with the
+	// client-id and client-secret keys of the OAuth app. Required by OIDC.
+	OAuthSecretOption = "oauth-secret"
+
+	// OIDCIssuerURLOption is the issuer URL of the OpenID Connect provider.
+	OIDCIssuerURLOption = "oidc-issuer-url"
+
+	// DenySourceRangesOption is the comma-separated list of CIDRs denied to connect to the
+	// tunnels. The allowed CIDRs are the service spec.loadBalancerSourceRanges.
+	DenySourceRangesOption = "deny-source-ranges"
+
+	// RemoteAddrOption is the TCP address reserved on the ngrok account, e.g. 1.tcp.ngrok.io:20000,
+	// the tcp tunnel is bound to. It is usually set for a single port.
+	RemoteAddrOption = "remote-addr"
+
+	// HostnameOption is the custom hostname, reserved on the ngrok account, the http or tls
+	// tunnel is bound to, e.g. api.dev.example.com. It is usually set for a single port.
+	HostnameOption = "hostname"
+
+	// CNAMETargetOption is the CNAME target of the custom hostname given by ngrok when the
+	// hostname was reserved, e.g. 2jfc1d.cname.ngrok.io. The DNS record of the hostname is
+	// published to external-dns when it is set.
+	CNAMETargetOption = "cname-target"
+
+	// TLSSecretOption is the name of a kubernetes.io/tls Secret, in the service namespace,
+	// with the certificate and key the tls tunnels are terminated with by the agent. The
+	// tls tunnels without it pass the TLS connections through to the service.
+	TLSSecretOption = "tls-secret"
+)
+
+// OIDCProvider is the OAuthProviderOption value for OpenID Connect.
+const OIDCProvider = "oidc"
+
+// Keys of the Secret referenced by OAuthSecretOption.
+const (
+	OAuthClientIDKey     = "client-id"
+	OAuthClientSecretKey = "client-secret"
+)
+
+// TunnelAnnotation returns the service annotation key of the given tunnel option name.
+func TunnelAnnotation(option string) string {
+	return TunnelAnnotationPrefix + option
+}
+
+// ServiceTunnelURLsHashAnnotation returns the pod template annotation key the hash of the
+// public URLs of the tunnels of the named service is recorded in, so that each of the
+// services selecting a workload rolls it out only when its own URLs change.
+func ServiceTunnelURLsHashAnnotation(serviceName string) string {
+	return serviceName + "." + TunnelURLsHashAnnotation
+}
+
+// PortTunnelAnnotation returns the service annotation key of the given tunnel option name
+// for the named service port.
+func PortTunnelAnnotation(portName, option string) string {
+	return portName + "." + TunnelAnnotationPrefix + option
+}
+
+// ParsePortTunnelAnnotation returns the port name and the tunnel option name of the
+// service annotation key. It returns false when the key is not a port tunnel annotation.
+func ParsePortTunnelAnnotation(key string) (portName, option string, ok bool) {
+	i := strings.Index(key, "."+TunnelAnnotationPrefix)
+	if i <= 0 || strings.Contains(key[:i], ".") {
+		return "", "", false
+	}
+
+	return key[:i], key[i+len(TunnelAnnotationPrefix)+1:], true
+}
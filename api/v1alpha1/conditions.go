@@ -0,0 +1,57 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// TunnelsReadyCondition is the condition the controller sets on the service
+// status to report whether the tunnels of all its ports are running.
+const TunnelsReadyCondition = "k-ngrok.io/TunnelsReady"
+
+// Reasons of the TunnelsReadyCondition.
+const (
+	// TunnelsRunningReason is set when the tunnels of all the service ports are running.
+	TunnelsRunningReason = "TunnelsRunning"
+
+	// ThrottledReason is set when the tunnels are waiting for the tunnel start
+	// rate limit of the agent, they are started once the limit allows it.
+	ThrottledReason = "Throttled"
+
+	// TunnelFailedReason is set when a tunnel could not be started or stopped.
+	TunnelFailedReason = "TunnelFailed"
+)
+
+// DNSRecordsPublishedCondition is the condition the controller sets on the service
+// status to report whether the DNS records of the custom hostnames of its tunnels are
+// published to external-dns. It is only set with --publish-dns-endpoints, on the
+// services with a custom hostname.
+const DNSRecordsPublishedCondition = "k-ngrok.io/DNSRecordsPublished"
+
+// Reasons of the DNSRecordsPublishedCondition.
+const (
+	// RecordsPublishedReason is set when the records of the running tunnels are published.
+	RecordsPublishedReason = "RecordsPublished"
+
+	// MissingCNAMETargetReason is set when a custom hostname has no CNAME target, its
+	// record is not published until the cname-target option is set.
+	MissingCNAMETargetReason = "MissingCNAMETarget"
+
+	// DNSEndpointConflictReason is set when a DNSEndpoint of the same name not owned
+	// by the service exists, the records are not published until it is removed.
+	DNSEndpointConflictReason = "DNSEndpointConflict"
+
+	// PublishFailedReason is set when the DNSEndpoint could not be published.
+	PublishFailedReason = "PublishFailed"
+)
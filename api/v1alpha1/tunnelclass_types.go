@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TunnelClassSpec defines the desired state of TunnelClass
+type TunnelClassSpec struct {
+	// LoadBalancerClass is the service LoadBalancer class name served by this TunnelClass.
+	// Must be a label-style identifier, with an optional prefix.
+	LoadBalancerClass string `json:"loadBalancerClass"`
+
+	// Agent is the name of the agent, or of the agent pool, that runs the
+	// tunnels of this class. When empty, the tunnels run on the "default" agent,
+	// or on any agent connected to the requested region.
+	// +optional
+	Agent string `json:"agent,omitempty"`
+
+	// Region is the default ngrok region the tunnels of this class are started in.
+	// The tunnels are started on an agent connected to the region.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Protocol is the default tunnel protocol of the service ports.
+	// Defaults to the protocol of the service port.
+	// +kubebuilder:validation:Enum=tcp;http;tls
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// Options are the default tunnel options, keyed by the tunnel.k-ngrok.io/
+	// annotation name without prefix. The service annotations take precedence.
+	// +optional
+	Options map[string]string `json:"options,omitempty"`
+
+	// AllowedAnnotations is the list of tunnel.k-ngrok.io/ annotation names,
+	// without prefix, the services of this class are allowed to set.
+	// All annotations are allowed when empty.
+	// +optional
+	AllowedAnnotations []string `json:"allowedAnnotations,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="LoadBalancerClass",type="string",JSONPath=".spec.loadBalancerClass"
+// +kubebuilder:printcolumn:name="Agent",type="string",JSONPath=".spec.agent"
+// +kubebuilder:printcolumn:name="Region",type="string",JSONPath=".spec.region"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// TunnelClass is the Schema for the tunnelclasses API
+type TunnelClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TunnelClassSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TunnelClassList contains a list of TunnelClass
+type TunnelClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TunnelClass `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TunnelClass{}, &TunnelClassList{})
+}
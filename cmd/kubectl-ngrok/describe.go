@@ -0,0 +1,175 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// describedOptions are the tunnel options shown by describe. Options referencing
+// a Secret only show the Secret name, never its content.
+var describedOptions = []string{
+	v1alpha1.ProtocolOption,
+	v1alpha1.RegionOption,
+	v1alpha1.BasicAuthOption,
+	v1alpha1.OAuthProviderOption,
+	v1alpha1.OAuthAllowEmailsOption,
+	v1alpha1.OAuthAllowDomainsOption,
+	v1alpha1.OAuthScopesOption,
+	v1alpha1.OAuthSecretOption,
+	v1alpha1.OIDCIssuerURLOption,
+	v1alpha1.DenySourceRangesOption,
+	v1alpha1.RemoteAddrOption,
+	v1alpha1.HostnameOption,
+	v1alpha1.CNAMETargetOption,
+	v1alpha1.TLSSecretOption,
+}
+
+func runDescribe(ctx context.Context, args []string) error {
+	o := &options{}
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	o.bindFlags(fs)
+	args, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := serviceName(args)
+	if err != nil {
+		return err
+	}
+
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	svc := &corev1.Service{}
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: name}, svc); err != nil {
+		return err
+	}
+
+	class, err := o.classFor(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	events := &corev1.EventList{}
+	if err := o.client.List(ctx, events, client.InNamespace(svc.Namespace), client.MatchingFieldsSelector{
+		Selector: fields.AndSelectors(
+			fields.OneTermEqualSelector("involvedObject.kind", "Service"),
+			fields.OneTermEqualSelector("involvedObject.name", svc.Name),
+			fields.OneTermEqualSelector("involvedObject.uid", string(svc.UID)),
+		),
+	}); err != nil {
+		return err
+	}
+
+	return describe(os.Stdout, svc, class, events.Items)
+}
+
+func describe(out io.Writer, svc *corev1.Service, class *v1alpha1.TunnelClass, events []corev1.Event) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", svc.Name)
+	fmt.Fprintf(w, "Namespace:\t%s\n", svc.Namespace)
+	fmt.Fprintf(w, "LoadBalancer Class:\t%s\n", valueOrNone(pointer.StringDeref(svc.Spec.LoadBalancerClass, "")))
+	fmt.Fprintf(w, "Tunnel Class:\t%s\n", valueOrNone(class.Name))
+	fmt.Fprintf(w, "Agent:\t%s\n", agentName(class))
+	fmt.Fprintf(w, "Region:\t%s\n", valueOrNone(tunnels.Region(svc, class)))
+
+	fmt.Fprintln(w, "Tunnels:")
+	fmt.Fprintln(w, "  PORT\tTUNNEL\tPROTOCOL\tADDR\tPUBLIC URL\tHEALTH")
+	for _, row := range tunnelRows(svc, class) {
+		config := tunnels.Config(svc, class, row.Port)
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", portName(row.Port), row.Name, row.Protocol, config.Addr, valueOrNone(row.PublicURL), row.Health)
+	}
+
+	fmt.Fprintln(w, "Options:")
+	for _, option := range describedOptions {
+		if v, ok := tunnels.Option(svc, class, option); ok {
+			fmt.Fprintf(w, "  %s:\t%s\n", option, v)
+		}
+	}
+
+	for _, sp := range svc.Spec.Ports {
+		for _, option := range describedOptions {
+			if _, ok := svc.Annotations[v1alpha1.PortTunnelAnnotation(sp.Name, option)]; !ok || sp.Name == "" {
+				continue
+			}
+
+			if v, ok := tunnels.PortOption(svc, class, sp, option); ok {
+				fmt.Fprintf(w, "  %s (port %s):\t%s\n", option, sp.Name, v)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Source Ranges:\t%s\n", valueOrNone(strings.Join(tunnels.SourceRanges(svc), ",")))
+
+	fmt.Fprintln(w, "Conditions:")
+	if len(svc.Status.Conditions) == 0 {
+		fmt.Fprintln(w, "  <none>")
+	} else {
+		fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+		for _, c := range svc.Status.Conditions {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+		}
+	}
+
+	fmt.Fprintln(w, "Events:")
+	if len(events) == 0 {
+		fmt.Fprintln(w, "  <none>")
+	} else {
+		sort.SliceStable(events, func(i, j int) bool {
+			return eventTime(events[i]).Before(eventTime(events[j]))
+		})
+
+		fmt.Fprintln(w, "  TYPE\tREASON\tAGE\tMESSAGE")
+		for _, e := range events {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", e.Type, e.Reason, duration.HumanDuration(time.Since(eventTime(e))), strings.TrimSpace(e.Message))
+		}
+	}
+
+	return w.Flush()
+}
+
+func eventTime(e corev1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+
+	return e.CreationTimestamp.Time
+}
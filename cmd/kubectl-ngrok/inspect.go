@@ -0,0 +1,227 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/inspect"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+func runInspect(ctx context.Context, args []string) error {
+	o := &options{}
+	var (
+		managerNamespace string
+		managerSelector  string
+		managerPort      int
+		limit            int
+		follow           bool
+		interval         time.Duration
+	)
+
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	o.bindFlags(fs)
+	fs.StringVar(&managerNamespace, "manager-namespace", "kngrok-system", "The namespace of the manager pods.")
+	fs.StringVar(&managerSelector, "manager-selector", "control-plane=controller-manager", "The label selector of the manager pods.")
+	fs.IntVar(&managerPort, "manager-port", 8082, "The port the manager inspect server binds to, see --inspect-bind-address of the manager.")
+	fs.IntVar(&limit, "limit", 20, "The maximum number of captured requests shown.")
+	fs.BoolVar(&follow, "follow", false, "Keep polling for new captured requests.")
+	fs.BoolVar(&follow, "f", false, "Shorthand for --follow.")
+	fs.DurationVar(&interval, "interval", 2*time.Second, "The polling interval when following.")
+	args, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := serviceName(args)
+	if err != nil {
+		return err
+	}
+
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	svc := &corev1.Service{}
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: name}, svc); err != nil {
+		return err
+	}
+
+	token, err := bearerToken(o.restConfig)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tMETHOD\tURI\tSTATUS\tDURATION\tTUNNEL")
+	seen := sets.NewString()
+	for {
+		pods, err := o.clientset.CoreV1().Pods(managerNamespace).List(ctx, metav1.ListOptions{LabelSelector: managerSelector})
+		if err != nil {
+			return err
+		}
+
+		// every manager replica runs its own agents, merge the requests they captured.
+		var reqs []ngrok.CapturedRequest
+		for _, pod := range pods.Items {
+			if pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+
+			captured, err := o.capturedRequests(ctx, pod, managerPort, svc, token, limit)
+			if err != nil {
+				return fmt.Errorf("unable to get captured requests from manager pod %s: %w", pod.Name, err)
+			}
+
+			reqs = append(reqs, captured...)
+		}
+
+		// print the oldest first, as a log would.
+		sort.SliceStable(reqs, func(i, j int) bool {
+			return reqs[i].Start.Before(reqs[j].Start)
+		})
+
+		if seen.Len() == 0 && limit > 0 && len(reqs) > limit {
+			reqs = reqs[len(reqs)-limit:]
+		}
+
+		for _, req := range reqs {
+			if seen.Has(req.ID) {
+				continue
+			}
+
+			seen.Insert(req.ID)
+			status := "-"
+			if req.Response != nil {
+				status = strconv.Itoa(req.Response.StatusCode)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", req.Start.Local().Format(time.RFC3339), req.Request.Method, req.Request.URI,
+				status, req.Duration.Round(time.Millisecond), req.TunnelName)
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// capturedRequests gets the requests captured on the tunnels of the service from
+// the manager pod through the apiserver pods proxy, since the agent API only
+// listens on the loopback interface of the pod. The apiserver does not forward
+// the Authorization header, so the token is sent in the inspect.TokenHeader.
+func (o *options) capturedRequests(ctx context.Context, pod corev1.Pod, port int, svc *corev1.Service, token string, limit int) ([]ngrok.CapturedRequest, error) {
+	b, err := o.clientset.CoreV1().RESTClient().Get().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		SubResource("proxy").
+		Name(net.JoinSchemeNamePort("http", pod.Name, strconv.Itoa(port))).
+		Suffix(inspect.RequestsPath).
+		Param("namespace", svc.Namespace).
+		Param("name", svc.Name).
+		Param("limit", strconv.Itoa(limit)).
+		SetHeader(inspect.TokenHeader, token).
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []ngrok.CapturedRequest
+	if err := json.Unmarshal(b, &reqs); err != nil {
+		return nil, err
+	}
+
+	return reqs, nil
+}
+
+// bearerToken returns the bearer token the kubeconfig credentials authenticate with,
+// including the tokens of files and of exec and auth provider plugins, by capturing
+// it from a request that is never sent.
+func bearerToken(config *rest.Config) (string, error) {
+	if config.BearerToken != "" {
+		return config.BearerToken, nil
+	}
+
+	var token string
+	c := rest.CopyConfig(config)
+	c.Wrap(func(http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+		})
+	})
+
+	rt, err := rest.TransportFor(c)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://kubernetes.default.svc/", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+	if token == "" {
+		return "", fmt.Errorf("inspect requires bearer token credentials, e.g. client certificates are not supported")
+	}
+
+	return token, nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command kubectl-ngrok is a kubectl plugin to list, describe and inspect
+// the ngrok tunnels of the Services exposed by kngrok.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+const usage = `kubectl ngrok lists, describes and inspects the ngrok tunnels of the Services exposed by kngrok.
+
+Usage:
+  kubectl ngrok tunnels [-A] [-n NAMESPACE]
+  kubectl ngrok describe svc/NAME [-n NAMESPACE]
+  kubectl ngrok inspect svc/NAME [-n NAMESPACE] [-f] [--limit N]
+
+Run 'kubectl ngrok COMMAND -h' for the flags of the command.
+`
+
+// options are the flags shared by all commands.
+type options struct {
+	kubeconfig        string
+	kubecontext       string
+	namespace         string
+	loadBalancerClass string
+
+	restConfig *rest.Config
+	client     client.Client
+	clientset  kubernetes.Interface
+}
+
+func (o *options) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use.")
+	fs.StringVar(&o.kubecontext, "context", "", "The name of the kubeconfig context to use.")
+	fs.StringVar(&o.namespace, "namespace", "", "The namespace of the services. Defaults to the kubeconfig context namespace.")
+	fs.StringVar(&o.namespace, "n", "", "Shorthand for --namespace.")
+	fs.StringVar(&o.loadBalancerClass, "service-loadbalancer-class", "k-ngrok.io/default",
+		"The service LoadBalancer class name the manager is running with.")
+}
+
+// complete builds the clients and resolves the namespace from the kubeconfig.
+func (o *options) complete() error {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.kubecontext})
+	if o.namespace == "" {
+		ns, _, err := config.Namespace()
+		if err != nil {
+			return err
+		}
+
+		o.namespace = ns
+	}
+
+	var err error
+	if o.restConfig, err = config.ClientConfig(); err != nil {
+		return err
+	}
+
+	scheme := clientgoscheme.Scheme
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+	if o.client, err = client.New(o.restConfig, client.Options{Scheme: scheme}); err != nil {
+		return err
+	}
+
+	o.clientset, err = kubernetes.NewForConfig(o.restConfig)
+	return err
+}
+
+// parse parses the flags interspersed with the positional arguments,
+// and returns the positional arguments.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// serviceName returns the service name from the svc/NAME, service/NAME or NAME argument.
+func serviceName(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected exactly one service, e.g. svc/foo")
+	}
+
+	parts := strings.SplitN(args[0], "/", 2)
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	switch parts[0] {
+	case "svc", "service", "services":
+		return parts[1], nil
+	default:
+		return "", fmt.Errorf("unsupported resource type %q, expected svc", parts[0])
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var run func(ctx context.Context, args []string) error
+	switch os.Args[1] {
+	case "tunnels":
+		run = runTunnels
+	case "describe":
+		run = runDescribe
+	case "inspect":
+		run = runInspect
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(1)
+	}
+
+	if err := run(context.Background(), os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
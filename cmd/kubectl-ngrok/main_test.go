@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestParse(t *testing.T) {
+	var (
+		namespace string
+		follow    bool
+	)
+
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.StringVar(&namespace, "n", "", "")
+	fs.BoolVar(&follow, "f", false, "")
+	args, err := parse(fs, []string{"svc/foo", "-n", "dev", "extra", "-f"})
+	if err != nil {
+		t.Fatalf("parse() unexpected error: %v", err)
+	}
+
+	if want := []string{"svc/foo", "extra"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("parse() = %v, want %v", args, want)
+	}
+
+	if namespace != "dev" || !follow {
+		t.Errorf("parse() flags namespace = %q, follow = %v, want dev and true", namespace, follow)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: []string{"foo"}, want: "foo"},
+		{args: []string{"svc/foo"}, want: "foo"},
+		{args: []string{"service/foo"}, want: "foo"},
+		{args: []string{"services/foo"}, want: "foo"},
+		{args: []string{"deploy/foo"}, wantErr: true},
+		{args: []string{"foo", "bar"}, wantErr: true},
+		{args: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := serviceName(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("serviceName(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("serviceName(%v) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file"), 0600); err != nil {
+		t.Fatalf("Unexpected error writing token file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  *rest.Config
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Token",
+			config: &rest.Config{Host: "https://127.0.0.1:6443", BearerToken: "token"},
+			want:   "token",
+		},
+		{
+			name:   "Token file",
+			config: &rest.Config{Host: "https://127.0.0.1:6443", BearerTokenFile: tokenFile},
+			want:   "from-file",
+		},
+		{
+			name:    "Basic auth",
+			config:  &rest.Config{Host: "https://127.0.0.1:6443", Username: "admin", Password: "secret"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bearerToken(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bearerToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("bearerToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// tunnelRow describes the tunnel of a service port.
+type tunnelRow struct {
+	Port      corev1.ServicePort
+	Name      string
+	Protocol  string
+	PublicURL string
+	Agent     string
+	Health    string
+}
+
+func runTunnels(ctx context.Context, args []string) error {
+	o := &options{}
+	var allNamespaces bool
+	fs := flag.NewFlagSet("tunnels", flag.ExitOnError)
+	o.bindFlags(fs)
+	fs.BoolVar(&allNamespaces, "all-namespaces", false, "List the tunnels of the services in all namespaces.")
+	fs.BoolVar(&allNamespaces, "A", false, "Shorthand for --all-namespaces.")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	var opts []client.ListOption
+	if !allNamespaces {
+		opts = append(opts, client.InNamespace(o.namespace))
+	}
+
+	svcs := &corev1.ServiceList{}
+	if err := o.client.List(ctx, svcs, opts...); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSERVICE\tPORT\tPROTOCOL\tPUBLIC URL\tAGENT\tREGION\tHEALTH")
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if _, ok := svc.Annotations[v1alpha1.TunnelsAnnotation]; !ok {
+			// the service is not exposed by kngrok.
+			continue
+		}
+
+		class, err := o.classFor(ctx, svc)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range tunnelRows(svc, class) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", svc.Namespace, svc.Name, portName(row.Port), row.Protocol,
+				valueOrNone(row.PublicURL), row.Agent, valueOrNone(tunnels.Region(svc, class)), row.Health)
+		}
+	}
+
+	return w.Flush()
+}
+
+// classFor returns the TunnelClass of the service, or the default class when
+// the LoadBalancer class has no TunnelClass.
+func (o *options) classFor(ctx context.Context, svc *corev1.Service) (*v1alpha1.TunnelClass, error) {
+	class, err := tunnels.ClassFor(ctx, o.client, o.loadBalancerClass, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if class == nil {
+		class = tunnels.DefaultClass(pointer.StringDeref(svc.Spec.LoadBalancerClass, ""))
+	}
+
+	return class, nil
+}
+
+// tunnelRows returns the tunnels of the service ports recorded in the tunnel registry.
+// The public URL of a tunnel migrated from the unversioned registry is read from the
+// service LoadBalancer ingress, which the controller populates in the order of the
+// ports whose tunnel is running.
+func tunnelRows(svc *corev1.Service, class *v1alpha1.TunnelClass) []tunnelRow {
+	registry, _ := tunnels.ParseRegistry(svc.Annotations)
+
+	var rows []tunnelRow
+	ingress := svc.Status.LoadBalancer.Ingress
+	for _, sp := range svc.Spec.Ports {
+		row := tunnelRow{
+			Port:     sp,
+			Name:     tunnels.Name(svc, sp),
+			Protocol: tunnels.Protocol(svc, class, sp),
+			Agent:    agentName(class),
+			Health:   "Pending",
+		}
+
+		if entry, ok := registry.Get(row.Name); ok {
+			if entry.Agent != "" {
+				row.Agent = entry.Agent
+			}
+
+			row.PublicURL = entry.PublicURL
+			if row.PublicURL == "" && len(ingress) > 0 {
+				row.PublicURL = publicURL(row.Protocol, ingress[0])
+			}
+
+			row.Health = "Ready"
+			if len(ingress) > 0 {
+				ingress = ingress[1:]
+			}
+		}
+
+		if !svc.GetDeletionTimestamp().IsZero() {
+			row.Health = "Terminating"
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func publicURL(proto string, ingress corev1.LoadBalancerIngress) string {
+	var port int32
+	if len(ingress.Ports) > 0 {
+		port = ingress.Ports[0].Port
+	}
+
+	if proto == "http" {
+		if port == 443 {
+			return "https://" + ingress.Hostname
+		}
+
+		proto = "https"
+	}
+
+	return proto + "://" + ingress.Hostname + ":" + strconv.Itoa(int(port))
+}
+
+func portName(sp corev1.ServicePort) string {
+	if sp.Name != "" {
+		return sp.Name + "/" + strconv.Itoa(int(sp.Port))
+	}
+
+	return strconv.Itoa(int(sp.Port))
+}
+
+func agentName(class *v1alpha1.TunnelClass) string {
+	if class.Spec.Agent != "" {
+		return class.Spec.Agent
+	}
+
+	return "default"
+}
+
+func valueOrNone(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+
+	return v
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+func TestTunnelRows(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	registry.Set(tunnels.RegistryEntry{Name: "default-foo-web", Port: 80, Agent: "eu", PublicURL: "https://foo.eu.ngrok.io"})
+	registry.Set(tunnels.RegistryEntry{Name: "default-foo-db", Port: 5432})
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":     "tcp",
+				v1alpha1.TunnelsAnnotation:       registry.String(),
+				"web.tunnel.k-ngrok.io/protocol": "http",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "web", Port: 80}, {Name: "db", Port: 5432}, {Name: "admin", Port: 8080}},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{
+					{Hostname: "foo.eu.ngrok.io", Ports: []corev1.PortStatus{{Port: 443}}},
+					{Hostname: "0.tcp.ngrok.io", Ports: []corev1.PortStatus{{Port: 12345}}},
+				},
+			},
+		},
+	}
+
+	class := tunnels.DefaultClass("k-ngrok.io/default")
+	var got []string
+	for _, row := range tunnelRows(svc, class) {
+		got = append(got, row.Name+" "+row.Protocol+" "+valueOrNone(row.PublicURL)+" "+row.Agent+" "+row.Health)
+	}
+
+	want := []string{
+		"default-foo-web http https://foo.eu.ngrok.io eu Ready",
+		"default-foo-db tcp tcp://0.tcp.ngrok.io:12345 default Ready",
+		"default-foo-admin tcp <none> default Pending",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tunnelRows() = %q, want %q", got, want)
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	tests := []struct {
+		proto   string
+		ingress corev1.LoadBalancerIngress
+		want    string
+	}{
+		{proto: "http", ingress: corev1.LoadBalancerIngress{Hostname: "foo.ngrok.io", Ports: []corev1.PortStatus{{Port: 443}}}, want: "https://foo.ngrok.io"},
+		{proto: "tcp", ingress: corev1.LoadBalancerIngress{Hostname: "0.tcp.ngrok.io", Ports: []corev1.PortStatus{{Port: 12345}}}, want: "tcp://0.tcp.ngrok.io:12345"},
+		{proto: "tls", ingress: corev1.LoadBalancerIngress{Hostname: "foo.ngrok.io", Ports: []corev1.PortStatus{{Port: 443}}}, want: "tls://foo.ngrok.io:443"},
+	}
+
+	for _, tt := range tests {
+		if got := publicURL(tt.proto, tt.ingress); got != tt.want {
+			t.Errorf("publicURL(%q, %+v) = %q, want %q", tt.proto, tt.ingress, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+// ownedAnnotations are the service annotations the controller owns.
+var ownedAnnotations = []string{
+	v1alpha1.TunnelsAnnotation,
+}
+
+// ownedConditions are the service condition types the controller owns.
+var ownedConditions = []string{
+	v1alpha1.TunnelsReadyCondition,
+	v1alpha1.DNSRecordsPublishedCondition,
+}
+
+// serviceApplyConfiguration returns the apply configurations of the service and
+// of its status, with only the fields owned by the controller. The fields that are
+// left out of them are removed from the service when they are owned by the controller.
+func serviceApplyConfiguration(obj client.Object) (client.Object, client.Object, error) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil, fmt.Errorf("expected a Service but got a %T", obj)
+	}
+
+	applyConfig := newServiceApplyConfiguration(svc)
+	annotations := map[string]string{}
+	for _, key := range ownedAnnotations {
+		if v, ok := svc.Annotations[key]; ok {
+			annotations[key] = v
+		}
+	}
+
+	if len(annotations) > 0 {
+		applyConfig.SetAnnotations(annotations)
+	}
+
+	if controllerutil.ContainsFinalizer(svc, ControllerName) {
+		applyConfig.SetFinalizers([]string{ControllerName})
+	}
+
+	statusApplyConfig := newServiceApplyConfiguration(svc)
+	loadBalancer, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&svc.Status.LoadBalancer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := unstructured.SetNestedField(statusApplyConfig.Object, loadBalancer, "status", "loadBalancer"); err != nil {
+		return nil, nil, err
+	}
+
+	var conditions []interface{}
+	for _, conditionType := range ownedConditions {
+		condition := meta.FindStatusCondition(svc.Status.Conditions, conditionType)
+		if condition == nil {
+			continue
+		}
+
+		c, err := runtime.DefaultUnstructuredConverter.ToUnstructured(condition)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		conditions = append(conditions, c)
+	}
+
+	if len(conditions) > 0 {
+		if err := unstructured.SetNestedSlice(statusApplyConfig.Object, conditions, "status", "conditions"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return applyConfig, statusApplyConfig, nil
+}
+
+func newServiceApplyConfiguration(svc *corev1.Service) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("Service")
+	u.SetNamespace(svc.Namespace)
+	u.SetName(svc.Name)
+	return u
+}
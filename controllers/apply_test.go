@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+func TestServiceApplyConfiguration(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation:       `["default-foo-80"]`,
+				"argocd.argoproj.io/tracking-id": "foo",
+			},
+			Finalizers: []string{ControllerName, "example.com/finalizer"},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{Hostname: "0.tcp.ngrok.io"}},
+			},
+			Conditions: []metav1.Condition{
+				{Type: v1alpha1.TunnelsReadyCondition, Status: metav1.ConditionTrue, Reason: v1alpha1.TunnelsRunningReason},
+				{Type: "example.com/Ready", Status: metav1.ConditionTrue, Reason: "Ready"},
+			},
+		},
+	}
+
+	applyConfig, statusApplyConfig, err := serviceApplyConfiguration(svc)
+	if err != nil {
+		t.Fatalf("serviceApplyConfiguration() unexpected error: %v", err)
+	}
+
+	u := applyConfig.(*unstructured.Unstructured)
+	if want := map[string]string{v1alpha1.TunnelsAnnotation: `["default-foo-80"]`}; !reflect.DeepEqual(u.GetAnnotations(), want) {
+		t.Errorf("serviceApplyConfiguration() annotations = %v, want %v", u.GetAnnotations(), want)
+	}
+
+	if want := []string{ControllerName}; !reflect.DeepEqual(u.GetFinalizers(), want) {
+		t.Errorf("serviceApplyConfiguration() finalizers = %v, want %v", u.GetFinalizers(), want)
+	}
+
+	if _, ok := u.Object["status"]; ok {
+		t.Errorf("serviceApplyConfiguration() unexpected status in the object apply configuration")
+	}
+
+	status := statusApplyConfig.(*unstructured.Unstructured)
+	ingress, _, _ := unstructured.NestedSlice(status.Object, "status", "loadBalancer", "ingress")
+	if len(ingress) != 1 {
+		t.Errorf("serviceApplyConfiguration() ingress = %v, want one entry", ingress)
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(status.Object, "status", "conditions")
+	if len(conditions) != 1 || conditions[0].(map[string]interface{})["type"] != v1alpha1.TunnelsReadyCondition {
+		t.Errorf("serviceApplyConfiguration() conditions = %v, want only %s", conditions, v1alpha1.TunnelsReadyCondition)
+	}
+
+	if _, ok := status.Object["metadata"].(map[string]interface{})["annotations"]; ok {
+		t.Errorf("serviceApplyConfiguration() unexpected annotations in the status apply configuration")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// dnsEndpointGVK is the GroupVersionKind of the external-dns DNSEndpoint. It is handled
+// as unstructured so the controller doesn't depend on external-dns.
+var dnsEndpointGVK = schema.GroupVersionKind{Group: "externaldns.k8s.io", Version: "v1alpha1", Kind: "DNSEndpoint"}
+
+// newDNSEndpoint returns the DNSEndpoint the DNS records of the custom hostnames
+// of the tunnels of the service are published in.
+func newDNSEndpoint(svc *corev1.Service) *unstructured.Unstructured {
+	ep := &unstructured.Unstructured{}
+	ep.SetGroupVersionKind(dnsEndpointGVK)
+	ep.SetName(svc.Name + "-tunnels")
+	ep.SetNamespace(svc.Namespace)
+	return ep
+}
+
+// publishDNSEndpoint maintains the DNSEndpoint, owned by the service, with a CNAME record
+// from the custom hostname of each running tunnel to its CNAME target, so external-dns
+// creates the records. The DNSEndpoint is deleted when no record is left. The outcome is
+// reported by the DNSRecordsPublishedCondition, and a custom hostname without a CNAME
+// target or a DNSEndpoint not owned by the service is reported by a Warning event.
+func (r *ServiceReconciler) publishDNSEndpoint(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass, registry *tunnels.Registry) error {
+	var (
+		endpoints []interface{}
+		hostnames int
+		missing   []string
+	)
+
+	for _, sp := range svc.Spec.Ports {
+		hostname, ok := tunnels.PortOption(svc, class, sp, v1alpha1.HostnameOption)
+		if !ok {
+			continue
+		}
+
+		hostnames++
+		target, ok := tunnels.PortOption(svc, class, sp, v1alpha1.CNAMETargetOption)
+		if !ok {
+			missing = append(missing, strconv.Itoa(int(sp.Port)))
+			continue
+		}
+
+		if _, ok := registry.Get(tunnels.Name(svc, sp)); !ok {
+			// the hostname doesn't resolve until its tunnel is running.
+			continue
+		}
+
+		endpoints = append(endpoints, map[string]interface{}{
+			"dnsName":    strings.ToLower(hostname),
+			"recordType": "CNAME",
+			"targets":    []interface{}{strings.ToLower(target)},
+		})
+	}
+
+	if err := r.publishDNSEndpointRecords(ctx, svc, endpoints); err != nil {
+		if !errors.Is(err, errDNSEndpointConflict) {
+			setDNSRecordsPublished(svc, metav1.ConditionFalse, v1alpha1.PublishFailedReason, err.Error())
+			return err
+		}
+
+		// requeuing doesn't help until the DNSEndpoint is removed.
+		if c := meta.FindStatusCondition(svc.Status.Conditions, v1alpha1.DNSRecordsPublishedCondition); c == nil || c.Reason != v1alpha1.DNSEndpointConflictReason {
+			r.Recorder.Event(svc, corev1.EventTypeWarning, v1alpha1.DNSEndpointConflictReason, err.Error())
+		}
+
+		setDNSRecordsPublished(svc, metav1.ConditionFalse, v1alpha1.DNSEndpointConflictReason, err.Error())
+		return nil
+	}
+
+	switch {
+	case hostnames == 0:
+		meta.RemoveStatusCondition(&svc.Status.Conditions, v1alpha1.DNSRecordsPublishedCondition)
+	case len(missing) > 0:
+		message := fmt.Sprintf("The custom hostname of port: '%s' has no %s, its DNS record is not published",
+			strings.Join(missing, "', '"), v1alpha1.CNAMETargetOption)
+		if c := meta.FindStatusCondition(svc.Status.Conditions, v1alpha1.DNSRecordsPublishedCondition); c == nil || c.Reason != v1alpha1.MissingCNAMETargetReason {
+			r.Recorder.Event(svc, corev1.EventTypeWarning, v1alpha1.MissingCNAMETargetReason, message)
+		}
+
+		setDNSRecordsPublished(svc, metav1.ConditionFalse, v1alpha1.MissingCNAMETargetReason, message)
+	default:
+		setDNSRecordsPublished(svc, metav1.ConditionTrue, v1alpha1.RecordsPublishedReason,
+			fmt.Sprintf("Published the DNS records of %d running tunnels", len(endpoints)))
+	}
+
+	return nil
+}
+
+// errDNSEndpointConflict is returned when the DNSEndpoint of the service is not owned by it.
+var errDNSEndpointConflict = errors.New("is not owned by the service, the DNS records are not published")
+
+// publishDNSEndpointRecords creates or updates the DNSEndpoint of the service with the
+// given endpoints, or deletes it when there is none.
+func (r *ServiceReconciler) publishDNSEndpointRecords(ctx context.Context, svc *corev1.Service, endpoints []interface{}) error {
+	if len(endpoints) == 0 {
+		return r.unpublishDNSEndpoint(ctx, svc)
+	}
+
+	ep := newDNSEndpoint(svc)
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, ep, func() error {
+		if ep.GetResourceVersion() != "" && !metav1.IsControlledBy(ep, svc) {
+			// never take over the records managed by someone else.
+			return fmt.Errorf("DNSEndpoint %s %w", client.ObjectKeyFromObject(ep), errDNSEndpointConflict)
+		}
+
+		if err := unstructured.SetNestedSlice(ep.Object, endpoints, "spec", "endpoints"); err != nil {
+			return err
+		}
+
+		return controllerutil.SetControllerReference(svc, ep, r.Scheme)
+	})
+
+	return err
+}
+
+// setDNSRecordsPublished sets the DNSRecordsPublishedCondition of the service.
+func setDNSRecordsPublished(svc *corev1.Service, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.DNSRecordsPublishedCondition,
+		Status:             status,
+		ObservedGeneration: svc.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// unpublishDNSEndpoint deletes the DNSEndpoint of the service, so external-dns deletes
+// the DNS records of its custom hostnames. A DNSEndpoint not owned by the service is kept.
+func (r *ServiceReconciler) unpublishDNSEndpoint(ctx context.Context, svc *corev1.Service) error {
+	ep := newDNSEndpoint(svc)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ep), ep); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if !metav1.IsControlledBy(ep, svc) {
+		return nil
+	}
+
+	if err := r.Delete(ctx, ep); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+func TestPublishDNSEndpoint(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	scheme.AddKnownTypeWithName(dnsEndpointGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(dnsEndpointGVK.GroupVersion().WithKind("DNSEndpointList"), &unstructured.UnstructuredList{})
+
+	newService := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "foo-uid", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80},
+					{Name: "admin", Port: 8080},
+				},
+			},
+		}
+	}
+
+	foreign := newDNSEndpoint(newService(nil))
+	foreign.SetLabels(map[string]string{"app": "foreign"})
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		running       []string
+		objs          []client.Object
+		wantEndpoints []interface{}
+		wantReason    string
+		wantEvent     bool
+		wantKept      bool
+		wantErr       bool
+	}{
+		{
+			name: "Publish the running tunnels",
+			annotations: map[string]string{
+				"http.tunnel.k-ngrok.io/hostname":  "API.dev.example.com",
+				"admin.tunnel.k-ngrok.io/hostname": "admin.dev.example.com",
+				"tunnel.k-ngrok.io/cname-target":   "2jfc1d.cname.ngrok.io",
+			},
+			running: []string{"default-foo-http"},
+			wantEndpoints: []interface{}{
+				map[string]interface{}{
+					"dnsName":    "api.dev.example.com",
+					"recordType": "CNAME",
+					"targets":    []interface{}{"2jfc1d.cname.ngrok.io"},
+				},
+			},
+			wantReason: v1alpha1.RecordsPublishedReason,
+		},
+		{
+			name:        "Hostname without CNAME target",
+			annotations: map[string]string{"http.tunnel.k-ngrok.io/hostname": "api.dev.example.com"},
+			running:     []string{"default-foo-http"},
+			wantReason:  v1alpha1.MissingCNAMETargetReason,
+			wantEvent:   true,
+		},
+		{
+			name:    "No custom hostname",
+			running: []string{"default-foo-http"},
+		},
+		{
+			name: "DNSEndpoint owned by someone else",
+			annotations: map[string]string{
+				"http.tunnel.k-ngrok.io/hostname":     "api.dev.example.com",
+				"http.tunnel.k-ngrok.io/cname-target": "2jfc1d.cname.ngrok.io",
+			},
+			running:    []string{"default-foo-http"},
+			objs:       []client.Object{foreign.DeepCopy()},
+			wantReason: v1alpha1.DNSEndpointConflictReason,
+			wantEvent:  true,
+			wantKept:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := newService(tt.annotations)
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(tt.objs, svc.DeepCopy())...).Build()
+			recorder := record.NewFakeRecorder(1)
+			r := &ServiceReconciler{Client: c, Scheme: scheme, Recorder: recorder}
+
+			registry := tunnels.NewRegistry()
+			for _, name := range tt.running {
+				registry.Set(tunnels.RegistryEntry{Name: name})
+			}
+
+			class := &v1alpha1.TunnelClass{}
+			err := r.publishDNSEndpoint(ctx, svc, class, registry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishDNSEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var reason string
+			if c := meta.FindStatusCondition(svc.Status.Conditions, v1alpha1.DNSRecordsPublishedCondition); c != nil {
+				reason = c.Reason
+			}
+
+			if reason != tt.wantReason {
+				t.Errorf("publishDNSEndpoint() condition reason = %q, want %q", reason, tt.wantReason)
+			}
+
+			if gotEvent := len(recorder.Events) > 0; gotEvent != tt.wantEvent {
+				t.Errorf("publishDNSEndpoint() recorded event = %v, want %v", gotEvent, tt.wantEvent)
+			}
+
+			ep := newDNSEndpoint(svc)
+			getErr := c.Get(ctx, client.ObjectKeyFromObject(ep), ep)
+			if tt.wantKept {
+				if getErr != nil || !reflect.DeepEqual(ep.GetLabels(), foreign.GetLabels()) {
+					t.Errorf("publishDNSEndpoint() changed the DNSEndpoint it doesn't own")
+				}
+
+				if err := r.unpublishDNSEndpoint(ctx, svc); err != nil {
+					t.Fatalf("unpublishDNSEndpoint() unexpected error: %v", err)
+				}
+
+				if err := c.Get(ctx, client.ObjectKeyFromObject(ep), ep); err != nil {
+					t.Errorf("unpublishDNSEndpoint() deleted the DNSEndpoint it doesn't own: %v", err)
+				}
+
+				return
+			}
+
+			if tt.wantEndpoints == nil {
+				if !apierrors.IsNotFound(getErr) {
+					t.Errorf("publishDNSEndpoint() DNSEndpoint exists, error = %v", getErr)
+				}
+
+				return
+			}
+
+			if getErr != nil {
+				t.Fatalf("publishDNSEndpoint() DNSEndpoint not found: %v", getErr)
+			}
+
+			endpoints, _, _ := unstructured.NestedSlice(ep.Object, "spec", "endpoints")
+			if !reflect.DeepEqual(endpoints, tt.wantEndpoints) {
+				t.Errorf("publishDNSEndpoint() endpoints = %v, want %v", endpoints, tt.wantEndpoints)
+			}
+
+			if !metav1.IsControlledBy(ep, svc) {
+				t.Errorf("publishDNSEndpoint() DNSEndpoint is not controlled by the service")
+			}
+
+			// the DNSEndpoint is deleted once no tunnel is running.
+			if err := r.publishDNSEndpoint(ctx, svc, class, tunnels.NewRegistry()); err != nil {
+				t.Fatalf("publishDNSEndpoint() unexpected error: %v", err)
+			}
+
+			if err := c.Get(ctx, client.ObjectKeyFromObject(ep), ep); !apierrors.IsNotFound(err) {
+				t.Errorf("publishDNSEndpoint() DNSEndpoint was not deleted, error = %v", err)
+			}
+		})
+	}
+}
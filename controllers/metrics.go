@@ -0,0 +1,200 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+var (
+	activeTunnels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kngrok_tunnels_active",
+		Help: "Number of running ngrok tunnels by service namespace, protocol and agent.",
+	}, []string{"namespace", "protocol", "agent"})
+
+	tunnelStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kngrok_tunnel_starts_total",
+		Help: "Total number of ngrok tunnels started by agent.",
+	}, []string{"agent"})
+
+	tunnelStops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kngrok_tunnel_stops_total",
+		Help: "Total number of ngrok tunnels stopped by agent.",
+	}, []string{"agent"})
+
+	tunnelFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kngrok_tunnel_failures_total",
+		Help: "Total number of failed ngrok tunnel operations by agent, operation and error class.",
+	}, []string{"agent", "operation", "error_class"})
+
+	servicesPendingClusterIP = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kngrok_services_pending_cluster_ip",
+		Help: "Number of services waiting on a ClusterIP to be allocated before their tunnels are started.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		activeTunnels,
+		tunnelStarts,
+		tunnelStops,
+		tunnelFailures,
+		servicesPendingClusterIP,
+	)
+}
+
+// trackedTunnel is a running tunnel of the service.
+type trackedTunnel struct {
+	Name     string
+	Port     int32
+	Protocol string
+	Agent    string
+}
+
+// serviceTracker tracks the running tunnels of the services and the services
+// waiting on a ClusterIP, since the gauges are aggregated over the services.
+type serviceTracker struct {
+	mu               sync.Mutex
+	tunnels          map[types.NamespacedName][]trackedTunnel
+	pendingClusterIP map[types.NamespacedName]struct{}
+	// active is the number of running tunnels exported by label values.
+	active map[[3]string]int
+}
+
+var tracker = newServiceTracker()
+
+func newServiceTracker() *serviceTracker {
+	return &serviceTracker{
+		tunnels:          make(map[types.NamespacedName][]trackedTunnel),
+		pendingClusterIP: make(map[types.NamespacedName]struct{}),
+		active:           make(map[[3]string]int),
+	}
+}
+
+// setTunnels records the running tunnels of the service.
+func (t *serviceTracker) setTunnels(key types.NamespacedName, tunnels []trackedTunnel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(tunnels) == 0 {
+		delete(t.tunnels, key)
+	} else {
+		t.tunnels[key] = tunnels
+	}
+
+	t.updateActiveTunnels()
+}
+
+// setPendingClusterIP records whether the service is waiting on a ClusterIP.
+func (t *serviceTracker) setPendingClusterIP(key types.NamespacedName, pending bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pending {
+		t.pendingClusterIP[key] = struct{}{}
+	} else {
+		delete(t.pendingClusterIP, key)
+	}
+
+	servicesPendingClusterIP.Set(float64(len(t.pendingClusterIP)))
+}
+
+// snapshot returns a copy of the running tunnels of the services.
+func (t *serviceTracker) snapshot() map[types.NamespacedName][]trackedTunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tunnels := make(map[types.NamespacedName][]trackedTunnel, len(t.tunnels))
+	for key, tt := range t.tunnels {
+		tunnels[key] = append([]trackedTunnel(nil), tt...)
+	}
+
+	return tunnels
+}
+
+// forget removes the deleted service from the tracked services.
+func (t *serviceTracker) forget(key types.NamespacedName) {
+	t.setTunnels(key, nil)
+	t.setPendingClusterIP(key, false)
+}
+
+func (t *serviceTracker) updateActiveTunnels() {
+	counts := make(map[[3]string]int)
+	for key, tunnels := range t.tunnels {
+		for _, tunnel := range tunnels {
+			counts[[3]string{key.Namespace, tunnel.Protocol, tunnel.Agent}]++
+		}
+	}
+
+	// only update the changed label values, and delete the ones of namespaces
+	// without running tunnels, so that a scrape never sees a partial gauge.
+	for l, count := range counts {
+		if prev, ok := t.active[l]; !ok || prev != count {
+			activeTunnels.WithLabelValues(l[0], l[1], l[2]).Set(float64(count))
+		}
+	}
+
+	for l := range t.active {
+		if _, ok := counts[l]; !ok {
+			activeTunnels.DeleteLabelValues(l[0], l[1], l[2])
+		}
+	}
+
+	t.active = counts
+}
+
+// recordFailure counts the failed tunnel operation on the agent by its error class.
+func recordFailure(agent, operation string, err error) {
+	tunnelFailures.WithLabelValues(agent, operation, errorClass(err)).Inc()
+}
+
+// errorClass returns the class of the agent API error with a bounded
+// cardinality to label the failure metrics with.
+func errorClass(err error) string {
+	var nerr nerrors.Error
+	var netErr net.Error
+	switch {
+	case nerrors.IsCircuitOpen(err):
+		return "circuit_open"
+	case errors.As(err, &nerr):
+		switch {
+		case nerr.StatusCode == http.StatusBadRequest:
+			return "bad_request"
+		case nerr.StatusCode == http.StatusNotFound:
+			return "not_found"
+		case nerr.StatusCode == http.StatusTooManyRequests:
+			return "rate_limited"
+		case nerr.StatusCode >= http.StatusInternalServerError:
+			return "server_error"
+		default:
+			return "api_error"
+		}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "connection"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "bad request", err: nerrors.Error{StatusCode: http.StatusBadRequest}, want: "bad_request"},
+		{name: "not found", err: nerrors.Error{StatusCode: http.StatusNotFound}, want: "not_found"},
+		{name: "too many requests", err: nerrors.Error{StatusCode: http.StatusTooManyRequests}, want: "rate_limited"},
+		{name: "server error", err: nerrors.Error{StatusCode: http.StatusBadGateway}, want: "server_error"},
+		{name: "other api error", err: nerrors.Error{StatusCode: http.StatusConflict}, want: "api_error"},
+		{name: "wrapped api error", err: fmt.Errorf("start: %w", nerrors.Error{StatusCode: http.StatusBadRequest}), want: "bad_request"},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: "timeout"},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: "connection"},
+		{name: "circuit open", err: &nerrors.CircuitOpenError{Agent: "default"}, want: "circuit_open"},
+		{name: "unknown", err: errors.New("boom"), want: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorClass(tt.err); got != tt.want {
+				t.Errorf("errorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceTracker(t *testing.T) {
+	tr := newServiceTracker()
+	foo := types.NamespacedName{Namespace: "default", Name: "foo"}
+	bar := types.NamespacedName{Namespace: "default", Name: "bar"}
+
+	tr.setTunnels(foo, []trackedTunnel{{Protocol: "http", Agent: "default"}, {Protocol: "tcp", Agent: "default"}})
+	tr.setTunnels(bar, []trackedTunnel{{Protocol: "http", Agent: "default"}})
+	if got := testutil.ToFloat64(activeTunnels.WithLabelValues("default", "http", "default")); got != 2 {
+		t.Errorf("active http tunnels = %v, want 2", got)
+	}
+
+	tr.setPendingClusterIP(foo, true)
+	if got := testutil.ToFloat64(servicesPendingClusterIP); got != 1 {
+		t.Errorf("services pending cluster ip = %v, want 1", got)
+	}
+
+	tr.forget(foo)
+	if got := testutil.ToFloat64(activeTunnels.WithLabelValues("default", "http", "default")); got != 1 {
+		t.Errorf("active http tunnels = %v, want 1", got)
+	}
+
+	if got := testutil.CollectAndCount(activeTunnels); got != 1 {
+		t.Errorf("active tunnels series = %v, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(servicesPendingClusterIP); got != 0 {
+		t.Errorf("services pending cluster ip = %v, want 0", got)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+func TestReconcileDeletion_AgentSelectionFails(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	var stops int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete && r.URL.Path == "/api/tunnels/default-foo" {
+			atomic.AddInt32(&stops, 1)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	registry := tunnels.NewRegistry()
+	registry.Set(tunnels.RegistryEntry{Name: "default-foo", Port: 80, Agent: "eu"})
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{v1alpha1.TunnelsAnnotation: registry.String()},
+			Finalizers:  []string{ControllerName},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+
+	// the TunnelClass references an agent pool that no longer exists.
+	class := &v1alpha1.TunnelClass{Spec: v1alpha1.TunnelClassSpec{Agent: "removed"}}
+	r := &ServiceReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc.DeepCopy()).Build(),
+		Scheme: scheme,
+		Agents: ngrok.NewAgents(ngrok.AgentConfig{Name: "eu", URL: srv.URL + "/api/"}),
+	}
+
+	if _, err := r.reconcileDeletion(context.Background(), svc, class); err != nil {
+		t.Fatalf("reconcileDeletion() unexpected error: %v", err)
+	}
+
+	if controllerutil.ContainsFinalizer(svc, ControllerName) {
+		t.Errorf("reconcileDeletion() did not remove the finalizer")
+	}
+
+	if atomic.LoadInt32(&stops) != 1 {
+		t.Errorf("reconcileDeletion() stopped the recorded tunnel %d times, want 1", stops)
+	}
+}
+
+func TestSecretToServices(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	service := func(name, class string, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				LoadBalancerClass: pointer.String(class),
+				Ports:             []corev1.ServicePort{{Name: "web", Port: 80}},
+			},
+		}
+	}
+
+	class := &v1alpha1.TunnelClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth"},
+		Spec: v1alpha1.TunnelClassSpec{
+			LoadBalancerClass: "k-ngrok.io/oauth",
+			Options:           map[string]string{v1alpha1.OAuthSecretOption: "shared-oauth"},
+		},
+	}
+
+	objs := []client.Object{
+		class,
+		service("annotated", "k-ngrok.io/default", map[string]string{"tunnel.k-ngrok.io/basic-auth": "shared-oauth"}),
+		service("port", "k-ngrok.io/default", map[string]string{"web.tunnel.k-ngrok.io/oauth-secret": "shared-oauth"}),
+		service("other", "k-ngrok.io/default", map[string]string{"tunnel.k-ngrok.io/basic-auth": "other"}),
+		service("class", "k-ngrok.io/oauth", nil),
+		service("unserved", "example.com/lb", map[string]string{"tunnel.k-ngrok.io/basic-auth": "shared-oauth"}),
+	}
+
+	r := &ServiceReconciler{
+		Client:            fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme:            scheme,
+		LoadBalancerClass: "k-ngrok.io/default",
+	}
+
+	secret := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "shared-oauth", Namespace: "default"}}
+	var got []string
+	for _, req := range r.secretToServices(secret) {
+		got = append(got, req.Name)
+	}
+
+	sort.Strings(got)
+	if want := []string{"annotated", "class", "port"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("secretToServices() = %v, want %v", got, want)
+	}
+}
+
+func TestReconcile_ThrottledRequeue(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code":100,"status_code":404,"msg":"tunnel not found"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Finalizers: []string{ControllerName}},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:         "10.0.0.1",
+			LoadBalancerClass: pointer.String("k-ngrok.io/default"),
+			Ports:             []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}
+
+	config := ngrok.DefaultAgentConfig("us")
+	config.URL = srv.URL + "/api/"
+	r := &ServiceReconciler{
+		Client:            fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc.DeepCopy()).Build(),
+		Scheme:            scheme,
+		Recorder:          record.NewFakeRecorder(10),
+		LoadBalancerClass: "k-ngrok.io/default",
+		// the empty token bucket throttles the tunnel starts without a delay.
+		Agents: ngrok.NewAgents(config).WithStartRateLimit(1, 0),
+	}
+
+	result, err := r.reconcile(context.Background(), svc, tunnels.DefaultClass("k-ngrok.io/default"))
+	if err != nil {
+		t.Fatalf("reconcile() unexpected error: %v", err)
+	}
+
+	if result.RequeueAfter < time.Second {
+		t.Errorf("reconcile() RequeueAfter = %v, want at least %v", result.RequeueAfter, time.Second)
+	}
+}
@@ -17,58 +17,126 @@ limitations under the License.
 package controllers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"net"
+	"fmt"
 	"net/url"
-	"strconv"
-	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/record"
-	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"github.com/prksu/kngrok/api/v1alpha1"
 	"github.com/prksu/kngrok/ngrok"
 	nerrors "github.com/prksu/kngrok/ngrok/errors"
+	"github.com/prksu/kngrok/tunnels"
 	"github.com/prksu/kngrok/util"
 	"github.com/prksu/kngrok/util/patch"
 )
 
 const ControllerName = "service.k-ngrok.io/controller"
 
+// minThrottledRequeue is the minimum delay before the service whose tunnel starts
+// are throttled is reconciled again.
+const minThrottledRequeue = time.Second
+
+// secretIndexKey is the field index of services by the names of the Secrets
+// referenced by their annotations.
+const secretIndexKey = ".metadata.annotations.secrets"
+
 // ServiceReconciler reconciles a Service object
 type ServiceReconciler struct {
 	client.Client
-	Scheme            *runtime.Scheme
-	Recorder          record.EventRecorder
+	// APIReader reads the objects that are not cached by the manager, such as the
+	// Secrets referenced by the services. The Client is used when nil.
+	APIReader client.Reader
+	Scheme    *runtime.Scheme
+	Recorder  record.EventRecorder
+	// Agents is the set of agents the tunnels are started on.
+	Agents *ngrok.Agents
+	// LoadBalancerClass is the service LoadBalancer class name served
+	// by the default agent when no TunnelClass is defined for it.
 	LoadBalancerClass string
+	// NamespaceSelector restricts the controller to services in namespaces
+	// whose labels match. All namespaces are selected when nil or empty.
+	NamespaceSelector labels.Selector
+	// ServerSideApply server-side applies the fields owned by the controller
+	// instead of patching the service with JSON merge patches.
+	ServerSideApply bool
+	// ForceOwnership takes the ownership of the fields applied by the controller
+	// that conflict with the fields owned by other managers.
+	ForceOwnership bool
+	// InjectTunnelURLs rolls out the workloads the public URLs of the tunnels
+	// are injected into when the URLs change.
+	InjectTunnelURLs bool
+	// PublishDNSEndpoints publishes the DNS records of the custom hostnames of
+	// the tunnels as external-dns DNSEndpoints.
+	PublishDNSEndpoints bool
 }
 
+// The namespaced rules can be granted per watched namespace with --watch-namespaces, the
+// tunnelclasses and namespaces rules are cluster-scoped, see the Namespace Scoping section
+// of the README.
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=services/finalizers,verbs=update
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;patch
+// +kubebuilder:rbac:groups=externaldns.k8s.io,resources=dnsendpoints,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=k-ngrok.io,resources=tunnelclasses,verbs=get;list;watch
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Service{}, secretIndexKey, func(obj client.Object) []string {
+		return tunnels.ReferencedSecrets(obj.(*corev1.Service))
+	}); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Service{}, builder.WithPredicates(r.ServiceWithLoadBalancerClass())).
-		Complete(r)
+		// only the ConfigMaps the URLs are published in are cached, see CacheSelectors.
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &v1alpha1.TunnelClass{}}, handler.EnqueueRequestsFromMapFunc(r.tunnelClassToServices)).
+		// only the metadata of the Secrets is watched, so that the Secrets of
+		// the whole cluster are not cached.
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretToServices), builder.OnlyMetadata)
+
+	if r.hasNamespaceSelector() {
+		// only watch namespaces when the selector is used so the controller
+		// can run without permission to read namespaces otherwise.
+		b = b.Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.namespaceToServices))
+	}
+
+	if r.PublishDNSEndpoints {
+		// the DNSEndpoint CRD is only required when the records are published.
+		b = b.Owns(newDNSEndpoint(&corev1.Service{}))
+	}
+
+	return b.Complete(r)
 }
 
 // ServiceWithLoadBalancerClass returns predicate funcs that filter the service
-// with given LoadBalancer class name on CREATE, UPDATE, DELETE and GENERIC events.
+// with served LoadBalancer class name on CREATE, UPDATE, DELETE and GENERIC events.
+// The service that has been handled by the controller is always accepted
+// so its tunnels can be stopped once the LoadBalancer class is no longer served.
 func (r *ServiceReconciler) ServiceWithLoadBalancerClass() predicate.Predicate {
 	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
 		svc, ok := obj.(*corev1.Service)
@@ -76,134 +144,445 @@ func (r *ServiceReconciler) ServiceWithLoadBalancerClass() predicate.Predicate {
 			return false
 		}
 
-		return r.LoadBalancerClass == pointer.StringDeref(svc.Spec.LoadBalancerClass, "")
+		return r.served(context.TODO(), svc) || controllerutil.ContainsFinalizer(svc, ControllerName)
 	})
 }
 
+// served returns true if the LoadBalancer class of the service is served by the controller.
+func (r *ServiceReconciler) served(ctx context.Context, svc *corev1.Service) bool {
+	class, err := tunnels.ClassFor(ctx, r.Client, r.LoadBalancerClass, svc)
+	return err == nil && class != nil
+}
+
+// tunnelClassToServices maps the TunnelClass to the requests of services with
+// its LoadBalancer class, so that they are reconciled whenever the TunnelClass
+// is changed.
+func (r *ServiceReconciler) tunnelClassToServices(obj client.Object) []reconcile.Request {
+	class, ok := obj.(*v1alpha1.TunnelClass)
+	if !ok {
+		return nil
+	}
+
+	svcs := &corev1.ServiceList{}
+	if err := r.List(context.TODO(), svcs); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, svc := range svcs.Items {
+		if svc.Spec.LoadBalancerClass == nil || *svc.Spec.LoadBalancerClass != class.Spec.LoadBalancerClass {
+			continue
+		}
+
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&svc)})
+	}
+
+	return reqs
+}
+
+// secretToServices maps the Secret to the requests of services in its namespace
+// that reference it, so that their tunnels are restarted whenever the Secret is changed.
+// The services are looked up by the Secret index, and by the LoadBalancer class of
+// the TunnelClasses whose options reference the Secret.
+func (r *ServiceReconciler) secretToServices(obj client.Object) []reconcile.Request {
+	ctx := context.TODO()
+	candidates := &corev1.ServiceList{}
+	if err := r.List(ctx, candidates, client.InNamespace(obj.GetNamespace()), client.MatchingFields{secretIndexKey: obj.GetName()}); err != nil {
+		return nil
+	}
+
+	classes := &v1alpha1.TunnelClassList{}
+	if err := r.List(ctx, classes); err != nil {
+		return nil
+	}
+
+	for _, class := range classes.Items {
+		if !classReferences(&class, obj.GetName()) {
+			continue
+		}
+
+		svcs := &corev1.ServiceList{}
+		if err := r.List(ctx, svcs, client.InNamespace(obj.GetNamespace())); err != nil {
+			return nil
+		}
+
+		for _, svc := range svcs.Items {
+			if svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass == class.Spec.LoadBalancerClass {
+				candidates.Items = append(candidates.Items, svc)
+			}
+		}
+	}
+
+	seen := sets.NewString()
+	var reqs []reconcile.Request
+	for _, svc := range candidates.Items {
+		if seen.Has(svc.Name) {
+			continue
+		}
+
+		seen.Insert(svc.Name)
+		class, err := tunnels.ClassFor(ctx, r.Client, r.LoadBalancerClass, &svc)
+		if err != nil || class == nil || !tunnels.References(&svc, class, obj.GetName()) {
+			continue
+		}
+
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&svc)})
+	}
+
+	return reqs
+}
+
+// classReferences returns true if the options of the TunnelClass reference the Secret with given name.
+func classReferences(class *v1alpha1.TunnelClass, secretName string) bool {
+	for _, ref := range tunnels.SecretReferences {
+		if name, ok := class.Spec.Options[ref.Option]; ok && name == secretName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namespaceToServices maps the namespace to the requests of services in it
+// with the served LoadBalancer class, so that they are reconciled whenever
+// the namespace labels are changed.
+func (r *ServiceReconciler) namespaceToServices(obj client.Object) []reconcile.Request {
+	ctx := context.TODO()
+	svcs := &corev1.ServiceList{}
+	if err := r.List(ctx, svcs, client.InNamespace(obj.GetName())); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, svc := range svcs.Items {
+		if !r.served(ctx, &svc) && !controllerutil.ContainsFinalizer(&svc, ControllerName) {
+			continue
+		}
+
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&svc)})
+	}
+
+	return reqs
+}
+
+func (r *ServiceReconciler) hasNamespaceSelector() bool {
+	return r.NamespaceSelector != nil && !r.NamespaceSelector.Empty()
+}
+
+// apiReader returns the reader of the objects that are not cached by the manager.
+func (r *ServiceReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+
+	return r.Client
+}
+
+// namespaceSelected returns true if the namespace with given name matches the NamespaceSelector.
+func (r *ServiceReconciler) namespaceSelected(ctx context.Context, name string) (bool, error) {
+	if !r.hasNamespaceSelector() {
+		return true, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: name}, ns); err != nil {
+		return false, err
+	}
+
+	return r.NamespaceSelector.Matches(labels.Set(ns.GetLabels())), nil
+}
+
+// agentFor returns the name of the agent that runs the tunnels of the service, and the agent.
+func (r *ServiceReconciler) agentFor(svc *corev1.Service, class *v1alpha1.TunnelClass) (string, ngrok.Agent, error) {
+	if class == nil {
+		// the LoadBalancer class is no longer served, the tunnels
+		// are assumed to run on the default class agent.
+		class = tunnels.DefaultClass(r.LoadBalancerClass)
+	}
+
+	name, err := tunnels.AgentFor(r.Agents, svc, class)
+	if err != nil {
+		return "", nil, err
+	}
+
+	agent, _ := r.Agents.Get(name)
+	return name, agent, nil
+}
+
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, reterr error) {
 	log := ctrl.LoggerFrom(ctx)
 	svc := &corev1.Service{}
 	if err := r.Get(ctx, req.NamespacedName, svc); err != nil {
 		if apierrors.IsNotFound(err) {
 			// Return early if requested service is not found.
 			log.V(1).Info("Requested service is not found or already deleted")
+			tracker.forget(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 
 		return ctrl.Result{}, err
 	}
 
+	tracker.setPendingClusterIP(req.NamespacedName, svc.Spec.ClusterIP == "")
 	if svc.Spec.ClusterIP == "" {
 		return ctrl.Result{RequeueAfter: 3 * time.Second}, nil
 	}
 
-	patcher, err := patch.NewPatcher(r.Client, svc)
+	class, err := tunnels.ClassFor(ctx, r.Client, r.LoadBalancerClass, svc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	patchOpts := []client.PatchOption{client.FieldOwner(ControllerName)}
+	var patcherOpts []patch.Option
+	if r.ServerSideApply {
+		patcherOpts = append(patcherOpts, patch.WithServerSideApply(serviceApplyConfiguration))
+		if r.ForceOwnership {
+			patchOpts = append(patchOpts, client.ForceOwnership)
+		}
+	} else {
+		patcherOpts = append(patcherOpts, patch.WithOptimisticLock(), patch.WithOwnedConditions(ownedConditions...))
+	}
+
+	patcher, err := patch.NewPatcher(r.Client, svc, patcherOpts...)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
 	defer func() {
-		if err := patcher.Patch(ctx, svc, client.FieldOwner(ControllerName)); err != nil {
+		// requeue after the cool-down of the unavailable agent instead of
+		// returning the error, so it is not hammered at the requeue rate.
+		if d, ok := retryAfter(reterr); ok {
+			log.Info("Agent is unavailable, requeue after cool-down", "after", d, "reason", reterr.Error())
+			result, reterr = ctrl.Result{RequeueAfter: d}, nil
+		}
+	}()
+
+	defer func() {
+		if err := patcher.Patch(ctx, svc, patchOpts...); err != nil {
 			reterr = err
 		}
 	}()
 
 	if !svc.GetDeletionTimestamp().IsZero() {
-		return r.reconcileDeletion(ctx, svc)
+		return r.reconcileDeletion(ctx, svc, class)
 	}
 
-	return r.reconcile(ctx, svc)
+	selected, err := r.namespaceSelected(ctx, svc.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !selected || class == nil {
+		log.V(1).Info("Service is not served by the controller")
+		if !controllerutil.ContainsFinalizer(svc, ControllerName) {
+			return ctrl.Result{}, nil
+		}
+
+		// the namespace has opted-out or the LoadBalancer class is no longer
+		// served after the service was exposed, stop its tunnels and release
+		// the ingress status.
+		svc.Status.LoadBalancer.Ingress = nil
+		meta.RemoveStatusCondition(&svc.Status.Conditions, v1alpha1.TunnelsReadyCondition)
+		meta.RemoveStatusCondition(&svc.Status.Conditions, v1alpha1.DNSRecordsPublishedCondition)
+		return r.reconcileDeletion(ctx, svc, class)
+	}
+
+	return r.reconcile(ctx, svc, class)
 }
 
-func (r *ServiceReconciler) reconcile(ctx context.Context, svc *corev1.Service) (_ ctrl.Result, reterr error) {
+func (r *ServiceReconciler) reconcile(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass) (_ ctrl.Result, reterr error) {
 	var (
-		log              = ctrl.LoggerFrom(ctx)
-		errs             []error
-		ingress          []corev1.LoadBalancerIngress
-		currentTunnelSet = sets.NewString()
-		desiredTunnelSet = sets.NewString()
+		log             = ctrl.LoggerFrom(ctx)
+		errs            []error
+		ingress         []corev1.LoadBalancerIngress
+		desiredRegistry = tunnels.NewRegistry()
+		resolver        = &tunnels.Resolver{Client: r.apiReader()}
+		throttled       int
+		throttledAfter  time.Duration
 	)
 
+	agentName, agent, err := r.agentFor(svc, class)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	if svc.Annotations == nil {
 		svc.Annotations = make(map[string]string)
 	}
 
-	if r, ok := svc.Annotations["service.k-ngrok.io/tunnels"]; ok {
-		// populate currentTunnelSet record from registry annotation.
-		// it will be compared against desiredTunnelSet that will be
-		// populated according to the desired service ports
-		var cur []string
-		if err := json.NewDecoder(bytes.NewReader([]byte(r))).Decode(&cur); err != nil {
-			return ctrl.Result{}, err
-		}
+	// the current registry is compared against the desired registry that will be
+	// populated according to the desired service ports.
+	currentRegistry, err := tunnels.ParseRegistry(svc.Annotations)
+	if err != nil {
+		// recover the tunnels of the service ports from the agent instead of failing
+		// forever, only the stale tunnels that could not be parsed are left running.
+		log.Error(err, "Unable to parse tunnel registry, recovering it")
+		r.Recorder.Eventf(svc, corev1.EventTypeWarning, "InvalidTunnelRegistry", "Unable to parse tunnel registry, recovering it from the agent: %v", err)
+	}
 
-		currentTunnelSet.Insert(cur...)
+	for i := range currentRegistry.Tunnels {
+		if currentRegistry.Tunnels[i].Agent == "" {
+			// the tunnels migrated from the unversioned registry run on the agent of the service.
+			currentRegistry.Tunnels[i].Agent = agentName
+		}
 	}
 
 	defer func() {
-		// always store actual running tunnel names into registry annotation.
-		registry := new(bytes.Buffer)
-		if err := json.NewEncoder(registry).Encode(desiredTunnelSet.List()); err != nil {
-			reterr = err
+		// always store actual running tunnels into registry annotation.
+		svc.Annotations[v1alpha1.TunnelsAnnotation] = desiredRegistry.String()
+		delete(svc.Annotations, v1alpha1.TunnelHashesAnnotation)
+
+		var running []trackedTunnel
+		for _, sp := range svc.Spec.Ports {
+			if entry, ok := desiredRegistry.Get(tunnels.Name(svc, sp)); ok {
+				running = append(running, trackedTunnel{Name: entry.Name, Port: sp.Port, Protocol: tunnels.Protocol(svc, class, sp), Agent: entry.Agent})
+			}
 		}
 
-		svc.Annotations["service.k-ngrok.io/tunnels"] = registry.String()
+		tracker.setTunnels(client.ObjectKeyFromObject(svc), running)
+
+		if err := r.publishURLs(ctx, svc, desiredRegistry); err != nil {
+			log.Error(err, "Unable to publish tunnel URLs")
+			reterr = kerrors.NewAggregate([]error{reterr, err})
+		}
+
+		if r.PublishDNSEndpoints {
+			if err := r.publishDNSEndpoint(ctx, svc, class, desiredRegistry); err != nil {
+				log.Error(err, "Unable to publish DNS endpoint")
+				reterr = kerrors.NewAggregate([]error{reterr, err})
+			}
+		}
 	}()
 
 	controllerutil.AddFinalizer(svc, ControllerName)
-	svckey := client.ObjectKeyFromObject(svc)
 	for _, sp := range svc.Spec.Ports {
-		tunnelName := strings.ReplaceAll(svckey.String(), "/", "-")
-		if len(svc.Spec.Ports) > 1 || sp.Name != "" {
-			// add port name in the end of tunnelName when it's defined or
-			// more than one ports is defined.
-			tunnelName = tunnelName + "-" + sp.Name
+		tunnelName := tunnels.Name(svc, sp)
+		desired, err := resolver.Resolve(ctx, svc, class, sp)
+		if err != nil {
+			log.Error(err, "Unable to resolve tunnel config", "tunnelName", tunnelName)
+			r.Recorder.Eventf(svc, corev1.EventTypeWarning, "InvalidTunnelConfig", "Unable to resolve tunnel config for port: '%d': %v", sp.Port, err)
+			errs = append(errs, err)
+			if entry, ok := currentRegistry.Get(tunnelName); ok {
+				// keep the running tunnel with its previous config until the config can be resolved.
+				desiredRegistry.Set(entry)
+			}
+
+			continue
+		}
+
+		current, running := currentRegistry.Get(tunnelName)
+		if running && current.Agent != agentName {
+			// the tunnel is started on the agent of the service, the tunnel
+			// running on the previous agent is stopped as a stale tunnel.
+			running = false
 		}
 
 		log.V(1).Info("Find existing tunnel", "tunnelName", tunnelName)
-		tunnel, err := ngrok.DefaultAgent.Find(ctx, tunnelName)
+		tunnel, err := agent.Find(ctx, tunnelName)
 		if err != nil && !nerrors.IsNotFound(err) {
 			log.V(1).Error(err, "Unable to find existing tunnel")
+			recordFailure(agentName, "find", err)
 			errs = append(errs, err)
 			continue
 		}
 
+		restart := false
+		startTime := current.StartTime
+		if running && current.Hash != "" && tunnel != nil && current.Hash != desired.Hash {
+			// restart the tunnel to apply the changed config,
+			// e.g. when the referenced Secret has changed.
+			log.V(1).Info("Tunnel config changed. Stopping tunnel", "tunnelName", tunnelName)
+			err := agent.Stop(ctx, tunnelName)
+			if err != nil && !nerrors.IsNotFound(err) {
+				log.Error(err, "Unable to stop tunnel", "tunnelName", tunnelName)
+				recordFailure(agentName, "stop", err)
+				errs = append(errs, err)
+				continue
+			}
+
+			if err == nil {
+				tunnelStops.WithLabelValues(agentName).Inc()
+			}
+
+			restart = true
+			tunnel = nil
+		}
+
 		if tunnel == nil || nerrors.IsNotFound(err) {
 			// start new tunnel if it is not exist.
 			log.V(1).Info("No existing tunnel found. Starting new tunnel", "tunnelName", tunnelName)
-			if tunnel, err = ngrok.DefaultAgent.Start(ctx, tunnelName, ngrok.TunnelConfig{
-				Addr:  net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(sp.Port))),
-				Proto: strings.ToLower(string(sp.Protocol)),
-			}); err != nil {
+			if err := r.writeCertificate(agentName, tunnelName, desired); err != nil {
+				log.Error(err, "Unable to write tunnel certificate", "tunnelName", tunnelName)
+				r.Recorder.Eventf(svc, corev1.EventTypeWarning, "InvalidTunnelConfig", "Unable to write the certificate of tunnel for port: '%d': %v", sp.Port, err)
+				errs = append(errs, err)
+				continue
+			}
+
+			if tunnel, err = agent.Start(ctx, tunnelName, desired.Config); err != nil {
+				if d, ok := nerrors.RetryAfter(err); ok && nerrors.IsThrottled(err) {
+					// the tunnel is started once the rate limit allows it.
+					log.V(1).Info("Tunnel start is throttled", "tunnelName", tunnelName, "after", d)
+					throttled++
+					if d > throttledAfter {
+						throttledAfter = d
+					}
+
+					continue
+				}
+
 				log.Error(err, "Unable to starting new tunnel", "tunnelName", tunnelName)
+				recordFailure(agentName, "start", err)
+				if desired.Config.IPRestriction != nil && nerrors.IsBadRequest(err) {
+					// the agent rejects the tunnel config it does not understand, or the
+					// ngrok account plan does not include IP policies.
+					r.Recorder.Eventf(svc, corev1.EventTypeWarning, "IPRestrictionUnsupported",
+						"Unable to start ngrok tunnel for port: '%d' with IP restriction, the agent or the ngrok plan may not support IP policies: %v", sp.Port, err)
+				}
+
 				errs = append(errs, err)
 				continue
 			}
 
+			tunnelStarts.WithLabelValues(agentName).Inc()
+			now := metav1.Now()
+			startTime = &now
 			u, _ := url.Parse(tunnel.PublicURL)
 			log.V(1).Info("Started ngrok tunnel", "tunnelName", tunnelName, "port", sp.Port, "on", u.Host)
-			r.Recorder.Eventf(svc, corev1.EventTypeNormal, "TunnelStarted", "Started ngrok tunnel for port: '%d' on addr: %s", sp.Port, u.Host)
+			if restart {
+				r.Recorder.Eventf(svc, corev1.EventTypeNormal, "TunnelRestarted", "Restarted ngrok tunnel for port: '%d' on addr: %s", sp.Port, u.Host)
+			} else {
+				r.Recorder.Eventf(svc, corev1.EventTypeNormal, "TunnelStarted", "Started ngrok tunnel for port: '%d' on addr: %s", sp.Port, u.Host)
+			}
 		}
 
 		hostname, port, err := util.SplitHostPort(tunnel.PublicURL)
 		if err != nil {
 			log.Error(err, "Unable to parse tunnel public_url", "tunnelName", tunnelName)
 			errs = append(errs, err)
-			// insert the new started tunnel into currentTunnelSet if we got unexpected error here
+			// insert the new started tunnel into currentRegistry if we got unexpected error here
 			// and treat the tunnel to be stale so it will be stopped soon.
-			currentTunnelSet.Insert(tunnelName)
+			currentRegistry.Set(tunnels.RegistryEntry{Name: tunnelName, Agent: agentName})
 			continue
 		}
 
-		desiredTunnelSet.Insert(tunnelName)
+		desiredRegistry.Set(tunnels.RegistryEntry{
+			Name:      tunnelName,
+			Port:      sp.Port,
+			Agent:     agentName,
+			PublicURL: tunnel.PublicURL,
+			Hash:      desired.Hash,
+			StartTime: startTime,
+		})
 		ingress = append(ingress, corev1.LoadBalancerIngress{
 			Hostname: hostname,
 			Ports: []corev1.PortStatus{
 				{
-					Port:     port,
-					Protocol: corev1.Protocol(strings.ToUpper(tunnel.Proto)),
+					Port: port,
+					// http, https and tls tunnels are all served over TCP.
+					Protocol: corev1.ProtocolTCP,
 				},
 			},
 		})
@@ -212,60 +591,209 @@ func (r *ServiceReconciler) reconcile(ctx context.Context, svc *corev1.Service)
 	if err := func() error {
 		log.V(1).Info("Ensure no stale tunnel is running")
 		var errs []error
-		for _, tunnelName := range currentTunnelSet.Difference(desiredTunnelSet).List() {
-			// stop any tunnel in the currentTunnelSet that are not in the desiredTunnelSet
-			// to keep the actual tunnel running as desired.
-			log.V(1).Info("Stopping stale tunnel", "tunnelName", tunnelName)
-			if err := ngrok.DefaultAgent.Stop(ctx, tunnelName); err != nil && !nerrors.IsNotFound(err) {
+		for _, stale := range currentRegistry.Tunnels {
+			// stop any tunnel in the currentRegistry that is not in the desiredRegistry,
+			// or that runs on another agent, to keep the actual tunnel running as desired.
+			if entry, ok := desiredRegistry.Get(stale.Name); ok && entry.Agent == stale.Agent {
+				continue
+			}
+
+			staleAgent, ok := r.Agents.Get(stale.Agent)
+			if !ok {
+				log.Info("Agent of stale tunnel is no longer configured", "tunnelName", stale.Name, "agent", stale.Agent)
+				continue
+			}
+
+			log.V(1).Info("Stopping stale tunnel", "tunnelName", stale.Name, "agent", stale.Agent)
+			if err := r.stopTunnel(ctx, stale.Agent, staleAgent, stale.Name); err != nil {
 				errs = append(errs, err)
+				// keep the stale tunnel recorded so it is stopped on the next reconcile.
+				if _, ok := desiredRegistry.Get(stale.Name); !ok {
+					desiredRegistry.Set(stale)
+				}
+
 				continue
 			}
 
-			log.V(1).Info("Stopped stale tunnel", "tunnelName", tunnelName)
+			log.V(1).Info("Stopped stale tunnel", "tunnelName", stale.Name, "agent", stale.Agent)
 		}
 
 		return kerrors.NewAggregate(errs)
 	}(); err != nil {
+		setTunnelsReady(svc, metav1.ConditionFalse, v1alpha1.TunnelFailedReason, err.Error())
 		return ctrl.Result{}, err
 	}
 
 	if err := kerrors.NewAggregate(errs); err != nil {
+		setTunnelsReady(svc, metav1.ConditionFalse, v1alpha1.TunnelFailedReason, err.Error())
 		return ctrl.Result{}, err
 	}
 
 	svc.Status.LoadBalancer.Ingress = ingress
+	if throttled > 0 {
+		setTunnelsReady(svc, metav1.ConditionFalse, v1alpha1.ThrottledReason,
+			fmt.Sprintf("%d tunnel(s) waiting for the tunnel start rate limit of agent %q", throttled, agentName))
+		if throttledAfter < minThrottledRequeue {
+			// a zero RequeueAfter would never requeue the service.
+			throttledAfter = minThrottledRequeue
+		}
+
+		return ctrl.Result{RequeueAfter: throttledAfter}, nil
+	}
+
+	setTunnelsReady(svc, metav1.ConditionTrue, v1alpha1.TunnelsRunningReason, "The tunnels of all the service ports are running")
 	return ctrl.Result{}, nil
 }
 
-func (r *ServiceReconciler) reconcileDeletion(ctx context.Context, svc *corev1.Service) (ctrl.Result, error) {
+// setTunnelsReady sets the TunnelsReadyCondition of the service.
+func setTunnelsReady(svc *corev1.Service, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.TunnelsReadyCondition,
+		Status:             status,
+		ObservedGeneration: svc.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+func (r *ServiceReconciler) reconcileDeletion(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass) (ctrl.Result, error) {
 	var (
 		log  = ctrl.LoggerFrom(ctx)
 		errs []error
 	)
 
-	svckey := client.ObjectKeyFromObject(svc)
-	for _, sp := range svc.Spec.Ports {
-		tunnelName := strings.ReplaceAll(svckey.String(), "/", "-")
-		if len(svc.Spec.Ports) > 1 || sp.Name != "" {
-			// add port name in the end of tunnelName when it's defined or
-			// more than one ports is defined.
-			tunnelName = tunnelName + "-" + sp.Name
+	stopped := sets.NewString()
+	agentName, agent, err := r.agentFor(svc, class)
+	if err != nil {
+		// e.g. the TunnelClass or the agent of the region was removed, the
+		// tunnels are only stopped on the agents recorded in the registry so
+		// the selection never blocks the removal of the finalizer.
+		log.Info("Unable to select the agent of the service, stopping the recorded tunnels only", "reason", err.Error())
+	} else {
+		for _, sp := range svc.Spec.Ports {
+			tunnelName := tunnels.Name(svc, sp)
+			stopped.Insert(tunnelName)
+			log.Info("Stopping tunnel", "tunnelName", tunnelName)
+			if err := r.stopTunnel(ctx, agentName, agent, tunnelName); err != nil {
+				log.Error(err, "Failed stopping the tunnel", "tunnelName", tunnelName)
+				errs = append(errs, err)
+				continue
+			}
+
+			log.V(1).Info("Stopped tunnel", "tunnelName", tunnelName)
 		}
+	}
 
-		log.Info("Stopping tunnel", "tunnelName", tunnelName)
-		if err := ngrok.DefaultAgent.Stop(ctx, tunnelName); err != nil && !nerrors.IsNotFound(err) {
-			log.Error(err, "Failed stopping the tunnel", "tunnelName", tunnelName)
-			errs = append(errs, err)
+	// also stop the recorded tunnels of the removed ports, and the
+	// tunnels left running on a previous agent of the service.
+	registry, _ := tunnels.ParseRegistry(svc.Annotations)
+	for _, entry := range registry.Tunnels {
+		if entry.Agent == "" {
+			entry.Agent = agentName
+		}
+
+		if entry.Agent == "" || (entry.Agent == agentName && stopped.Has(entry.Name)) {
+			continue
+		}
+
+		entryAgent, ok := r.Agents.Get(entry.Agent)
+		if !ok {
+			log.Info("Agent of recorded tunnel is no longer configured", "tunnelName", entry.Name, "agent", entry.Agent)
 			continue
 		}
 
-		log.V(1).Info("Stopped tunnel", "tunnelName", tunnelName)
+		log.Info("Stopping tunnel", "tunnelName", entry.Name, "agent", entry.Agent)
+		if err := r.stopTunnel(ctx, entry.Agent, entryAgent, entry.Name); err != nil {
+			log.Error(err, "Failed stopping the tunnel", "tunnelName", entry.Name, "agent", entry.Agent)
+			errs = append(errs, err)
+		}
 	}
 
 	if err := kerrors.NewAggregate(errs); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	if err := r.unpublishURLs(ctx, svc); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if r.PublishDNSEndpoints {
+		if err := r.unpublishDNSEndpoint(ctx, svc); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	tracker.setTunnels(client.ObjectKeyFromObject(svc), nil)
 	controllerutil.RemoveFinalizer(svc, ControllerName)
 	return ctrl.Result{}, nil
 }
+
+// stopTunnel stops the named tunnel on the agent. A tunnel that is not running is ignored.
+func (r *ServiceReconciler) stopTunnel(ctx context.Context, agentName string, agent ngrok.Agent, tunnelName string) error {
+	err := agent.Stop(ctx, tunnelName)
+	if err != nil && !nerrors.IsNotFound(err) {
+		recordFailure(agentName, "stop", err)
+		return err
+	}
+
+	if err == nil {
+		tunnelStops.WithLabelValues(agentName).Inc()
+	}
+
+	// the certificate of the tls tunnel is no longer read by the agent.
+	return r.writeCertificate(agentName, tunnelName, nil)
+}
+
+// writeCertificate writes the certificate of the tls tunnel into the certificate directory
+// of the agent, and sets the paths the agent reads them from into the tunnel config. The
+// files of the tunnel are removed when the certificate is nil.
+func (r *ServiceReconciler) writeCertificate(agentName, tunnelName string, tunnel *tunnels.Tunnel) error {
+	config, _ := r.Agents.Config(agentName)
+	if tunnel == nil || tunnel.Certificate == nil {
+		if config.CertDir == "" {
+			return nil
+		}
+
+		return tunnels.RemoveCertificate(config.CertDir, tunnelName)
+	}
+
+	if config.CertDir == "" {
+		return fmt.Errorf("agent %q has no certificate directory to terminate tls tunnels", agentName)
+	}
+
+	crt, key, err := tunnels.WriteCertificate(config.CertDir, tunnelName, tunnel.Certificate)
+	if err != nil {
+		return err
+	}
+
+	tunnel.Config.Crt, tunnel.Config.Key = crt, key
+	return nil
+}
+
+// retryAfter returns the longest delay to wait before retrying when all the
+// aggregated errors are due to an agent asking to retry after a delay or
+// whose circuit breaker is open.
+func retryAfter(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+
+	errs := []error{err}
+	if agg, ok := err.(kerrors.Aggregate); ok {
+		errs = agg.Errors()
+	}
+
+	var after time.Duration
+	for _, err := range errs {
+		d, ok := nerrors.RetryAfter(err)
+		if !ok {
+			return 0, false
+		}
+
+		if d > after {
+			after = d
+		}
+	}
+
+	return after, true
+}
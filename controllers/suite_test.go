@@ -38,6 +38,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -77,6 +80,9 @@ var _ = BeforeSuite(func() {
 	err := clientgoscheme.AddToScheme(scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = v1alpha1.AddToScheme(scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	cfg, err = testenv.Start()
 	Expect(err).NotTo(HaveOccurred())
 	Expect(cfg).NotTo(BeNil())
@@ -95,6 +101,7 @@ var _ = BeforeSuite(func() {
 	err = (&ServiceReconciler{
 		Client:            mgr.GetClient(),
 		Scheme:            mgr.GetScheme(),
+		Agents:            ngrok.NewAgents(ngrok.DefaultAgentConfig("us")),
 		LoadBalancerClass: "service.k-ngrok.io/controller",
 		Recorder:          new(record.FakeRecorder),
 	}).SetupWithManager(mgr)
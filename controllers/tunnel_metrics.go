@@ -0,0 +1,188 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/prksu/kngrok/ngrok"
+)
+
+const (
+	// tunnelMetricsTimeout bounds the agent API calls made on scrapes.
+	tunnelMetricsTimeout = 5 * time.Second
+	// tunnelMetricsMaxAge is how long the tunnels listed from an agent are reused
+	// by the following scrapes, so that concurrent scrapers do not load the agents.
+	tunnelMetricsMaxAge = 10 * time.Second
+)
+
+var (
+	tunnelLabelNames = []string{"namespace", "service", "port"}
+
+	tunnelConnsDesc = prometheus.NewDesc("kngrok_tunnel_connections_total",
+		"Total number of connections to the tunnel of the service port.", tunnelLabelNames, nil)
+	tunnelConnsOpenDesc = prometheus.NewDesc("kngrok_tunnel_connections_open",
+		"Number of open connections to the tunnel of the service port.", tunnelLabelNames, nil)
+	tunnelConnsRateDesc = prometheus.NewDesc("kngrok_tunnel_connections_rate",
+		"Per-second rate of connections to the tunnel of the service port averaged over the window.", append(tunnelLabelNames, "window"), nil)
+	tunnelConnsDurationDesc = prometheus.NewDesc("kngrok_tunnel_connection_duration_seconds",
+		"Duration percentiles of the connections to the tunnel of the service port, as computed by the agent.", append(tunnelLabelNames, "percentile"), nil)
+	tunnelHTTPDesc = prometheus.NewDesc("kngrok_tunnel_http_requests_total",
+		"Total number of http requests to the tunnel of the service port.", tunnelLabelNames, nil)
+	tunnelHTTPRateDesc = prometheus.NewDesc("kngrok_tunnel_http_requests_rate",
+		"Per-second rate of http requests to the tunnel of the service port averaged over the window.", append(tunnelLabelNames, "window"), nil)
+	tunnelHTTPDurationDesc = prometheus.NewDesc("kngrok_tunnel_http_request_duration_seconds",
+		"Duration percentiles of the http requests to the tunnel of the service port, as computed by the agent.", append(tunnelLabelNames, "percentile"), nil)
+	tunnelMetricsErrorsDesc = prometheus.NewDesc("kngrok_tunnel_metrics_scrape_error",
+		"1 if the tunnel metrics could not be read from the agent on the last scrape, 0 otherwise.", []string{"agent"}, nil)
+)
+
+// tunnelMetricsCollector collects the traffic metrics the agents report for the
+// running tunnels, labelled with the namespace, name and port of their service.
+// Only the tunnels tracked by the reconciler are collected, so the metrics are
+// exported by the leader.
+type tunnelMetricsCollector struct {
+	agents  *ngrok.Agents
+	tracker *serviceTracker
+	// maxAge is how long the tunnels listed from an agent are reused.
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	lists map[string]agentTunnels
+}
+
+// agentTunnels are the tunnels listed from an agent.
+type agentTunnels struct {
+	tunnels  []ngrok.Tunnel
+	err      error
+	listedAt time.Time
+}
+
+var _ prometheus.Collector = &tunnelMetricsCollector{}
+
+// RegisterTunnelMetrics registers the collector of the traffic metrics of the
+// tunnels running on the agents with the registry.
+func RegisterTunnelMetrics(registry prometheus.Registerer, agents *ngrok.Agents) error {
+	return registry.Register(newTunnelMetricsCollector(agents, tracker))
+}
+
+func newTunnelMetricsCollector(agents *ngrok.Agents, tracker *serviceTracker) *tunnelMetricsCollector {
+	return &tunnelMetricsCollector{
+		agents:  agents,
+		tracker: tracker,
+		maxAge:  tunnelMetricsMaxAge,
+		lists:   make(map[string]agentTunnels),
+	}
+}
+
+func (c *tunnelMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelConnsDesc
+	ch <- tunnelConnsOpenDesc
+	ch <- tunnelConnsRateDesc
+	ch <- tunnelConnsDurationDesc
+	ch <- tunnelHTTPDesc
+	ch <- tunnelHTTPRateDesc
+	ch <- tunnelHTTPDurationDesc
+	ch <- tunnelMetricsErrorsDesc
+}
+
+func (c *tunnelMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelMetricsTimeout)
+	defer cancel()
+
+	type owner struct {
+		key  types.NamespacedName
+		port int32
+	}
+
+	// group the tracked tunnels by agent so each agent is queried once.
+	owners := make(map[string]map[string]owner)
+	for key, tunnels := range c.tracker.snapshot() {
+		for _, tunnel := range tunnels {
+			if owners[tunnel.Agent] == nil {
+				owners[tunnel.Agent] = make(map[string]owner)
+			}
+
+			owners[tunnel.Agent][tunnel.Name] = owner{key: key, port: tunnel.Port}
+		}
+	}
+
+	for agentName, tunnelOwners := range owners {
+		agent, ok := c.agents.Get(agentName)
+		if !ok {
+			continue
+		}
+
+		list, err := c.list(ctx, agentName, agent)
+		if err != nil {
+			ctrl.Log.WithName("metrics").V(1).Error(err, "Unable to list tunnels for metrics", "agent", agentName)
+			ch <- prometheus.MustNewConstMetric(tunnelMetricsErrorsDesc, prometheus.GaugeValue, 1, agentName)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(tunnelMetricsErrorsDesc, prometheus.GaugeValue, 0, agentName)
+		for _, tunnel := range list {
+			o, ok := tunnelOwners[tunnel.Name]
+			if !ok || tunnel.Metrics == nil {
+				continue
+			}
+
+			labels := []string{o.key.Namespace, o.key.Name, strconv.Itoa(int(o.port))}
+			collectMetrics(ch, labels, tunnel.Metrics.Conns, tunnelConnsDesc, tunnelConnsRateDesc, tunnelConnsDurationDesc)
+			ch <- prometheus.MustNewConstMetric(tunnelConnsOpenDesc, prometheus.GaugeValue, float64(tunnel.Metrics.Conns.Gauge), labels...)
+			if tunnel.Proto == "http" || tunnel.Proto == "https" {
+				collectMetrics(ch, labels, tunnel.Metrics.HTTP, tunnelHTTPDesc, tunnelHTTPRateDesc, tunnelHTTPDurationDesc)
+			}
+		}
+	}
+}
+
+// list returns the tunnels of the agent, listed at most maxAge ago. The concurrent
+// scrapes wait for the tunnels being listed instead of listing them again.
+func (c *tunnelMetricsCollector) list(ctx context.Context, agentName string, agent ngrok.Agent) ([]ngrok.Tunnel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.lists[agentName]; ok && time.Since(l.listedAt) < c.maxAge {
+		return l.tunnels, l.err
+	}
+
+	tunnels, err := agent.List(ctx)
+	c.lists[agentName] = agentTunnels{tunnels: tunnels, err: err, listedAt: time.Now()}
+	return tunnels, err
+}
+
+// collectMetrics sends the count, the rates and the duration percentiles of the
+// metrics as the series of the given descriptors. The percentiles are computed by
+// the agent, so they are exported as gauges with a percentile label rather than as
+// a summary, whose quantile label they would be mistaken for.
+func collectMetrics(ch chan<- prometheus.Metric, labels []string, m ngrok.Metrics, count, rate, duration *prometheus.Desc) {
+	ch <- prometheus.MustNewConstMetric(count, prometheus.CounterValue, float64(m.Count), labels...)
+	for window, v := range map[string]float64{"1m": m.Rate1, "5m": m.Rate5, "15m": m.Rate15} {
+		ch <- prometheus.MustNewConstMetric(rate, prometheus.GaugeValue, v, append(labels, window)...)
+	}
+
+	for percentile, ns := range map[string]float64{"50": m.P50, "90": m.P90, "95": m.P95, "99": m.P99} {
+		ch <- prometheus.MustNewConstMetric(duration, prometheus.GaugeValue, ns/float64(time.Second), append(labels, percentile)...)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/prksu/kngrok/ngrok"
+)
+
+func TestTunnelMetricsCollector(t *testing.T) {
+	var lists int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lists, 1)
+		_, _ = w.Write([]byte(`{"tunnels":[` +
+			`{"name":"default-foo-80","proto":"https","metrics":{"conns":{"count":3,"gauge":1},"http":{"count":7}}},` +
+			`{"name":"default-foo-5432","proto":"tcp","metrics":{"conns":{"count":2}}},` +
+			`{"name":"unknown","proto":"tcp","metrics":{"conns":{"count":9}}}]}`))
+	}))
+	defer srv.Close()
+
+	agents := ngrok.NewAgents()
+	agents.Add(ngrok.AgentConfig{Name: ngrok.DefaultAgentName}, &ngrok.AgentClient{Client: srv.Client(), BaseURL: srv.URL + "/api/"})
+
+	tr := newServiceTracker()
+	tr.setTunnels(types.NamespacedName{Namespace: "default", Name: "foo"}, []trackedTunnel{
+		{Name: "default-foo-80", Port: 80, Protocol: "http", Agent: ngrok.DefaultAgentName},
+		{Name: "default-foo-5432", Port: 5432, Protocol: "tcp", Agent: ngrok.DefaultAgentName},
+	})
+
+	c := newTunnelMetricsCollector(agents, tr)
+	want := `
+# HELP kngrok_tunnel_connections_total Total number of connections to the tunnel of the service port.
+# TYPE kngrok_tunnel_connections_total counter
+kngrok_tunnel_connections_total{namespace="default",port="5432",service="foo"} 2
+kngrok_tunnel_connections_total{namespace="default",port="80",service="foo"} 3
+# HELP kngrok_tunnel_http_requests_total Total number of http requests to the tunnel of the service port.
+# TYPE kngrok_tunnel_http_requests_total counter
+kngrok_tunnel_http_requests_total{namespace="default",port="80",service="foo"} 7
+# HELP kngrok_tunnel_metrics_scrape_error 1 if the tunnel metrics could not be read from the agent on the last scrape, 0 otherwise.
+# TYPE kngrok_tunnel_metrics_scrape_error gauge
+kngrok_tunnel_metrics_scrape_error{agent="default"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want),
+		"kngrok_tunnel_connections_total", "kngrok_tunnel_http_requests_total", "kngrok_tunnel_metrics_scrape_error"); err != nil {
+		t.Error(err)
+	}
+
+	// the tunnels listed by the previous scrape are reused.
+	if got := testutil.CollectAndCount(c, "kngrok_tunnel_connections_total"); got != 2 {
+		t.Errorf("connections series = %d, want 2", got)
+	}
+
+	if got := atomic.LoadInt32(&lists); got != 1 {
+		t.Errorf("agent tunnels listed %d times, want 1", got)
+	}
+
+	c.maxAge = 0
+	testutil.CollectAndCount(c)
+	if got := atomic.LoadInt32(&lists); got != 2 {
+		t.Errorf("agent tunnels listed %d times, want 2 once expired", got)
+	}
+}
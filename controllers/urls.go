@@ -0,0 +1,247 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// CacheSelectors returns the selectors of the objects cached by the manager for the
+// controller. Only the ConfigMaps labeled with the TunnelURLsLabel are cached, so the
+// other ConfigMaps of the cluster are neither cached nor watched.
+func CacheSelectors() cache.SelectorsByObject {
+	// the requirement of the constant label key never fails.
+	req, _ := labels.NewRequirement(v1alpha1.TunnelURLsLabel, selection.Exists, nil)
+	return cache.SelectorsByObject{
+		&corev1.ConfigMap{}: {Label: labels.NewSelector().Add(*req)},
+	}
+}
+
+// publishURLs maintains the ConfigMap, owned by the service, with the public URLs of the
+// tunnels recorded in the registry keyed by the service port. When the URLs are injected
+// into the pods, the workloads selected by the service are rolled out to pick up the change.
+// The ConfigMap with the same name that is not controlled by the service is left alone.
+func (r *ServiceReconciler) publishURLs(ctx context.Context, svc *corev1.Service, registry *tunnels.Registry) error {
+	data := make(map[string]string)
+	for _, sp := range svc.Spec.Ports {
+		if entry, ok := registry.Get(tunnels.Name(svc, sp)); ok && entry.PublicURL != "" {
+			data[tunnels.URLKey(sp)] = entry.PublicURL
+		}
+	}
+
+	hash, err := urlsHash(data)
+	if err != nil {
+		return err
+	}
+
+	existing, err := r.urlsConfigMap(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && !metav1.IsControlledBy(existing, svc) {
+		r.Recorder.Eventf(svc, corev1.EventTypeWarning, "TunnelURLsConflict",
+			"ConfigMap %q is not controlled by the service, the tunnel URLs are not published", existing.Name)
+		return nil
+	}
+
+	cm := existing
+	if cm == nil {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      tunnels.URLsConfigMapName(svc),
+				Namespace: svc.Namespace,
+			},
+		}
+	}
+
+	before := cm.DeepCopy()
+	cm.Data = data
+	metav1.SetMetaDataLabel(&cm.ObjectMeta, v1alpha1.TunnelURLsLabel, svc.Name)
+	metav1.SetMetaDataAnnotation(&cm.ObjectMeta, v1alpha1.TunnelURLsHashAnnotation, hash)
+	if err := controllerutil.SetControllerReference(svc, cm, r.Scheme); err != nil {
+		return err
+	}
+
+	switch {
+	case existing == nil:
+		if err := r.Create(ctx, cm); err != nil {
+			return err
+		}
+	case !equality.Semantic.DeepEqual(before, cm):
+		if err := r.Patch(ctx, cm, client.MergeFrom(before)); err != nil {
+			return err
+		}
+	}
+
+	if !r.InjectTunnelURLs {
+		return nil
+	}
+
+	return r.rollout(ctx, svc, hash)
+}
+
+// unpublishURLs deletes the ConfigMap with the public URLs of the tunnels of the service,
+// when it is controlled by the service.
+func (r *ServiceReconciler) unpublishURLs(ctx context.Context, svc *corev1.Service) error {
+	cm, err := r.urlsConfigMap(ctx, svc)
+	if err != nil || cm == nil || !metav1.IsControlledBy(cm, svc) {
+		return err
+	}
+
+	if err := r.Delete(ctx, cm, client.Preconditions{UID: &cm.UID}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// urlsConfigMap returns the ConfigMap with the name the public URLs of the tunnels of the
+// service are published in, or nil when there is none. The ConfigMap that is not labeled,
+// such as the one published before the label was set, is read from the API server.
+func (r *ServiceReconciler) urlsConfigMap(ctx context.Context, svc *corev1.Service) (*corev1.ConfigMap, error) {
+	key := client.ObjectKey{Namespace: svc.Namespace, Name: tunnels.URLsConfigMapName(svc)}
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, key, cm)
+	if apierrors.IsNotFound(err) {
+		err = r.apiReader().Get(ctx, key, cm)
+	}
+
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// rollout records the hash of the public URLs on the pod template of the workloads
+// selected by the service that opted in to the injection of the URLs, so their pods
+// are recreated with the changed URLs. The workloads are listed from the API server,
+// so the workloads of the cluster are not cached by the manager.
+func (r *ServiceReconciler) rollout(ctx context.Context, svc *corev1.Service, hash string) error {
+	if len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+
+	var (
+		errs      []error
+		selector  = labels.SelectorFromSet(svc.Spec.Selector)
+		inNS      = client.InNamespace(svc.Namespace)
+		workloads []client.Object
+	)
+
+	deployments := &appsv1.DeploymentList{}
+	if err := r.apiReader().List(ctx, deployments, inNS); err != nil {
+		return err
+	}
+
+	for i := range deployments.Items {
+		workloads = append(workloads, &deployments.Items[i])
+	}
+
+	statefulSets := &appsv1.StatefulSetList{}
+	if err := r.apiReader().List(ctx, statefulSets, inNS); err != nil {
+		return err
+	}
+
+	for i := range statefulSets.Items {
+		workloads = append(workloads, &statefulSets.Items[i])
+	}
+
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := r.apiReader().List(ctx, daemonSets, inNS); err != nil {
+		return err
+	}
+
+	for i := range daemonSets.Items {
+		workloads = append(workloads, &daemonSets.Items[i])
+	}
+
+	for _, workload := range workloads {
+		if err := r.rolloutWorkload(ctx, workload, selector, v1alpha1.ServiceTunnelURLsHashAnnotation(svc.Name), hash); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
+
+// rolloutWorkload records the hash of the public URLs in the given annotation of the pod
+// template of the workload when its pods opted in to the injection of the URLs and are
+// selected by the selector.
+func (r *ServiceReconciler) rolloutWorkload(ctx context.Context, workload client.Object, selector labels.Selector, key, hash string) error {
+	before := workload.DeepCopyObject().(client.Object)
+	var template *corev1.PodTemplateSpec
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		template = &w.Spec.Template
+	case *appsv1.StatefulSet:
+		template = &w.Spec.Template
+	case *appsv1.DaemonSet:
+		template = &w.Spec.Template
+	default:
+		return nil
+	}
+
+	if template.Labels[v1alpha1.InjectTunnelURLsLabel] != "true" || !selector.Matches(labels.Set(template.Labels)) {
+		return nil
+	}
+
+	if template.Annotations[key] == hash {
+		return nil
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+
+	template.Annotations[key] = hash
+	return r.Patch(ctx, workload, client.MergeFrom(before))
+}
+
+// urlsHash returns the hash of the public URLs published in the ConfigMap.
+func urlsHash(data map[string]string) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])[:16], nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+func TestPublishURLs(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "foo-uid"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "foo"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80},
+				{Name: "db", Port: 5432},
+			},
+		},
+	}
+
+	registry := tunnels.NewRegistry()
+	registry.Set(tunnels.RegistryEntry{Name: tunnels.Name(svc, svc.Spec.Ports[0]), Port: 80, PublicURL: "https://foo.ngrok.io"})
+	// the tunnel of the db port is not running yet.
+	registry.Set(tunnels.RegistryEntry{Name: tunnels.Name(svc, svc.Spec.Ports[1]), Port: 5432})
+
+	template := func(labels map[string]string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+	}
+
+	injected := map[string]string{"app": "foo", v1alpha1.InjectTunnelURLsLabel: "true"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Template: template(injected)},
+	}
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Template: template(map[string]string{"app": "foo"})},
+	}
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"},
+		Spec: appsv1.DaemonSetSpec{Template: template(map[string]string{
+			"app": "bar", v1alpha1.InjectTunnelURLsLabel: "true",
+		})},
+	}
+
+	tests := []struct {
+		name             string
+		inject           bool
+		wantRolledOut    []client.Object
+		wantNotRolledOut []client.Object
+	}{
+		{
+			name:             "Publish the URLs only",
+			inject:           false,
+			wantNotRolledOut: []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &appsv1.DaemonSet{}},
+		},
+		{
+			name:             "Roll out the selected workloads that opted in",
+			inject:           true,
+			wantRolledOut:    []client.Object{&appsv1.Deployment{}},
+			wantNotRolledOut: []client.Object{&appsv1.StatefulSet{}, &appsv1.DaemonSet{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := fake.NewClientBuilder().WithScheme(scheme).
+				WithObjects(svc.DeepCopy(), deployment.DeepCopy(), statefulSet.DeepCopy(), daemonSet.DeepCopy()).
+				Build()
+			r := &ServiceReconciler{Client: c, Scheme: scheme, InjectTunnelURLs: tt.inject}
+
+			if err := r.publishURLs(ctx, svc, registry); err != nil {
+				t.Fatalf("publishURLs() unexpected error: %v", err)
+			}
+
+			cm := &corev1.ConfigMap{}
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "foo-tunnel-urls"}, cm); err != nil {
+				t.Fatalf("publishURLs() ConfigMap not found: %v", err)
+			}
+
+			if want := map[string]string{"http": "https://foo.ngrok.io"}; !reflect.DeepEqual(cm.Data, want) {
+				t.Errorf("publishURLs() ConfigMap data = %v, want %v", cm.Data, want)
+			}
+
+			if !metav1.IsControlledBy(cm, svc) {
+				t.Errorf("publishURLs() ConfigMap is not controlled by the service")
+			}
+
+			if cm.Labels[v1alpha1.TunnelURLsLabel] != svc.Name {
+				t.Errorf("publishURLs() ConfigMap has no %s label", v1alpha1.TunnelURLsLabel)
+			}
+
+			hash := cm.Annotations[v1alpha1.TunnelURLsHashAnnotation]
+			if hash == "" {
+				t.Errorf("publishURLs() ConfigMap has no %s annotation", v1alpha1.TunnelURLsHashAnnotation)
+			}
+
+			keys := map[string]client.ObjectKey{
+				"*v1.Deployment":  client.ObjectKeyFromObject(deployment),
+				"*v1.StatefulSet": client.ObjectKeyFromObject(statefulSet),
+				"*v1.DaemonSet":   client.ObjectKeyFromObject(daemonSet),
+			}
+			check := func(obj client.Object, want string) {
+				key := keys[reflect.TypeOf(obj).String()]
+				if err := c.Get(ctx, key, obj); err != nil {
+					t.Fatalf("Get() unexpected error: %v", err)
+				}
+
+				var got string
+				switch w := obj.(type) {
+				case *appsv1.Deployment:
+					got = w.Spec.Template.Annotations["foo.service.k-ngrok.io/tunnel-urls-hash"]
+				case *appsv1.StatefulSet:
+					got = w.Spec.Template.Annotations["foo.service.k-ngrok.io/tunnel-urls-hash"]
+				case *appsv1.DaemonSet:
+					got = w.Spec.Template.Annotations["foo.service.k-ngrok.io/tunnel-urls-hash"]
+				}
+
+				if got != want {
+					t.Errorf("publishURLs() %T %s template hash = %q, want %q", obj, key, got, want)
+				}
+			}
+
+			for _, obj := range tt.wantRolledOut {
+				check(obj, hash)
+			}
+
+			for _, obj := range tt.wantNotRolledOut {
+				check(obj, "")
+			}
+
+			if err := r.unpublishURLs(ctx, svc); err != nil {
+				t.Fatalf("unpublishURLs() unexpected error: %v", err)
+			}
+
+			if err := r.unpublishURLs(ctx, svc); err != nil {
+				t.Errorf("unpublishURLs() unexpected error on a deleted ConfigMap: %v", err)
+			}
+		})
+	}
+}
+
+func TestPublishURLs_NotControlled(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "foo-uid"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+
+	registry := tunnels.NewRegistry()
+	registry.Set(tunnels.RegistryEntry{Name: tunnels.Name(svc, svc.Spec.Ports[0]), Port: 80, PublicURL: "https://foo.ngrok.io"})
+
+	// the ConfigMap of the user happens to have the name the URLs are published in.
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-tunnel-urls", Namespace: "default"},
+		Data:       map[string]string{"foo": "bar"},
+	}
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc.DeepCopy(), cm.DeepCopy()).Build()
+	recorder := record.NewFakeRecorder(1)
+	r := &ServiceReconciler{Client: c, Scheme: scheme, Recorder: recorder}
+
+	if err := r.publishURLs(ctx, svc, registry); err != nil {
+		t.Fatalf("publishURLs() unexpected error: %v", err)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "TunnelURLsConflict") {
+			t.Errorf("publishURLs() event = %q, want a TunnelURLsConflict event", event)
+		}
+	default:
+		t.Errorf("publishURLs() recorded no event")
+	}
+
+	if err := r.unpublishURLs(ctx, svc); err != nil {
+		t.Fatalf("unpublishURLs() unexpected error: %v", err)
+	}
+
+	got := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(cm), got); err != nil {
+		t.Fatalf("ConfigMap not found: %v", err)
+	}
+
+	if !reflect.DeepEqual(got.Data, cm.Data) || len(got.OwnerReferences) > 0 || len(got.Labels) > 0 {
+		t.Errorf("ConfigMap not controlled by the service was modified: %v", got)
+	}
+}
+
+func TestPublishURLs_SharedWorkload(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	newService := func(name, url string) (*corev1.Service, *tunnels.Registry) {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name + "-uid")},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "foo"},
+				Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}
+
+		registry := tunnels.NewRegistry()
+		registry.Set(tunnels.RegistryEntry{Name: tunnels.Name(svc, svc.Spec.Ports[0]), Port: 80, PublicURL: url})
+		return svc, registry
+	}
+
+	foo, fooRegistry := newService("foo", "https://foo.ngrok.io")
+	bar, barRegistry := newService("bar", "https://bar.ngrok.io")
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"app": "foo", v1alpha1.InjectTunnelURLsLabel: "true"},
+		}}},
+	}
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(foo.DeepCopy(), bar.DeepCopy(), deployment.DeepCopy()).Build()
+	r := &ServiceReconciler{Client: c, Scheme: scheme, InjectTunnelURLs: true}
+
+	for _, publish := range []struct {
+		svc      *corev1.Service
+		registry *tunnels.Registry
+	}{{foo, fooRegistry}, {bar, barRegistry}} {
+		if err := r.publishURLs(ctx, publish.svc, publish.registry); err != nil {
+			t.Fatalf("publishURLs() unexpected error: %v", err)
+		}
+	}
+
+	rolledOut := &appsv1.Deployment{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), rolledOut); err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"foo", "bar"} {
+		if rolledOut.Spec.Template.Annotations[v1alpha1.ServiceTunnelURLsHashAnnotation(name)] == "" {
+			t.Errorf("publishURLs() template has no hash of service %s", name)
+		}
+	}
+
+	// the unchanged URLs of a service don't roll out the workload again.
+	if err := r.publishURLs(ctx, foo, fooRegistry); err != nil {
+		t.Fatalf("publishURLs() unexpected error: %v", err)
+	}
+
+	got := &appsv1.Deployment{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), got); err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+
+	if got.ResourceVersion != rolledOut.ResourceVersion {
+		t.Errorf("publishURLs() rolled out the workload again, resourceVersion = %s, want %s", got.ResourceVersion, rolledOut.ResourceVersion)
+	}
+}
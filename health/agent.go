@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health provides the health and readiness checks of the ngrok agents
+// the manager starts the tunnels on.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	"github.com/prksu/kngrok/ngrok"
+)
+
+const (
+	// DefaultTimeout is the default timeout of the agent API call of a check.
+	// It must be lower than the timeoutSeconds of the probes of the manager pod.
+	DefaultTimeout = 3 * time.Second
+	// DefaultFailureThreshold is the default number of consecutive failed checks
+	// of an agent before it is reported as unusable.
+	DefaultFailureThreshold = 1
+)
+
+// AgentChecker checks the agents are usable by querying their API. The agent
+// API does not expose its session status, but it answers with an error when
+// the session is not established, e.g. when the agent is unauthenticated or
+// has lost its session, so such agents are also reported as unusable.
+type AgentChecker struct {
+	// Agents are the agents to check. They should be unwrapped, see ngrok.Agents.Unwrapped,
+	// so that a failed check is neither retried nor hidden by an open circuit breaker.
+	Agents *ngrok.Agents
+	// Timeout is the timeout of the agent API call. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed checks of an agent
+	// before the check fails, so a transient agent hiccup is tolerated.
+	// Defaults to DefaultFailureThreshold.
+	FailureThreshold int
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+var _ healthz.Checker = (&AgentChecker{}).Check
+
+// Check implements healthz.Checker and fails when any agent has failed
+// FailureThreshold consecutive checks. The agents are checked in parallel,
+// so the check takes at most Timeout whatever the number of agents.
+func (c *AgentChecker) Check(req *http.Request) error {
+	names := c.Agents.All()
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = c.checkAgent(req.Context(), name)
+		}(i, name)
+	}
+
+	wg.Wait()
+	return kerrors.NewAggregate(errs)
+}
+
+func (c *AgentChecker) checkAgent(ctx context.Context, name string) error {
+	agent, _ := c.Agents.Get(name)
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := agent.List(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures == nil {
+		c.failures = make(map[string]int)
+	}
+
+	if err == nil {
+		delete(c.failures, name)
+		return nil
+	}
+
+	c.failures[name]++
+	threshold := c.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+
+	if c.failures[name] < threshold {
+		return nil
+	}
+
+	return fmt.Errorf("agent %q is unusable after %d consecutive failed checks: %w", name, c.failures[name], err)
+}
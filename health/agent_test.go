@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prksu/kngrok/ngrok"
+)
+
+func TestAgentChecker_Check(t *testing.T) {
+	var down int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(`{"error_code":105,"status_code":502,"msg":"session is not established"}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"tunnels":[]}`))
+	}))
+	defer srv.Close()
+
+	agents := ngrok.NewAgents()
+	agents.Add(ngrok.AgentConfig{Name: ngrok.DefaultAgentName}, &ngrok.AgentClient{Client: srv.Client(), BaseURL: srv.URL + "/api/"})
+	c := &AgentChecker{Agents: agents, FailureThreshold: 2}
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+
+	if err := c.Check(req); err != nil {
+		t.Fatalf("Check() unexpected error with the agent up: %v", err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	if err := c.Check(req); err != nil {
+		t.Fatalf("Check() unexpected error below the failure threshold: %v", err)
+	}
+
+	if err := c.Check(req); err == nil {
+		t.Fatal("Check() expected error at the failure threshold")
+	}
+
+	atomic.StoreInt32(&down, 0)
+	if err := c.Check(req); err != nil {
+		t.Fatalf("Check() unexpected error once the agent recovered: %v", err)
+	}
+}
+
+func TestAgentChecker_CheckParallel(t *testing.T) {
+	// every agent only answers once all of them are queried, which
+	// times out unless the agents are checked in parallel.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		_, _ = w.Write([]byte(`{"tunnels":[]}`))
+	}))
+	defer srv.Close()
+
+	agents := ngrok.NewAgents()
+	for _, name := range []string{"us", "eu"} {
+		agents.Add(ngrok.AgentConfig{Name: name}, &ngrok.AgentClient{Client: srv.Client(), BaseURL: srv.URL + "/api/"})
+	}
+
+	c := &AgentChecker{Agents: agents, Timeout: 5 * time.Second}
+	if err := c.Check(httptest.NewRequest(http.MethodGet, "/readyz", nil)); err != nil {
+		t.Fatalf("Check() unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inspect serves the HTTP requests captured by the agents on the
+// tunnels of the Services, e.g. for the kubectl-ngrok plugin.
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/ngrok"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// RequestsPath is the path the captured requests of a service are served on.
+const RequestsPath = "/requests"
+
+// TokenHeader is the header the bearer token of the requests is read from when
+// there is no Authorization header, since the apiserver proxy does not forward it.
+const TokenHeader = "X-Kngrok-Token"
+
+// Server serves the requests captured on the tunnels of a service at RequestsPath,
+// with the namespace and name query parameters of the service, and an optional limit.
+// The captured requests include their headers and bodies, so the requests are only
+// served to the users allowed to get the proxy subresource of the service.
+type Server struct {
+	Client client.Reader
+	// Reviewer creates the TokenReviews and SubjectAccessReviews of the requests.
+	Reviewer client.Writer
+	// Agents is the set of agents the tunnels are started on.
+	Agents *ngrok.Agents
+	// LoadBalancerClass is the service LoadBalancer class name served
+	// by the default agent when no TunnelClass is defined for it.
+	LoadBalancerClass string
+	// BindAddress is the address the server binds to.
+	BindAddress string
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable so the server
+// runs on every replica, each of them has its own agents.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// Start implements manager.Runnable and serves until the context is done.
+func (s *Server) Start(ctx context.Context) error {
+	log := ctrl.LoggerFrom(ctx).WithName("inspect")
+	mux := http.NewServeMux()
+	mux.Handle(RequestsPath, s)
+	srv := &http.Server{Handler: mux}
+	ln, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error(err, "Unable to shutdown inspect server")
+		}
+	}()
+
+	log.Info("Starting inspect server", "addr", ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	key := client.ObjectKey{Namespace: q.Get("namespace"), Name: q.Get("name")}
+	if key.Namespace == "" || key.Name == "" {
+		http.Error(w, "namespace and name are required", http.StatusBadRequest)
+		return
+	}
+
+	if status, err := s.authorize(r, key); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	reqs, err := s.requests(r.Context(), key, limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apierrors.IsNotFound(err) {
+			status = http.StatusNotFound
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reqs)
+}
+
+// authorize authenticates the bearer token of the request with a TokenReview, and
+// authorizes its user to get the proxy subresource of the service with a SubjectAccessReview.
+// It returns the status code of the response otherwise.
+func (s *Server) authorize(r *http.Request, key client.ObjectKey) (int, error) {
+	token := r.Header.Get(TokenHeader)
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if token == "" {
+		return http.StatusUnauthorized, errors.New("bearer token is required")
+	}
+
+	tr := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	if err := s.Reviewer.Create(r.Context(), tr); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !tr.Status.Authenticated {
+		return http.StatusUnauthorized, errors.New("bearer token is not authenticated")
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(tr.Status.User.Extra))
+	for k, v := range tr.Status.User.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   tr.Status.User.Username,
+			UID:    tr.Status.User.UID,
+			Groups: tr.Status.User.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   key.Namespace,
+				Verb:        "get",
+				Resource:    "services",
+				Subresource: "proxy",
+				Name:        key.Name,
+			},
+		},
+	}
+
+	if err := s.Reviewer.Create(r.Context(), sar); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !sar.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("user %q cannot get services/proxy %q in namespace %q", tr.Status.User.Username, key.Name, key.Namespace)
+	}
+
+	return http.StatusOK, nil
+}
+
+// requests returns the requests captured on the tunnels of the service, the most recent first.
+func (s *Server) requests(ctx context.Context, key client.ObjectKey, limit int) ([]ngrok.CapturedRequest, error) {
+	svc := &corev1.Service{}
+	if err := s.Client.Get(ctx, key, svc); err != nil {
+		return nil, err
+	}
+
+	class, err := tunnels.ClassFor(ctx, s.Client, s.LoadBalancerClass, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if class == nil {
+		return nil, apierrors.NewNotFound(corev1.Resource("services"), key.Name)
+	}
+
+	name, err := tunnels.AgentFor(s.Agents, svc, class)
+	if err != nil {
+		return nil, err
+	}
+
+	agent, _ := s.Agents.Get(name)
+	var reqs []ngrok.CapturedRequest
+	for _, sp := range svc.Spec.Ports {
+		captured, err := agent.ListRequests(ctx, ngrok.ListRequestsOptions{TunnelName: tunnels.Name(svc, sp), Limit: limit})
+		if err != nil {
+			return nil, err
+		}
+
+		reqs = append(reqs, captured...)
+	}
+
+	sort.SliceStable(reqs, func(i, j int) bool {
+		return reqs[i].Start.After(reqs[j].Start)
+	})
+
+	if limit > 0 && len(reqs) > limit {
+		reqs = reqs[:limit]
+	}
+
+	return reqs, nil
+}
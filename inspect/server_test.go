@@ -0,0 +1,172 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+// reviewer authenticates the token "valid" as the user "alice", who is
+// allowed to proxy the services of the "default" namespace only.
+type reviewer struct {
+	client.Writer
+}
+
+func (reviewer) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	switch review := obj.(type) {
+	case *authenticationv1.TokenReview:
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "alice"
+		}
+	case *authorizationv1.SubjectAccessReview:
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Namespace == "default" &&
+			attrs.Verb == "get" && attrs.Resource == "services" && attrs.Subresource == "proxy"
+	}
+
+	return nil
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"requests": []ngrok.CapturedRequest{{ID: r.URL.Query().Get("tunnel_name"), Start: start}},
+		})
+	}))
+	t.Cleanup(agent.Close)
+
+	svcs := []client.Object{}
+	for _, ns := range []string{"default", "private"} {
+		svcs = append(svcs, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: ns},
+			Spec: corev1.ServiceSpec{
+				LoadBalancerClass: pointer.String("k-ngrok.io/default"),
+				Ports:             []corev1.ServicePort{{Port: 80}},
+			},
+		})
+	}
+
+	config := ngrok.DefaultAgentConfig("us")
+	config.URL = agent.URL + "/api/"
+	s := &Server{
+		Client:            fake.NewClientBuilder().WithScheme(scheme).WithObjects(svcs...).Build(),
+		Reviewer:          reviewer{},
+		Agents:            ngrok.NewAgents(config),
+		LoadBalancerClass: "k-ngrok.io/default",
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		want   int
+	}{
+		{
+			name:   "Authorized with the Authorization header",
+			query:  "namespace=default&name=foo",
+			header: http.Header{"Authorization": []string{"Bearer valid"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "Authorized with the token header",
+			query:  "namespace=default&name=foo",
+			header: http.Header{TokenHeader: []string{"valid"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:  "Without token",
+			query: "namespace=default&name=foo",
+			want:  http.StatusUnauthorized,
+		},
+		{
+			name:   "Not authenticated",
+			query:  "namespace=default&name=foo",
+			header: http.Header{TokenHeader: []string{"invalid"}},
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "Not authorized in the namespace",
+			query:  "namespace=private&name=foo",
+			header: http.Header{TokenHeader: []string{"valid"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "Service not found",
+			query:  "namespace=default&name=bar",
+			header: http.Header{TokenHeader: []string{"valid"}},
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "Missing name",
+			query:  "namespace=default",
+			header: http.Header{TokenHeader: []string{"valid"}},
+			want:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, RequestsPath+"?"+tt.query, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("ServeHTTP() status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var reqs []ngrok.CapturedRequest
+			if err := json.NewDecoder(rec.Body).Decode(&reqs); err != nil {
+				t.Fatalf("Unexpected error decoding the response: %v", err)
+			}
+
+			if len(reqs) != 1 || reqs[0].ID != "default-foo" {
+				t.Errorf("ServeHTTP() requests = %+v, want the requests of tunnel default-foo", reqs)
+			}
+		})
+	}
+}
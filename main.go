@@ -18,20 +18,32 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
+	"github.com/prksu/kngrok/api/v1alpha1"
 	"github.com/prksu/kngrok/controllers"
+	"github.com/prksu/kngrok/health"
+	"github.com/prksu/kngrok/inspect"
+	"github.com/prksu/kngrok/ngrok"
 	"github.com/prksu/kngrok/webhooks"
 	// +kubebuilder::scaffold:imports
 )
@@ -43,23 +55,112 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 
 	// +kubebuilder::scaffold:scheme
 }
 
+// agentConfigs implements flag.Value to collect the repeatable agent flag.
+type agentConfigs []ngrok.AgentConfig
+
+func (a *agentConfigs) String() string {
+	return fmt.Sprint(*a)
+}
+
+func (a *agentConfigs) Set(s string) error {
+	config, err := ngrok.ParseAgentConfig(s)
+	if err != nil {
+		return err
+	}
+
+	*a = append(*a, config)
+	return nil
+}
+
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var inspectAddr string
 	var serviceLoadBalancerClass string
+	var watchNamespaces string
+	var namespaceSelector string
+	var agents agentConfigs
+	var defaultAgentRegion string
+	var agentProbeTimeout time.Duration
+	var agentReadinessThreshold int
+	var agentLivenessThreshold int
+	retry := ngrok.DefaultRetryConfig
+	breaker := ngrok.DefaultBreakerConfig
+	var tunnelStartRate float64
+	var tunnelStartBurst int
+	var serverSideApply bool
+	var applyForceOwnership bool
+	var injectTunnelURLs bool
+	var publishDNSEndpoints bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&inspectAddr, "inspect-bind-address", "0",
+		"The address the endpoint serving the requests captured on the tunnels binds to. "+
+			"Set this to '0' to disable it.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&serviceLoadBalancerClass, "service-loadbalancer-class", "k-ngrok.io/default",
 		"The service LoadBalancer class name the controller watch to. "+
 			"Must be a label-style identifier, with an optional prefix.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated list of namespaces the controller watch to. "+
+			"Watch all namespaces when empty.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of the namespaces whose services the controller and webhook act on. "+
+			"Select all namespaces when empty.")
+	flag.Var(&agents, "agent",
+		"The ngrok agent the tunnels are started on, as comma-separated key=value pairs of "+
+			"name, url, pool, region, account and certs, e.g. name=eu,url=http://127.0.0.1:4041/api/,pool=public,region=eu,account=acme. "+
+			"certs is the directory shared with the agent the certificates of the tls tunnels are written to. "+
+			"Can be repeated. Defaults to the agent named default listening on "+ngrok.DefaultBaseURL)
+	flag.StringVar(&defaultAgentRegion, "default-agent-region", "us",
+		"The ngrok region the default agent is connected to when no --agent is set. "+
+			"It must match the region of the agent config.")
+	flag.DurationVar(&agentProbeTimeout, "agent-probe-timeout", health.DefaultTimeout,
+		"The timeout of the agent API call made by the health and readiness probes. "+
+			"It must be lower than the timeoutSeconds of the probes of the manager pod.")
+	flag.IntVar(&agentReadinessThreshold, "agent-readiness-failure-threshold", 0,
+		"The number of consecutive failed checks of an agent before the manager reports not ready. "+
+			"Defaults to '0', which does not check the agents for readiness, since a not ready manager "+
+			"no longer serves the webhooks of the services.")
+	flag.IntVar(&agentLivenessThreshold, "agent-liveness-failure-threshold", 3,
+		"The number of consecutive failed checks of an agent before the manager reports unhealthy. "+
+			"Set this to '0' to not check the agents for liveness.")
+	flag.IntVar(&retry.MaxRetries, "agent-max-retries", retry.MaxRetries,
+		"The maximum number of retries of the failed agent API calls.")
+	flag.DurationVar(&retry.InitialBackoff, "agent-retry-initial-backoff", retry.InitialBackoff,
+		"The delay before the first retry of a failed agent API call. It doubles on every retry.")
+	flag.DurationVar(&retry.MaxBackoff, "agent-retry-max-backoff", retry.MaxBackoff,
+		"The maximum delay between the retries of a failed agent API call.")
+	flag.IntVar(&breaker.FailureThreshold, "agent-circuit-failure-threshold", breaker.FailureThreshold,
+		"The number of consecutive failed calls that stops calling an unavailable agent for the cool-down. "+
+			"Set this to '0' to disable the circuit breaker.")
+	flag.DurationVar(&breaker.CoolDown, "agent-circuit-cool-down", breaker.CoolDown,
+		"The time an unavailable agent is not called before it is probed again.")
+	flag.Float64Var(&tunnelStartRate, "tunnel-start-rate", 1,
+		"The number of tunnels per second that can be started on an agent, or on the agents of the same account. "+
+			"Set this to '0' to not limit the tunnel start rate.")
+	flag.IntVar(&tunnelStartBurst, "tunnel-start-burst", 10,
+		"The number of tunnels that can be started at once on an agent, or on the agents of the same account. "+
+			"It must be at least 1 when the tunnel start rate is limited.")
+	flag.BoolVar(&serverSideApply, "server-side-apply", false,
+		"Server-side apply the service fields owned by the controller instead of patching them with JSON merge patches.")
+	flag.BoolVar(&applyForceOwnership, "apply-force-ownership", true,
+		"Take the ownership of the service fields applied by the controller that conflict with other managers. "+
+			"Only used with --server-side-apply.")
+	flag.BoolVar(&injectTunnelURLs, "inject-tunnel-urls", false,
+		"Inject the public URLs of the tunnels into the pods labeled "+v1alpha1.InjectTunnelURLsLabel+"=true "+
+			"that are selected by the services, and roll out their workloads when the URLs change.")
+	flag.BoolVar(&publishDNSEndpoints, "publish-dns-endpoints", false,
+		"Publish the CNAME records of the custom hostnames of the tunnels as external-dns DNSEndpoints. "+
+			"Requires the DNSEndpoint CRD.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -68,45 +169,142 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if tunnelStartRate > 0 && tunnelStartBurst < 1 {
+		// no tunnel could ever be started with an empty token bucket.
+		setupLog.Error(fmt.Errorf("invalid tunnel start burst %d", tunnelStartBurst), "tunnel start burst must be at least 1")
+		os.Exit(1)
+	}
+
+	nsSelector, err := labels.Parse(namespaceSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to parse namespace selector")
+		os.Exit(1)
+	}
+
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "f358660c.k-ngrok.io",
-	})
+	}
+
+	newCache := cache.New
+	if watchNamespaces != "" {
+		// restrict the cache to the given namespaces so the manager only
+		// needs namespace-scoped permissions to watch services.
+		newCache = cache.MultiNamespacedCacheBuilder(strings.Split(watchNamespaces, ","))
+	}
+
+	options.NewCache = func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		opts.SelectorsByObject = controllers.CacheSelectors()
+		return newCache(config, opts)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	if err := ngrok.RegisterMetrics(metrics.Registry); err != nil {
+		setupLog.Error(err, "unable to register agent metrics")
+		os.Exit(1)
+	}
+
+	if len(agents) == 0 {
+		agents = append(agents, ngrok.DefaultAgentConfig(defaultAgentRegion))
+	}
+
+	agentSet := ngrok.NewAgents(agents...).WithRetry(retry, breaker)
+	if tunnelStartRate > 0 {
+		agentSet.WithStartRateLimit(rate.Limit(tunnelStartRate), tunnelStartBurst)
+	}
+
+	if err := controllers.RegisterTunnelMetrics(metrics.Registry, agentSet); err != nil {
+		setupLog.Error(err, "unable to register tunnel metrics")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.ServiceReconciler{
-		Client:            mgr.GetClient(),
-		Scheme:            mgr.GetScheme(),
-		Recorder:          mgr.GetEventRecorderFor(controllers.ControllerName),
-		LoadBalancerClass: serviceLoadBalancerClass,
+		Client:              mgr.GetClient(),
+		APIReader:           mgr.GetAPIReader(),
+		Scheme:              mgr.GetScheme(),
+		Recorder:            mgr.GetEventRecorderFor(controllers.ControllerName),
+		Agents:              agentSet,
+		LoadBalancerClass:   serviceLoadBalancerClass,
+		NamespaceSelector:   nsSelector,
+		ServerSideApply:     serverSideApply,
+		ForceOwnership:      applyForceOwnership,
+		InjectTunnelURLs:    injectTunnelURLs,
+		PublishDNSEndpoints: publishDNSEndpoints,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
 	if err = (&webhooks.ServiceWebhook{
 		Client:            mgr.GetAPIReader(),
+		Cache:             mgr.GetClient(),
+		Agents:            agentSet,
 		LoadBalancerClass: serviceLoadBalancerClass,
+		NamespaceSelector: nsSelector,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "Service")
 		os.Exit(1)
 	}
+	if injectTunnelURLs {
+		if err = (&webhooks.PodWebhook{
+			Client:            mgr.GetAPIReader(),
+			LoadBalancerClass: serviceLoadBalancerClass,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder::scaffold:builder
 
+	if inspectAddr != "0" {
+		if err := mgr.Add(&inspect.Server{
+			Client:            mgr.GetClient(),
+			Reviewer:          mgr.GetClient(),
+			Agents:            agentSet,
+			LoadBalancerClass: serviceLoadBalancerClass,
+			BindAddress:       inspectAddr,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up inspect server")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	if agentLivenessThreshold > 0 {
+		if err := mgr.AddHealthzCheck("agents", (&health.AgentChecker{
+			Agents:           agentSet.Unwrapped(),
+			Timeout:          agentProbeTimeout,
+			FailureThreshold: agentLivenessThreshold,
+		}).Check); err != nil {
+			setupLog.Error(err, "unable to set up agents health check")
+			os.Exit(1)
+		}
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if agentReadinessThreshold > 0 {
+		if err := mgr.AddReadyzCheck("agents", (&health.AgentChecker{
+			Agents:           agentSet.Unwrapped(),
+			Timeout:          agentProbeTimeout,
+			FailureThreshold: agentReadinessThreshold,
+		}).Check); err != nil {
+			setupLog.Error(err, "unable to set up agents ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -20,13 +20,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	nerrors "github.com/prksu/kngrok/ngrok/errors"
 )
 
-const baseURL = "http://127.0.0.1:4040/api/"
+// DefaultBaseURL is the base URL of the agent API listening on the default web_addr.
+const DefaultBaseURL = "http://127.0.0.1:4040/api/"
 
 type Tunnel struct {
 	Name      string       `json:"name"`
@@ -35,98 +40,207 @@ type Tunnel struct {
 	PublicURL string       `json:"public_url,omitempty"`
 	Proto     string       `json:"proto"`
 	Config    TunnelConfig `json:"config,omitempty"`
+	// Metrics are the traffic metrics of the tunnel since it was started.
+	Metrics *TunnelMetrics `json:"metrics,omitempty"`
+}
+
+// TunnelMetrics are the traffic metrics the agent reports for a tunnel.
+type TunnelMetrics struct {
+	// Conns are the metrics of the connections to the tunnel.
+	Conns Metrics `json:"conns"`
+	// HTTP are the metrics of the requests to the http tunnel.
+	HTTP Metrics `json:"http"`
+}
+
+// Metrics are the counts, rates and duration percentiles of the tunnel
+// connections or http requests.
+type Metrics struct {
+	// Count is the total number of connections or requests.
+	Count int64 `json:"count"`
+	// Gauge is the number of open connections or in-flight requests.
+	Gauge int64 `json:"gauge"`
+	// Rate1, Rate5 and Rate15 are the per-second rates averaged over 1, 5 and 15 minutes.
+	Rate1  float64 `json:"rate1"`
+	Rate5  float64 `json:"rate5"`
+	Rate15 float64 `json:"rate15"`
+	// P50, P90, P95 and P99 are the duration percentiles in nanoseconds.
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
 }
 
 type TunnelConfig struct {
 	Addr       string `json:"addr,omitempty"`
 	Proto      string `json:"proto,omitempty"`
 	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Hostname is the custom hostname of http or tls tunnel.
+	Hostname string `json:"hostname,omitempty"`
+	// Crt and Key are the paths, on the agent filesystem, of the PEM encoded certificate
+	// and private key the tls tunnel is terminated with.
+	Crt string `json:"crt,omitempty"`
+	Key string `json:"key,omitempty"`
+	// Auth is the basic auth credentials of http tunnel, in username:password form.
+	Auth string `json:"auth,omitempty"`
+	// OAuth enforces the OAuth authentication of http tunnel at the ngrok edge.
+	OAuth *OAuth `json:"oauth,omitempty"`
+	// OIDC enforces the OpenID Connect authentication of http tunnel at the ngrok edge.
+	OIDC *OIDC `json:"oidc,omitempty"`
+	// IPRestriction restricts the source IPs allowed to connect to the tunnel.
+	IPRestriction *IPRestriction `json:"ip_restriction,omitempty"`
+}
+
+// IPRestriction is the IP restriction policy of the tunnel. Connections from
+// IPs that match the DenyCIDRs, or don't match the AllowCIDRs when it is not
+// empty, are rejected at the ngrok edge.
+type IPRestriction struct {
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty"`
+}
+
+// OAuth is the OAuth config of http tunnel.
+type OAuth struct {
+	// Provider is the OAuth identity provider, e.g. google or github.
+	Provider     string   `json:"provider"`
+	AllowEmails  []string `json:"allow_emails,omitempty"`
+	AllowDomains []string `json:"allow_domains,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	// ClientID and ClientSecret of your own OAuth app. The ngrok managed
+	// OAuth app is used when they are empty.
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
 }
 
-var DefaultAgent Agent = &AgentClient{Client: &http.Client{}}
+// OIDC is the OpenID Connect config of http tunnel.
+type OIDC struct {
+	IssuerURL    string   `json:"issuer_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	AllowEmails  []string `json:"allow_emails,omitempty"`
+	AllowDomains []string `json:"allow_domains,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
 
 type Agent interface {
+	List(ctx context.Context) ([]Tunnel, error)
 	Find(ctx context.Context, tunnelName string) (*Tunnel, error)
 	Start(ctx context.Context, tunnelName string, config TunnelConfig) (*Tunnel, error)
 	Stop(ctx context.Context, tunnelName string) error
+
+	ListRequests(ctx context.Context, opts ListRequestsOptions) ([]CapturedRequest, error)
+	GetRequest(ctx context.Context, id string) (*CapturedRequest, error)
+	ReplayRequest(ctx context.Context, id string, tunnelName string) error
+	ClearRequests(ctx context.Context) error
 }
 
 type AgentClient struct {
 	*http.Client
+	// Name is the name of the agent the metrics of the API requests are labelled with.
+	Name string
+	// BaseURL is the base URL of the agent API. Defaults to DefaultBaseURL.
+	BaseURL string
 }
 
-func (c *AgentClient) Find(ctx context.Context, tunnelName string) (*Tunnel, error) {
-	u := baseURL + path.Join("tunnels", tunnelName)
-	resp, err := c.Get(u)
-	if err != nil {
-		return nil, err
+func (c *AgentClient) url(elem ...string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		tunnel := &Tunnel{}
-		if err := json.NewDecoder(resp.Body).Decode(tunnel); err != nil {
-			return nil, err
+	return strings.TrimSuffix(base, "/") + "/" + path.Join(elem...)
+}
+
+// do sends the request with the JSON encoded body, if any, and decodes the response
+// into out, if any, when the response has the expected status code. Otherwise, it
+// returns the agent API error.
+func (c *AgentClient) do(ctx context.Context, method, u string, body interface{}, status int, out interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
 		}
 
-		return tunnel, nil
+		rb = bytes.NewReader(b)
 	}
 
-	var nerr nerrors.Error
-	if err := json.NewDecoder(resp.Body).Decode(&nerr); err != nil {
-		return nil, err
+	req, err := http.NewRequestWithContext(ctx, method, u, rb)
+	if err != nil {
+		return err
 	}
 
-	return nil, nerr
-}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-func (c *AgentClient) Start(ctx context.Context, tunnelName string, config TunnelConfig) (*Tunnel, error) {
-	u := baseURL + "tunnels"
-	b := struct {
-		Name         string `json:"name"`
-		TunnelConfig `json:",inline"`
-	}{
-		Name:         tunnelName,
-		TunnelConfig: config,
+	start := time.Now()
+	resp, err := c.Do(req)
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
 	}
 
-	rb, _ := json.Marshal(b)
-	resp, err := c.Post(u, "application/json", bytes.NewReader(rb))
+	agentRequestDuration.WithLabelValues(c.Name, method, c.resource(u), code).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if resp.StatusCode == http.StatusCreated {
-		return c.Find(ctx, tunnelName)
+	defer resp.Body.Close()
+	if resp.StatusCode == status {
+		if out == nil {
+			return nil
+		}
+
+		return json.NewDecoder(resp.Body).Decode(out)
 	}
 
 	var nerr nerrors.Error
-	if err := json.NewDecoder(resp.Body).Decode(&nerr); err != nil {
-		return nil, err
+	if err := json.NewDecoder(resp.Body).Decode(&nerr); err != nil || nerr.StatusCode == 0 {
+		// the response is not an agent API error, e.g. it was sent by a proxy.
+		nerr = nerrors.Error{StatusCode: resp.StatusCode, Message: resp.Status}
 	}
 
-	return nil, nerr
+	nerr.RetryAfter = nerrors.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	return nerr
 }
 
-func (c *AgentClient) Stop(ctx context.Context, tunnelName string) error {
-	u := baseURL + path.Join("tunnels", tunnelName)
-	req, err := http.NewRequest(http.MethodDelete, u, nil)
-	if err != nil {
-		return err
+func (c *AgentClient) List(ctx context.Context) ([]Tunnel, error) {
+	list := &struct {
+		Tunnels []Tunnel `json:"tunnels"`
+	}{}
+
+	if err := c.do(ctx, http.MethodGet, c.url("tunnels"), nil, http.StatusOK, list); err != nil {
+		return nil, err
 	}
 
-	resp, err := c.Do(req)
-	if err != nil {
-		return err
+	return list.Tunnels, nil
+}
+
+func (c *AgentClient) Find(ctx context.Context, tunnelName string) (*Tunnel, error) {
+	tunnel := &Tunnel{}
+	if err := c.do(ctx, http.MethodGet, c.url("tunnels", tunnelName), nil, http.StatusOK, tunnel); err != nil {
+		return nil, err
 	}
 
-	if resp.StatusCode == http.StatusNoContent {
-		return nil
+	return tunnel, nil
+}
+
+func (c *AgentClient) Start(ctx context.Context, tunnelName string, config TunnelConfig) (*Tunnel, error) {
+	b := struct {
+		Name         string `json:"name"`
+		TunnelConfig `json:",inline"`
+	}{
+		Name:         tunnelName,
+		TunnelConfig: config,
 	}
 
-	var nerr nerrors.Error
-	if err := json.NewDecoder(resp.Body).Decode(&nerr); err != nil {
-		return err
+	if err := c.do(ctx, http.MethodPost, c.url("tunnels"), b, http.StatusCreated, nil); err != nil {
+		return nil, err
 	}
 
-	return nerr
+	return c.Find(ctx, tunnelName)
+}
+
+func (c *AgentClient) Stop(ctx context.Context, tunnelName string) error {
+	return c.do(ctx, http.MethodDelete, c.url("tunnels", tunnelName), nil, http.StatusNoContent, nil)
 }
@@ -0,0 +1,174 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+func newTestAgentClient(t *testing.T, handler http.HandlerFunc) *AgentClient {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &AgentClient{Client: srv.Client(), BaseURL: srv.URL + "/api/"}
+}
+
+func TestAgentClient_Find(t *testing.T) {
+	c := newTestAgentClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tunnels/foo":
+			_ = json.NewEncoder(w).Encode(Tunnel{Name: "foo", PublicURL: "tcp://0.tcp.ngrok.io:12345", Proto: "tcp"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(nerrors.Error{Code: 404, StatusCode: http.StatusNotFound, Message: "tunnel not found"})
+		}
+	})
+
+	tunnel, err := c.Find(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("Find() unexpected error: %v", err)
+	}
+
+	if tunnel.PublicURL != "tcp://0.tcp.ngrok.io:12345" {
+		t.Errorf("Find() public_url = %q", tunnel.PublicURL)
+	}
+
+	_, err = c.Find(context.Background(), "bar")
+	if !nerrors.IsNotFound(err) {
+		t.Errorf("Find() expected not found error, got %v", err)
+	}
+
+	if err != nil && !strings.HasPrefix(err.Error(), "ngrok agent api error: tunnel not found") {
+		t.Errorf("Find() error message = %q, want the agent api prefix", err.Error())
+	}
+}
+
+func TestAgentClient_Requests(t *testing.T) {
+	var replayed, cleared bool
+	c := newTestAgentClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/requests/http":
+			if got := r.URL.Query().Get("tunnel_name"); got != "foo" {
+				t.Errorf("ListRequests() tunnel_name = %q, want %q", got, "foo")
+			}
+
+			_, _ = w.Write([]byte(`{"uri":"/api/requests/http","requests":[{"id":"548fb5c700000002","tunnel_name":"foo","duration":3893202,"request":{"method":"GET","uri":"/user/1","proto":"HTTP/1.1"},"response":{"status":"200 OK","status_code":200,"proto":"HTTP/1.1"}}]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/requests/http/548fb5c700000002":
+			_, _ = w.Write([]byte(`{"id":"548fb5c700000002","tunnel_name":"foo","request":{"method":"GET","uri":"/user/1","proto":"HTTP/1.1","raw":"R0VUIC91c2VyLzEgSFRUUC8xLjENCg0K"}}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/requests/http":
+			var b map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&b)
+			replayed = b["id"] == "548fb5c700000002" && b["tunnel_name"] == "bar"
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/requests/http":
+			cleared = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(nerrors.Error{StatusCode: http.StatusNotFound})
+		}
+	})
+
+	ctx := context.Background()
+	reqs, err := c.ListRequests(ctx, ListRequestsOptions{TunnelName: "foo", Limit: 10})
+	if err != nil {
+		t.Fatalf("ListRequests() unexpected error: %v", err)
+	}
+
+	if len(reqs) != 1 || reqs[0].Response == nil || reqs[0].Response.StatusCode != http.StatusOK {
+		t.Fatalf("ListRequests() unexpected requests: %+v", reqs)
+	}
+
+	req, err := c.GetRequest(ctx, reqs[0].ID)
+	if err != nil {
+		t.Fatalf("GetRequest() unexpected error: %v", err)
+	}
+
+	if string(req.Request.Raw) != "GET /user/1 HTTP/1.1\r\n\r\n" {
+		t.Errorf("GetRequest() raw = %q", req.Request.Raw)
+	}
+
+	if err := c.ReplayRequest(ctx, req.ID, "bar"); err != nil || !replayed {
+		t.Errorf("ReplayRequest() error = %v, replayed = %v", err, replayed)
+	}
+
+	if err := c.ClearRequests(ctx); err != nil || !cleared {
+		t.Errorf("ClearRequests() error = %v, cleared = %v", err, cleared)
+	}
+}
+
+func TestAgentClient_resource(t *testing.T) {
+	c := &AgentClient{BaseURL: "http://127.0.0.1:4040/api/"}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: c.url("tunnels"), want: "tunnels"},
+		{url: c.url("tunnels", "default-foo-80"), want: "tunnels"},
+		{url: c.url("requests", "http") + "?tunnel_name=default-foo-80", want: "requests"},
+	}
+
+	for _, tt := range tests {
+		if got := c.resource(tt.url); got != tt.want {
+			t.Errorf("resource(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(registry); err != nil {
+		t.Fatalf("RegisterMetrics() unexpected error: %v", err)
+	}
+
+	if err := RegisterMetrics(registry); err == nil {
+		t.Errorf("RegisterMetrics() expected error registering the metrics twice")
+	}
+}
+
+func TestAgentClient_List(t *testing.T) {
+	c := newTestAgentClient(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"tunnels":[{"name":"foo","proto":"https","public_url":"https://foo.ngrok.io",` +
+			`"metrics":{"conns":{"count":3,"gauge":1,"rate1":0.5,"p50":1500000000},"http":{"count":7,"rate5":0.25}}}]}`))
+	})
+
+	list, err := c.List(context.Background())
+	if err != nil {
+		t.Fatalf("List() unexpected error: %v", err)
+	}
+
+	if len(list) != 1 || list[0].Metrics == nil {
+		t.Fatalf("List() = %+v, expected one tunnel with metrics", list)
+	}
+
+	want := TunnelMetrics{
+		Conns: Metrics{Count: 3, Gauge: 1, Rate1: 0.5, P50: 1500000000},
+		HTTP:  Metrics{Count: 7, Rate5: 0.25},
+	}
+
+	if got := *list[0].Metrics; got != want {
+		t.Errorf("List() metrics = %+v, want %+v", got, want)
+	}
+}
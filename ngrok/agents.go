@@ -0,0 +1,268 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultAgentName is the name of the agent used when no agent is referenced.
+const DefaultAgentName = "default"
+
+// AgentConfig describes an ngrok agent the manager starts the tunnels on.
+type AgentConfig struct {
+	// Name identifies the agent. It is referenced by the TunnelClass.
+	Name string
+	// URL is the base URL of the agent API. Defaults to DefaultBaseURL.
+	URL string
+	// Pool is the optional name of the agent pool the agent belongs to.
+	Pool string
+	// Region is the ngrok region the agent session is connected to.
+	Region string
+	// Account is the optional name of the ngrok account the agent is authenticated
+	// with. The agents of the same account share the tunnel start rate limit.
+	Account string
+	// CertDir is the optional directory shared with the agent the certificates of the
+	// tls tunnels it terminates are written to. It must have the same path in the
+	// manager and agent containers.
+	CertDir string
+}
+
+// DefaultAgentConfig returns the config of the default agent listening on
+// DefaultBaseURL, connected to the given region.
+func DefaultAgentConfig(region string) AgentConfig {
+	return AgentConfig{Name: DefaultAgentName, URL: DefaultBaseURL, Region: region}
+}
+
+// ParseAgentConfig parses the AgentConfig from comma-separated key=value pairs,
+// e.g. "name=eu,url=http://127.0.0.1:4041/api/,pool=public,region=eu,account=acme,certs=/var/run/ngrok/certs".
+func ParseAgentConfig(s string) (AgentConfig, error) {
+	var config AgentConfig
+	for _, kv := range strings.Split(s, ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return AgentConfig{}, fmt.Errorf("invalid agent config %q: expected key=value pair", kv)
+		}
+
+		k, v := strings.TrimSpace(pair[0]), pair[1]
+		switch k {
+		case "name":
+			config.Name = strings.TrimSpace(v)
+		case "url":
+			config.URL = strings.TrimSpace(v)
+		case "pool":
+			config.Pool = strings.TrimSpace(v)
+		case "region":
+			config.Region = strings.TrimSpace(v)
+		case "account":
+			config.Account = strings.TrimSpace(v)
+		case "certs":
+			config.CertDir = strings.TrimSpace(v)
+		default:
+			return AgentConfig{}, fmt.Errorf("invalid agent config %q: unknown key %q", s, k)
+		}
+	}
+
+	if config.Name == "" {
+		return AgentConfig{}, fmt.Errorf("invalid agent config %q: name is required", s)
+	}
+
+	return config, nil
+}
+
+// Agents is a set of named agents.
+type Agents struct {
+	configs map[string]AgentConfig
+	agents  map[string]Agent
+	// added are the agents as added, before they are wrapped.
+	added map[string]Agent
+}
+
+// NewAgents returns the Agents with an AgentClient for each given config.
+func NewAgents(configs ...AgentConfig) *Agents {
+	a := &Agents{
+		configs: make(map[string]AgentConfig),
+		agents:  make(map[string]Agent),
+		added:   make(map[string]Agent),
+	}
+
+	for _, config := range configs {
+		a.Add(config, &AgentClient{Client: &http.Client{}, Name: config.Name, BaseURL: config.URL})
+	}
+
+	return a
+}
+
+// WithRetry wraps every agent of the set with the RetryAgent.
+func (a *Agents) WithRetry(retry RetryConfig, breaker BreakerConfig) *Agents {
+	for name, agent := range a.agents {
+		a.agents[name] = NewRetryAgent(name, agent, retry, breaker)
+	}
+
+	return a
+}
+
+// WithStartRateLimit wraps every agent of the set with the RateLimitedAgent.
+// The agents of the same account share the token bucket, the agents without
+// an account have their own.
+func (a *Agents) WithStartRateLimit(limit rate.Limit, burst int) *Agents {
+	limiters := make(map[string]*rate.Limiter)
+	for name, agent := range a.agents {
+		key := "agent/" + name
+		if account := a.configs[name].Account; account != "" {
+			key = "account/" + account
+		}
+
+		if limiters[key] == nil {
+			limiters[key] = rate.NewLimiter(limit, burst)
+		}
+
+		a.agents[name] = NewRateLimitedAgent(name, agent, limiters[key])
+	}
+
+	return a
+}
+
+// Add adds the agent with given config into the set, replacing any agent with the same name.
+func (a *Agents) Add(config AgentConfig, agent Agent) {
+	a.configs[config.Name] = config
+	a.agents[config.Name] = agent
+	a.added[config.Name] = agent
+}
+
+// Unwrapped returns the set of the agents as added, without the RetryAgent and
+// RateLimitedAgent wrappers, e.g. for health checks that must neither be retried
+// nor be short-circuited by the circuit breaker.
+func (a *Agents) Unwrapped() *Agents {
+	u := &Agents{
+		configs: make(map[string]AgentConfig, len(a.configs)),
+		agents:  make(map[string]Agent, len(a.added)),
+		added:   make(map[string]Agent, len(a.added)),
+	}
+
+	for name, agent := range a.added {
+		u.Add(a.configs[name], agent)
+	}
+
+	return u
+}
+
+// Get returns the agent with given name.
+func (a *Agents) Get(name string) (Agent, bool) {
+	agent, ok := a.agents[name]
+	return agent, ok
+}
+
+// Config returns the config of the agent with given name.
+func (a *Agents) Config(name string) (AgentConfig, bool) {
+	config, ok := a.configs[name]
+	return config, ok
+}
+
+// All returns the sorted names of all agents.
+func (a *Agents) All() []string {
+	var names []string
+	for name := range a.agents {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the sorted names of the agents that matches with the given
+// reference and region. The reference is either an agent name or an agent pool
+// name. When the reference is empty, it matches the default agent unless a
+// region is given, in which case it matches any agent connected to the region.
+func (a *Agents) Names(ref, region string) []string {
+	var names []string
+	for name, config := range a.configs {
+		switch {
+		case region != "" && config.Region != region:
+			continue
+		case ref == "" && region == "" && name != DefaultAgentName:
+			continue
+		case ref != "" && name != ref && config.Pool != ref:
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Regions returns the sorted regions the agents are connected to.
+func (a *Agents) Regions() []string {
+	regions := make(map[string]struct{})
+	for _, config := range a.configs {
+		if config.Region != "" {
+			regions[config.Region] = struct{}{}
+		}
+	}
+
+	var list []string
+	for region := range regions {
+		list = append(list, region)
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// Select returns the name of the agent referenced by ref, that is either an
+// agent name or an agent pool name, and connected to the given region if any.
+// When more than one agent matches, the agent is picked consistently for the
+// given key among them with rendezvous hashing, so adding or removing an agent
+// only moves the keys picking that agent.
+func (a *Agents) Select(ref, region, key string) (string, error) {
+	names := a.Names(ref, region)
+	if len(names) == 0 {
+		switch {
+		case ref == "" && region == "":
+			return "", fmt.Errorf("no agent named %q", DefaultAgentName)
+		case ref == "":
+			return "", fmt.Errorf("no agent connected to region %q", region)
+		case region != "":
+			return "", fmt.Errorf("no agent or agent pool named %q connected to region %q", ref, region)
+		default:
+			return "", fmt.Errorf("no agent or agent pool named %q", ref)
+		}
+	}
+
+	var (
+		selected string
+		best     uint64
+	)
+
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(key + "\x00" + name))
+		if score := binary.BigEndian.Uint64(sum[:8]); selected == "" || score > best {
+			selected, best = name, score
+		}
+	}
+
+	return selected, nil
+}
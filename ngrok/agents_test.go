@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseAgentConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    AgentConfig
+		wantErr bool
+	}{
+		{
+			name: "Name only",
+			in:   "name=default",
+			want: AgentConfig{Name: "default"},
+		},
+		{
+			name: "All keys",
+			in:   "name=eu,url=http://127.0.0.1:4041/api/,pool=public,region=eu,account=acme,certs=/var/run/ngrok/certs",
+			want: AgentConfig{Name: "eu", URL: "http://127.0.0.1:4041/api/", Pool: "public", Region: "eu", Account: "acme", CertDir: "/var/run/ngrok/certs"},
+		},
+		{
+			name:    "Missing name",
+			in:      "url=http://127.0.0.1:4041/api/",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown key",
+			in:      "name=eu,foo=bar",
+			wantErr: true,
+		},
+		{
+			name:    "Not a key=value pair",
+			in:      "eu",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAgentConfig(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAgentConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAgentConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgents_Select(t *testing.T) {
+	agents := NewAgents(
+		AgentConfig{Name: DefaultAgentName, Region: "us"},
+		AgentConfig{Name: "eu-1", Pool: "eu", Region: "eu"},
+		AgentConfig{Name: "eu-2", Pool: "eu", Region: "eu"},
+		AgentConfig{Name: "ap-1", Pool: "eu", Region: "ap"},
+	)
+
+	tests := []struct {
+		name    string
+		ref     string
+		region  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Default agent",
+			ref:  "",
+			want: []string{DefaultAgentName},
+		},
+		{
+			name: "Agent name",
+			ref:  "eu-2",
+			want: []string{"eu-2"},
+		},
+		{
+			name: "Agent pool",
+			ref:  "eu",
+			want: []string{"eu-1", "eu-2", "ap-1"},
+		},
+		{
+			name:   "Agent pool in region",
+			ref:    "eu",
+			region: "ap",
+			want:   []string{"ap-1"},
+		},
+		{
+			name:   "Any agent in region",
+			region: "eu",
+			want:   []string{"eu-1", "eu-2"},
+		},
+		{
+			name:    "No agent in region",
+			ref:     "eu",
+			region:  "us",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown agent",
+			ref:     "us",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := agents.Select(tt.ref, tt.region, "default/foo")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Agents.Select() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			again, _ := agents.Select(tt.ref, tt.region, "default/foo")
+			if got != again {
+				t.Errorf("Agents.Select() is not consistent, got %q then %q", got, again)
+			}
+
+			found := false
+			for _, name := range tt.want {
+				found = found || name == got
+			}
+
+			if !found {
+				t.Errorf("Agents.Select() = %q, want one of %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgents_SelectStable(t *testing.T) {
+	agents := NewAgents(
+		AgentConfig{Name: "eu-1", Pool: "eu"},
+		AgentConfig{Name: "eu-2", Pool: "eu"},
+		AgentConfig{Name: "eu-3", Pool: "eu"},
+	)
+
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("default/svc-%d", i)
+		before[key], _ = agents.Select("eu", "", key)
+	}
+
+	// adding an agent to the pool only moves the keys that pick the new agent.
+	agents.Add(AgentConfig{Name: "eu-4", Pool: "eu"}, &AgentClient{})
+	moved := 0
+	for key, name := range before {
+		got, _ := agents.Select("eu", "", key)
+		if got == name {
+			continue
+		}
+
+		if got != "eu-4" {
+			t.Errorf("Agents.Select(%q) moved from %q to %q, want the added agent", key, name, got)
+		}
+
+		moved++
+	}
+
+	if moved == 0 || moved > 50 {
+		t.Errorf("Agents.Select() moved %d of 100 keys to the added agent", moved)
+	}
+}
+
+func TestAgents_Unwrapped(t *testing.T) {
+	config := AgentConfig{Name: "eu", URL: "http://127.0.0.1:4041/api/", Region: "eu"}
+	agents := NewAgents(config).WithRetry(testRetryConfig, BreakerConfig{}).WithStartRateLimit(1, 1)
+	if agent, _ := agents.Get("eu"); reflect.TypeOf(agent) == reflect.TypeOf(&AgentClient{}) {
+		t.Fatalf("Get() = %T, want the wrapped agent", agent)
+	}
+
+	unwrapped := agents.Unwrapped()
+	if agent, _ := unwrapped.Get("eu"); reflect.TypeOf(agent) != reflect.TypeOf(&AgentClient{}) {
+		t.Errorf("Unwrapped().Get() = %T, want *AgentClient", agent)
+	}
+
+	if got, _ := unwrapped.Config("eu"); !reflect.DeepEqual(got, config) {
+		t.Errorf("Unwrapped().Config() = %+v, want %+v", got, config)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudapi is a client of the ngrok API, that manages the resources of the
+// ngrok account, e.g. the reserved domains and TCP addresses, the TLS certificates,
+// the IP policies and the edges, as opposed to the agent API that manages the
+// tunnels of a single agent.
+package cloudapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+// DefaultBaseURL is the base URL of the ngrok API.
+const DefaultBaseURL = "https://api.ngrok.com"
+
+// APIVersion is the version of the ngrok API the client speaks.
+const APIVersion = "2"
+
+// Client is the ngrok API client. It authenticates with an API key of the ngrok account.
+type Client struct {
+	*http.Client
+	// BaseURL is the base URL of the ngrok API. Defaults to DefaultBaseURL.
+	BaseURL string
+	// APIKey is the ngrok API key.
+	APIKey string
+}
+
+// NewClient returns the Client authenticated with the API key.
+func NewClient(apiKey string) *Client {
+	return &Client{Client: &http.Client{}, APIKey: apiKey}
+}
+
+// Ref references another resource of the ngrok account.
+type Ref struct {
+	ID  string `json:"id"`
+	URI string `json:"uri,omitempty"`
+}
+
+// ListOptions selects a page of a list.
+type ListOptions struct {
+	// BeforeID lists the resources created before the resource with given ID.
+	BeforeID string
+	// Limit is the maximum number of resources in the page. The API default is used when zero.
+	Limit int
+}
+
+// Page is the paging of a list. The next page is listed before the ID of the
+// last resource of the page.
+type Page struct {
+	URI         string  `json:"uri"`
+	NextPageURI *string `json:"next_page_uri"`
+}
+
+func (p *Page) nextPage() string {
+	if p.NextPageURI == nil {
+		return ""
+	}
+
+	return *p.NextPageURI
+}
+
+// page is a page of a list.
+type page interface {
+	nextPage() string
+}
+
+func (c *Client) url(elem ...string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + path.Join(elem...)
+}
+
+// do sends the request with the JSON encoded body, if any, and decodes the response
+// into out, if any, when the response has the expected status code. Otherwise, it
+// returns the ngrok API error.
+func (c *Client) do(ctx context.Context, method, u string, body interface{}, status int, out interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		rb = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, rb)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set("Ngrok-Version", APIVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == status {
+		if out == nil {
+			return nil
+		}
+
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	return apiError(resp)
+}
+
+// apiError returns the nerrors.Error of the ngrok API error response.
+func apiError(resp *http.Response) error {
+	var aerr struct {
+		ErrorCode  string      `json:"error_code"`
+		StatusCode int         `json:"status_code"`
+		Message    string      `json:"msg"`
+		Details    interface{} `json:"details"`
+	}
+
+	nerr := nerrors.Error{StatusCode: resp.StatusCode, Message: resp.Status, Cloud: true}
+	if err := json.NewDecoder(resp.Body).Decode(&aerr); err == nil && aerr.StatusCode != 0 {
+		nerr.StatusCode = aerr.StatusCode
+		nerr.Message = aerr.Message
+		nerr.Details = aerr.Details
+		// the ngrok API error codes are the ERR_NGROK_<code> strings.
+		nerr.Code, _ = strconv.Atoi(strings.TrimPrefix(aerr.ErrorCode, "ERR_NGROK_"))
+	}
+
+	nerr.RetryAfter = nerrors.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	return nerr
+}
+
+// resource is a collection of resources of the ngrok account, served on the path.
+type resource struct {
+	c    *Client
+	path string
+}
+
+func (r resource) create(ctx context.Context, body, out interface{}) error {
+	return r.c.do(ctx, http.MethodPost, r.c.url(r.path), body, http.StatusCreated, out)
+}
+
+func (r resource) get(ctx context.Context, id string, out interface{}) error {
+	return r.c.do(ctx, http.MethodGet, r.c.url(r.path, id), nil, http.StatusOK, out)
+}
+
+func (r resource) update(ctx context.Context, id string, body, out interface{}) error {
+	return r.c.do(ctx, http.MethodPatch, r.c.url(r.path, id), body, http.StatusOK, out)
+}
+
+func (r resource) delete(ctx context.Context, id string) error {
+	return r.c.do(ctx, http.MethodDelete, r.c.url(r.path, id), nil, http.StatusNoContent, nil)
+}
+
+func (r resource) list(ctx context.Context, opts *ListOptions, out page) error {
+	q := url.Values{}
+	if opts != nil && opts.BeforeID != "" {
+		q.Set("before_id", opts.BeforeID)
+	}
+
+	if opts != nil && opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	u := r.c.url(r.path)
+	if len(q) > 0 {
+		u = u + "?" + q.Encode()
+	}
+
+	return r.c.do(ctx, http.MethodGet, u, nil, http.StatusOK, out)
+}
+
+// listAll lists every page, each decoded into a new page returned by newPage.
+func (r resource) listAll(ctx context.Context, newPage func() page) error {
+	u := r.c.url(r.path)
+	for {
+		out := newPage()
+		if err := r.c.do(ctx, http.MethodGet, u, nil, http.StatusOK, out); err != nil {
+			return err
+		}
+
+		next := out.nextPage()
+		if next == "" {
+			return nil
+		}
+
+		// only the query of the next page URI is followed, so the API key is
+		// never sent to another host than the configured base URL.
+		nu, err := url.Parse(next)
+		if err != nil {
+			return err
+		}
+
+		next = r.c.url(r.path) + "?" + nu.RawQuery
+		if next == u {
+			return fmt.Errorf("ngrok api returned the same page %s as the next page", u)
+		}
+
+		u = next
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/ngrok/cloudapi"
+	"github.com/prksu/kngrok/ngrok/cloudapi/cloudapitest"
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+func newTestServer(t *testing.T) *cloudapitest.Server {
+	srv := cloudapitest.NewServer("test-api-key")
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReservedDomainsClient(t *testing.T) {
+	ctx := context.Background()
+	domains := newTestServer(t).Client().ReservedDomains()
+
+	domain, err := domains.Create(ctx, &cloudapi.ReservedDomainCreate{Domain: "api.dev.example.com", Region: "eu"})
+	if err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	if domain.ID == "" || domain.Region != "eu" || domain.CNAMETarget == nil {
+		t.Errorf("Create() unexpected reserved domain: %+v", domain)
+	}
+
+	if _, err := domains.Create(ctx, &cloudapi.ReservedDomainCreate{Domain: "api.dev.example.com"}); !nerrors.IsConflict(err) {
+		t.Errorf("Create() expected conflict error for a reserved domain, got %v", err)
+	}
+
+	description := "api"
+	certID := "cert_000001"
+	updated, err := domains.Update(ctx, domain.ID, &cloudapi.ReservedDomainUpdate{Description: &description, CertificateID: &certID})
+	if err != nil {
+		t.Fatalf("Update() unexpected error: %v", err)
+	}
+
+	if updated.Description != description || updated.Certificate == nil || updated.Certificate.ID != certID {
+		t.Errorf("Update() unexpected reserved domain: %+v", updated)
+	}
+
+	got, err := domains.Get(ctx, domain.ID)
+	if err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, updated) {
+		t.Errorf("Get() = %+v, want %+v", got, updated)
+	}
+
+	if err := domains.Delete(ctx, domain.ID); err != nil {
+		t.Fatalf("Delete() unexpected error: %v", err)
+	}
+
+	if _, err := domains.Get(ctx, domain.ID); !nerrors.IsNotFound(err) {
+		t.Errorf("Get() expected not found error for a deleted reserved domain, got %v", err)
+	}
+
+	if err := domains.Delete(ctx, domain.ID); !nerrors.IsNotFound(err) {
+		t.Errorf("Delete() expected not found error for a deleted reserved domain, got %v", err)
+	}
+}
+
+func TestReservedAddrsClient_List(t *testing.T) {
+	ctx := context.Background()
+	addrs := newTestServer(t).Client().ReservedAddrs()
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		addr, err := addrs.Create(ctx, &cloudapi.ReservedAddrCreate{Description: fmt.Sprintf("addr-%d", i)})
+		if err != nil {
+			t.Fatalf("Create() unexpected error: %v", err)
+		}
+
+		// the addresses are listed from the most recently created.
+		created = append([]string{addr.Addr}, created...)
+	}
+
+	list, err := addrs.List(ctx, &cloudapi.ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("List() unexpected error: %v", err)
+	}
+
+	if len(list.ReservedAddrs) != 2 || list.NextPageURI == nil {
+		t.Fatalf("List() = %d reserved addresses, next page %v, want 2 and a next page", len(list.ReservedAddrs), list.NextPageURI)
+	}
+
+	next, err := addrs.List(ctx, &cloudapi.ListOptions{BeforeID: list.ReservedAddrs[1].ID, Limit: 2})
+	if err != nil {
+		t.Fatalf("List() unexpected error: %v", err)
+	}
+
+	if len(next.ReservedAddrs) != 2 || next.ReservedAddrs[0].Addr != created[2] {
+		t.Errorf("List() before %s = %+v, want the addresses from %s", list.ReservedAddrs[1].ID, next.ReservedAddrs, created[2])
+	}
+
+	all, err := addrs.ListAll(ctx)
+	if err != nil {
+		t.Fatalf("ListAll() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, addr := range all {
+		got = append(got, addr.Addr)
+	}
+
+	if !reflect.DeepEqual(got, created) {
+		t.Errorf("ListAll() = %v, want %v", got, created)
+	}
+}
+
+func TestClient_ListAllPages(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("before_id") {
+		case "":
+			// the next page URI is followed on the configured host only.
+			fmt.Fprint(w, `{"ip_policies":[{"id":"ipp_2"}],"uri":"","next_page_uri":"https://attacker.example.com/ip_policies?before_id=ipp_2"}`)
+		case "ipp_2":
+			fmt.Fprint(w, `{"ip_policies":[{"id":"ipp_1"}],"uri":"","next_page_uri":null}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c := cloudapi.NewClient("test-api-key")
+	c.BaseURL = srv.URL
+	all, err := c.IPPolicies().ListAll(context.Background())
+	if err != nil {
+		t.Fatalf("ListAll() unexpected error: %v", err)
+	}
+
+	if len(all) != 2 || all[0].ID != "ipp_2" || all[1].ID != "ipp_1" || calls != 2 {
+		t.Errorf("ListAll() = %+v after %d calls, want ipp_2 and ipp_1 after 2 calls", all, calls)
+	}
+}
+
+func TestIPPolicyRulesClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t).Client()
+
+	policy, err := c.IPPolicies().Create(ctx, &cloudapi.IPPolicyCreate{Description: "office"})
+	if err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	rule, err := c.IPPolicyRules().Create(ctx, &cloudapi.IPPolicyRuleCreate{
+		CIDR:       "10.0.0.0/8",
+		IPPolicyID: policy.ID,
+		Action:     cloudapi.IPPolicyRuleAllow,
+	})
+	if err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	if rule.IPPolicy.ID != policy.ID || rule.CIDR != "10.0.0.0/8" || rule.Action != cloudapi.IPPolicyRuleAllow {
+		t.Errorf("Create() unexpected IP policy rule: %+v", rule)
+	}
+}
+
+func TestEdgesClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t).Client()
+
+	if _, err := c.HTTPSEdges().Create(ctx, &cloudapi.EdgeCreate{Hostports: []string{"api.dev.example.com:443"}}); err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	if _, err := c.TCPEdges().Create(ctx, &cloudapi.EdgeCreate{Hostports: []string{"1.tcp.ngrok.io:20000"}}); err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	edges, err := c.HTTPSEdges().ListAll(ctx)
+	if err != nil {
+		t.Fatalf("ListAll() unexpected error: %v", err)
+	}
+
+	if len(edges) != 1 || !reflect.DeepEqual(edges[0].Hostports, []string{"api.dev.example.com:443"}) {
+		t.Errorf("ListAll() = %+v, want the https edge only", edges)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+
+	c := srv.Client()
+	c.APIKey = "invalid"
+	if _, err := c.TLSCertificates().ListAll(ctx); !nerrors.IsUnauthorized(err) {
+		t.Errorf("ListAll() expected unauthorized error, got %v", err)
+	}
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error_code":"ERR_NGROK_226","status_code":429,"msg":"rate limited","details":{"operation_id":"op_1"}}`)
+	}))
+	t.Cleanup(limited.Close)
+
+	c = cloudapi.NewClient("test-api-key")
+	c.BaseURL = limited.URL
+	_, err := c.ReservedDomains().Get(ctx, "rd_1")
+	if !nerrors.IsTooManyRequests(err) {
+		t.Fatalf("Get() expected too many requests error, got %v", err)
+	}
+
+	if d, ok := nerrors.RetryAfter(err); !ok || d != 30*time.Second {
+		t.Errorf("Get() retry after = %v, %v, want 30s", d, ok)
+	}
+
+	if nerr := err.(nerrors.Error); nerr.Code != 226 || nerr.Message != "rate limited" {
+		t.Errorf("Get() error = %+v, want code 226 and message", nerr)
+	}
+
+	if !strings.HasPrefix(err.Error(), "ngrok cloud api error: rate limited") {
+		t.Errorf("Get() error message = %q, want the cloud api prefix", err.Error())
+	}
+}
+
+func TestNewClientFromSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ngrok-api", Namespace: "kngrok-system"},
+		Data:       map[string][]byte{cloudapi.APIKeySecretKey: []byte("test-api-key")},
+	}
+
+	empty := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "kngrok-system"}}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret, empty).Build()
+
+	tests := []struct {
+		name    string
+		key     client.ObjectKey
+		wantErr bool
+	}{
+		{
+			name: "API key",
+			key:  client.ObjectKeyFromObject(secret),
+		},
+		{
+			name:    "Secret without API key",
+			key:     client.ObjectKeyFromObject(empty),
+			wantErr: true,
+		},
+		{
+			name:    "Secret not found",
+			key:     client.ObjectKey{Namespace: "kngrok-system", Name: "missing"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cloudapi.NewClientFromSecret(context.Background(), c, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClientFromSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && got.APIKey != "test-api-key" {
+				t.Errorf("NewClientFromSecret() API key = %q, want %q", got.APIKey, "test-api-key")
+			}
+		})
+	}
+}
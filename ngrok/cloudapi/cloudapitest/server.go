@@ -0,0 +1,294 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudapitest provides an in-memory stand-in of the ngrok API, so the
+// cloudapi clients and their callers are testable offline.
+package cloudapitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prksu/kngrok/ngrok/cloudapi"
+)
+
+// DefaultLimit is the number of resources of a page when the request sets no limit.
+const DefaultLimit = 100
+
+// collections are the collections of resources served, by path.
+var collections = []struct {
+	path    string
+	prefix  string
+	listKey string
+}{
+	{path: "reserved_domains", prefix: "rd", listKey: "reserved_domains"},
+	{path: "reserved_addrs", prefix: "ra", listKey: "reserved_addrs"},
+	{path: "tls_certificates", prefix: "cert", listKey: "certificates"},
+	{path: "ip_policies", prefix: "ipp", listKey: "ip_policies"},
+	{path: "ip_policy_rules", prefix: "ipr", listKey: "ip_policy_rules"},
+	{path: "edges/https", prefix: "edghts", listKey: "https_edges"},
+	{path: "edges/tcp", prefix: "edgtcp", listKey: "tcp_edges"},
+	{path: "edges/tls", prefix: "edgtls", listKey: "tls_edges"},
+}
+
+// Server is an in-memory stand-in of the ngrok API. The resources are stored as
+// they are created, with the fields ngrok sets on them, e.g. the ID, the CNAME
+// target of the reserved domains or the address of the reserved TCP addresses,
+// and listed from the most recently created. It doesn't validate the resources
+// beyond the reserved domains being unique, and its error codes are not the ones
+// of the ngrok API.
+type Server struct {
+	*httptest.Server
+	// APIKey is the API key the requests must be authenticated with.
+	APIKey string
+
+	mu        sync.Mutex
+	seq       int
+	resources map[string][]map[string]interface{}
+}
+
+// NewServer starts and returns a new Server accepting the API key. The caller
+// should call Close when finished, to shut it down.
+func NewServer(apiKey string) *Server {
+	s := &Server{APIKey: apiKey, resources: make(map[string][]map[string]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns a cloudapi.Client of the server, authenticated with its API key.
+func (s *Server) Client() *cloudapi.Client {
+	c := cloudapi.NewClient(s.APIKey)
+	c.Client = s.Server.Client()
+	c.BaseURL = s.URL
+	return c
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeError(w, http.StatusUnauthorized, "The API key is not valid.")
+		return
+	}
+
+	if r.Header.Get("Ngrok-Version") != cloudapi.APIVersion {
+		writeError(w, http.StatusBadRequest, "The Ngrok-Version header is not supported.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := strings.Trim(r.URL.Path, "/")
+	for _, col := range collections {
+		switch {
+		case p == col.path && r.Method == http.MethodGet:
+			s.list(w, r, col.path, col.listKey)
+			return
+		case p == col.path && r.Method == http.MethodPost:
+			s.create(w, r, col.path, col.prefix)
+			return
+		case strings.HasPrefix(p, col.path+"/") && !strings.Contains(strings.TrimPrefix(p, col.path+"/"), "/"):
+			s.serveResource(w, r, col.path, strings.TrimPrefix(p, col.path+"/"))
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, fmt.Sprintf("The endpoint %s %s does not exist.", r.Method, r.URL.Path))
+}
+
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, path, id string) {
+	i := s.index(path, id)
+	if i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The resource %s does not exist.", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.resources[path][i])
+	case http.MethodPatch:
+		update, ok := decode(w, r)
+		if !ok {
+			return
+		}
+
+		obj := s.resources[path][i]
+		for k, v := range references(update) {
+			if v != nil {
+				obj[k] = v
+			}
+		}
+
+		writeJSON(w, http.StatusOK, obj)
+	case http.MethodDelete:
+		s.resources[path] = append(s.resources[path][:i], s.resources[path][i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("The method %s is not allowed.", r.Method))
+	}
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, path, prefix string) {
+	obj, ok := decode(w, r)
+	if !ok {
+		return
+	}
+
+	s.seq++
+	id := fmt.Sprintf("%s_%06d", prefix, s.seq)
+	obj = references(obj)
+	obj["id"] = id
+	obj["uri"] = s.URL + "/" + path + "/" + id
+	obj["created_at"] = time.Now().UTC().Format(time.RFC3339)
+	for _, k := range []string{"description", "metadata"} {
+		if _, ok := obj[k]; !ok {
+			obj[k] = ""
+		}
+	}
+
+	switch path {
+	case "reserved_domains":
+		domain, _ := obj["domain"].(string)
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, "The domain is required.")
+			return
+		}
+
+		for _, other := range s.resources[path] {
+			if other["domain"] == domain {
+				writeError(w, http.StatusConflict, fmt.Sprintf("The domain %s is already reserved.", domain))
+				return
+			}
+		}
+
+		setDefault(obj, "region", "us")
+		obj["cname_target"] = fmt.Sprintf("%s.%s.cname.ngrok.io", strings.ReplaceAll(id, "_", ""), obj["region"])
+	case "reserved_addrs":
+		setDefault(obj, "region", "us")
+		obj["addr"] = fmt.Sprintf("1.tcp.ngrok.io:%d", 20000+s.seq)
+	case "tls_certificates":
+		// the private key is never returned.
+		delete(obj, "private_key_pem")
+	}
+
+	s.resources[path] = append(s.resources[path], obj)
+	writeJSON(w, http.StatusCreated, obj)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, path, listKey string) {
+	q := r.URL.Query()
+	limit := DefaultLimit
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("The limit %q is not valid.", v))
+			return
+		}
+
+		if l < limit {
+			limit = l
+		}
+	}
+
+	// the resources are listed from the most recently created.
+	all := s.resources[path]
+	end := len(all)
+	if beforeID := q.Get("before_id"); beforeID != "" {
+		if end = s.index(path, beforeID); end < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("The resource %s does not exist.", beforeID))
+			return
+		}
+	}
+
+	items := []map[string]interface{}{}
+	for i := end - 1; i >= 0 && len(items) < limit; i-- {
+		items = append(items, all[i])
+	}
+
+	var next interface{}
+	if len(items) > 0 && end-len(items) > 0 {
+		v := url.Values{}
+		v.Set("before_id", items[len(items)-1]["id"].(string))
+		v.Set("limit", strconv.Itoa(limit))
+		next = s.URL + "/" + path + "?" + v.Encode()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		listKey:         items,
+		"uri":           s.URL + r.URL.RequestURI(),
+		"next_page_uri": next,
+	})
+}
+
+// index returns the index of the resource with given ID in the collection, or -1.
+func (s *Server) index(path, id string) int {
+	for i, obj := range s.resources[path] {
+		if obj["id"] == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// references replaces the <name>_id fields of the request with the <name> references.
+func references(obj map[string]interface{}) map[string]interface{} {
+	for k, v := range obj {
+		if id, ok := v.(string); ok && strings.HasSuffix(k, "_id") {
+			delete(obj, k)
+			obj[strings.TrimSuffix(k, "_id")] = map[string]interface{}{"id": id}
+		}
+	}
+
+	return obj
+}
+
+func setDefault(obj map[string]interface{}, key string, value interface{}) {
+	if v, ok := obj[key]; !ok || v == "" {
+		obj[key] = value
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	obj := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("The request body is not valid: %v", err))
+		return nil, false
+	}
+
+	return obj, true
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error_code":  fmt.Sprintf("ERR_NGROK_%d", status),
+		"status_code": status,
+		"msg":         msg,
+		"details":     map[string]interface{}{},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Edge is an edge of the ngrok account, that routes the traffic of its hostports
+// to the tunnels it is attached to with the edge policies, e.g. an IP restriction.
+type Edge struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Metadata    string    `json:"metadata"`
+	// Hostports are the hostname and port pairs the edge serves, e.g. api.example.com:443.
+	Hostports []string `json:"hostports"`
+}
+
+// EdgeCreate is the request to create an edge.
+type EdgeCreate struct {
+	Description string   `json:"description,omitempty"`
+	Metadata    string   `json:"metadata,omitempty"`
+	Hostports   []string `json:"hostports,omitempty"`
+}
+
+// EdgeUpdate is the request to update an edge. The nil fields are unchanged.
+type EdgeUpdate struct {
+	Description *string  `json:"description,omitempty"`
+	Metadata    *string  `json:"metadata,omitempty"`
+	Hostports   []string `json:"hostports,omitempty"`
+}
+
+// EdgeList is a page of the edges of a protocol.
+type EdgeList struct {
+	Page
+	Edges []Edge `json:"-"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The edges are listed under the
+// key of their protocol.
+func (l *EdgeList) UnmarshalJSON(b []byte) error {
+	var list struct {
+		Page
+		HTTPSEdges []Edge `json:"https_edges"`
+		TCPEdges   []Edge `json:"tcp_edges"`
+		TLSEdges   []Edge `json:"tls_edges"`
+	}
+
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	l.Page = list.Page
+	l.Edges = append(append(list.HTTPSEdges, list.TCPEdges...), list.TLSEdges...)
+	return nil
+}
+
+// EdgesClient manages the edges of a protocol.
+type EdgesClient struct {
+	resource
+}
+
+// HTTPSEdges returns the client of the https edges.
+func (c *Client) HTTPSEdges() *EdgesClient {
+	return &EdgesClient{resource{c: c, path: "edges/https"}}
+}
+
+// TCPEdges returns the client of the tcp edges.
+func (c *Client) TCPEdges() *EdgesClient {
+	return &EdgesClient{resource{c: c, path: "edges/tcp"}}
+}
+
+// TLSEdges returns the client of the tls edges.
+func (c *Client) TLSEdges() *EdgesClient {
+	return &EdgesClient{resource{c: c, path: "edges/tls"}}
+}
+
+// Create creates the edge.
+func (c *EdgesClient) Create(ctx context.Context, create *EdgeCreate) (*Edge, error) {
+	edge := &Edge{}
+	if err := c.create(ctx, create, edge); err != nil {
+		return nil, err
+	}
+
+	return edge, nil
+}
+
+// Get returns the edge with given ID.
+func (c *EdgesClient) Get(ctx context.Context, id string) (*Edge, error) {
+	edge := &Edge{}
+	if err := c.get(ctx, id, edge); err != nil {
+		return nil, err
+	}
+
+	return edge, nil
+}
+
+// Update updates the edge with given ID.
+func (c *EdgesClient) Update(ctx context.Context, id string, update *EdgeUpdate) (*Edge, error) {
+	edge := &Edge{}
+	if err := c.update(ctx, id, update, edge); err != nil {
+		return nil, err
+	}
+
+	return edge, nil
+}
+
+// Delete deletes the edge with given ID.
+func (c *EdgesClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the edges.
+func (c *EdgesClient) List(ctx context.Context, opts *ListOptions) (*EdgeList, error) {
+	list := &EdgeList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the edges.
+func (c *EdgesClient) ListAll(ctx context.Context) ([]Edge, error) {
+	var pages []*EdgeList
+	if err := c.listAll(ctx, func() page {
+		list := &EdgeList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []Edge
+	for _, list := range pages {
+		all = append(all, list.Edges...)
+	}
+
+	return all, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"time"
+)
+
+// IPPolicy is a set of IP policy rules that allow or deny the source IPs of the
+// connections to the endpoints it is attached to.
+type IPPolicy struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Metadata    string    `json:"metadata"`
+}
+
+// IPPolicyCreate is the request to create an IP policy.
+type IPPolicyCreate struct {
+	Description string `json:"description,omitempty"`
+	Metadata    string `json:"metadata,omitempty"`
+}
+
+// IPPolicyUpdate is the request to update an IP policy. The nil fields are unchanged.
+type IPPolicyUpdate struct {
+	Description *string `json:"description,omitempty"`
+	Metadata    *string `json:"metadata,omitempty"`
+}
+
+// IPPolicyList is a page of the IP policies.
+type IPPolicyList struct {
+	Page
+	IPPolicies []IPPolicy `json:"ip_policies"`
+}
+
+// IP policy rule actions.
+const (
+	IPPolicyRuleAllow = "allow"
+	IPPolicyRuleDeny  = "deny"
+)
+
+// IPPolicyRule allows or denies the source IPs of a CIDR in an IP policy.
+type IPPolicyRule struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Metadata    string    `json:"metadata"`
+	CIDR        string    `json:"cidr"`
+	IPPolicy    Ref       `json:"ip_policy"`
+	// Action is either IPPolicyRuleAllow or IPPolicyRuleDeny.
+	Action string `json:"action"`
+}
+
+// IPPolicyRuleCreate is the request to create an IP policy rule.
+type IPPolicyRuleCreate struct {
+	Description string `json:"description,omitempty"`
+	Metadata    string `json:"metadata,omitempty"`
+	CIDR        string `json:"cidr"`
+	IPPolicyID  string `json:"ip_policy_id"`
+	Action      string `json:"action"`
+}
+
+// IPPolicyRuleUpdate is the request to update an IP policy rule. The nil fields are unchanged.
+type IPPolicyRuleUpdate struct {
+	Description *string `json:"description,omitempty"`
+	Metadata    *string `json:"metadata,omitempty"`
+	CIDR        *string `json:"cidr,omitempty"`
+}
+
+// IPPolicyRuleList is a page of the IP policy rules.
+type IPPolicyRuleList struct {
+	Page
+	IPPolicyRules []IPPolicyRule `json:"ip_policy_rules"`
+}
+
+// IPPoliciesClient manages the IP policies.
+type IPPoliciesClient struct {
+	resource
+}
+
+// IPPolicies returns the client of the IP policies.
+func (c *Client) IPPolicies() *IPPoliciesClient {
+	return &IPPoliciesClient{resource{c: c, path: "ip_policies"}}
+}
+
+// Create creates the IP policy.
+func (c *IPPoliciesClient) Create(ctx context.Context, create *IPPolicyCreate) (*IPPolicy, error) {
+	policy := &IPPolicy{}
+	if err := c.create(ctx, create, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Get returns the IP policy with given ID.
+func (c *IPPoliciesClient) Get(ctx context.Context, id string) (*IPPolicy, error) {
+	policy := &IPPolicy{}
+	if err := c.get(ctx, id, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Update updates the IP policy with given ID.
+func (c *IPPoliciesClient) Update(ctx context.Context, id string, update *IPPolicyUpdate) (*IPPolicy, error) {
+	policy := &IPPolicy{}
+	if err := c.update(ctx, id, update, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Delete deletes the IP policy with given ID.
+func (c *IPPoliciesClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the IP policies.
+func (c *IPPoliciesClient) List(ctx context.Context, opts *ListOptions) (*IPPolicyList, error) {
+	list := &IPPolicyList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the IP policies.
+func (c *IPPoliciesClient) ListAll(ctx context.Context) ([]IPPolicy, error) {
+	var pages []*IPPolicyList
+	if err := c.listAll(ctx, func() page {
+		list := &IPPolicyList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []IPPolicy
+	for _, list := range pages {
+		all = append(all, list.IPPolicies...)
+	}
+
+	return all, nil
+}
+
+// IPPolicyRulesClient manages the IP policy rules.
+type IPPolicyRulesClient struct {
+	resource
+}
+
+// IPPolicyRules returns the client of the IP policy rules.
+func (c *Client) IPPolicyRules() *IPPolicyRulesClient {
+	return &IPPolicyRulesClient{resource{c: c, path: "ip_policy_rules"}}
+}
+
+// Create creates the IP policy rule.
+func (c *IPPolicyRulesClient) Create(ctx context.Context, create *IPPolicyRuleCreate) (*IPPolicyRule, error) {
+	rule := &IPPolicyRule{}
+	if err := c.create(ctx, create, rule); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// Get returns the IP policy rule with given ID.
+func (c *IPPolicyRulesClient) Get(ctx context.Context, id string) (*IPPolicyRule, error) {
+	rule := &IPPolicyRule{}
+	if err := c.get(ctx, id, rule); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// Update updates the IP policy rule with given ID.
+func (c *IPPolicyRulesClient) Update(ctx context.Context, id string, update *IPPolicyRuleUpdate) (*IPPolicyRule, error) {
+	rule := &IPPolicyRule{}
+	if err := c.update(ctx, id, update, rule); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// Delete deletes the IP policy rule with given ID.
+func (c *IPPolicyRulesClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the IP policy rules.
+func (c *IPPolicyRulesClient) List(ctx context.Context, opts *ListOptions) (*IPPolicyRuleList, error) {
+	list := &IPPolicyRuleList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the IP policy rules.
+func (c *IPPolicyRulesClient) ListAll(ctx context.Context) ([]IPPolicyRule, error) {
+	var pages []*IPPolicyRuleList
+	if err := c.listAll(ctx, func() page {
+		list := &IPPolicyRuleList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []IPPolicyRule
+	for _, list := range pages {
+		all = append(all, list.IPPolicyRules...)
+	}
+
+	return all, nil
+}
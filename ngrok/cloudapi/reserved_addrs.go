@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"time"
+)
+
+// ReservedAddr is a TCP address reserved on the ngrok account, that the tcp
+// tunnels are bound to with their remote address.
+type ReservedAddr struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Metadata    string    `json:"metadata"`
+	// Addr is the reserved address, e.g. 1.tcp.ngrok.io:20000.
+	Addr   string `json:"addr"`
+	Region string `json:"region"`
+}
+
+// ReservedAddrCreate is the request to reserve a TCP address.
+type ReservedAddrCreate struct {
+	Region      string `json:"region,omitempty"`
+	Description string `json:"description,omitempty"`
+	Metadata    string `json:"metadata,omitempty"`
+}
+
+// ReservedAddrUpdate is the request to update a reserved TCP address. The nil fields are unchanged.
+type ReservedAddrUpdate struct {
+	Description *string `json:"description,omitempty"`
+	Metadata    *string `json:"metadata,omitempty"`
+}
+
+// ReservedAddrList is a page of the reserved TCP addresses.
+type ReservedAddrList struct {
+	Page
+	ReservedAddrs []ReservedAddr `json:"reserved_addrs"`
+}
+
+// ReservedAddrsClient manages the reserved TCP addresses.
+type ReservedAddrsClient struct {
+	resource
+}
+
+// ReservedAddrs returns the client of the reserved TCP addresses.
+func (c *Client) ReservedAddrs() *ReservedAddrsClient {
+	return &ReservedAddrsClient{resource{c: c, path: "reserved_addrs"}}
+}
+
+// Create reserves a TCP address.
+func (c *ReservedAddrsClient) Create(ctx context.Context, create *ReservedAddrCreate) (*ReservedAddr, error) {
+	addr := &ReservedAddr{}
+	if err := c.create(ctx, create, addr); err != nil {
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+// Get returns the reserved TCP address with given ID.
+func (c *ReservedAddrsClient) Get(ctx context.Context, id string) (*ReservedAddr, error) {
+	addr := &ReservedAddr{}
+	if err := c.get(ctx, id, addr); err != nil {
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+// Update updates the reserved TCP address with given ID.
+func (c *ReservedAddrsClient) Update(ctx context.Context, id string, update *ReservedAddrUpdate) (*ReservedAddr, error) {
+	addr := &ReservedAddr{}
+	if err := c.update(ctx, id, update, addr); err != nil {
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+// Delete releases the reserved TCP address with given ID.
+func (c *ReservedAddrsClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the reserved TCP addresses.
+func (c *ReservedAddrsClient) List(ctx context.Context, opts *ListOptions) (*ReservedAddrList, error) {
+	list := &ReservedAddrList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the reserved TCP addresses.
+func (c *ReservedAddrsClient) ListAll(ctx context.Context) ([]ReservedAddr, error) {
+	var pages []*ReservedAddrList
+	if err := c.listAll(ctx, func() page {
+		list := &ReservedAddrList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []ReservedAddr
+	for _, list := range pages {
+		all = append(all, list.ReservedAddrs...)
+	}
+
+	return all, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"time"
+)
+
+// ReservedDomain is a domain reserved on the ngrok account, that the http and tls
+// tunnels are bound to with their hostname.
+type ReservedDomain struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Metadata    string    `json:"metadata"`
+	Domain      string    `json:"domain"`
+	Region      string    `json:"region"`
+	// CNAMETarget is the DNS target the custom domain must be a CNAME of. It
+	// is not set for the subdomains of the ngrok domains.
+	CNAMETarget *string `json:"cname_target"`
+	// Certificate is the TLS certificate the domain is terminated with, if any.
+	Certificate *Ref `json:"certificate"`
+	// CertificateManagementPolicy is the policy of the certificate ngrok
+	// manages for the domain, if any.
+	CertificateManagementPolicy *CertificateManagementPolicy `json:"certificate_management_policy"`
+}
+
+// CertificateManagementPolicy is the policy of the certificate ngrok manages for a domain.
+type CertificateManagementPolicy struct {
+	// Authority is the certificate authority, e.g. letsencrypt.
+	Authority string `json:"authority"`
+	// PrivateKeyType is the type of the private key, e.g. ecdsa or rsa.
+	PrivateKeyType string `json:"private_key_type"`
+}
+
+// ReservedDomainCreate is the request to reserve a domain.
+type ReservedDomainCreate struct {
+	Domain                      string                       `json:"domain"`
+	Region                      string                       `json:"region,omitempty"`
+	Description                 string                       `json:"description,omitempty"`
+	Metadata                    string                       `json:"metadata,omitempty"`
+	CertificateID               *string                      `json:"certificate_id,omitempty"`
+	CertificateManagementPolicy *CertificateManagementPolicy `json:"certificate_management_policy,omitempty"`
+}
+
+// ReservedDomainUpdate is the request to update a reserved domain. The nil fields are unchanged.
+type ReservedDomainUpdate struct {
+	Description                 *string                      `json:"description,omitempty"`
+	Metadata                    *string                      `json:"metadata,omitempty"`
+	CertificateID               *string                      `json:"certificate_id,omitempty"`
+	CertificateManagementPolicy *CertificateManagementPolicy `json:"certificate_management_policy,omitempty"`
+}
+
+// ReservedDomainList is a page of the reserved domains.
+type ReservedDomainList struct {
+	Page
+	ReservedDomains []ReservedDomain `json:"reserved_domains"`
+}
+
+// ReservedDomainsClient manages the reserved domains.
+type ReservedDomainsClient struct {
+	resource
+}
+
+// ReservedDomains returns the client of the reserved domains.
+func (c *Client) ReservedDomains() *ReservedDomainsClient {
+	return &ReservedDomainsClient{resource{c: c, path: "reserved_domains"}}
+}
+
+// Create reserves the domain.
+func (c *ReservedDomainsClient) Create(ctx context.Context, create *ReservedDomainCreate) (*ReservedDomain, error) {
+	domain := &ReservedDomain{}
+	if err := c.create(ctx, create, domain); err != nil {
+		return nil, err
+	}
+
+	return domain, nil
+}
+
+// Get returns the reserved domain with given ID.
+func (c *ReservedDomainsClient) Get(ctx context.Context, id string) (*ReservedDomain, error) {
+	domain := &ReservedDomain{}
+	if err := c.get(ctx, id, domain); err != nil {
+		return nil, err
+	}
+
+	return domain, nil
+}
+
+// Update updates the reserved domain with given ID.
+func (c *ReservedDomainsClient) Update(ctx context.Context, id string, update *ReservedDomainUpdate) (*ReservedDomain, error) {
+	domain := &ReservedDomain{}
+	if err := c.update(ctx, id, update, domain); err != nil {
+		return nil, err
+	}
+
+	return domain, nil
+}
+
+// Delete releases the reserved domain with given ID.
+func (c *ReservedDomainsClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the reserved domains.
+func (c *ReservedDomainsClient) List(ctx context.Context, opts *ListOptions) (*ReservedDomainList, error) {
+	list := &ReservedDomainList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the reserved domains.
+func (c *ReservedDomainsClient) ListAll(ctx context.Context) ([]ReservedDomain, error) {
+	var pages []*ReservedDomainList
+	if err := c.listAll(ctx, func() page {
+		list := &ReservedDomainList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []ReservedDomain
+	for _, list := range pages {
+		all = append(all, list.ReservedDomains...)
+	}
+
+	return all, nil
+}
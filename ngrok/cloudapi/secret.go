@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// APIKeySecretKey is the key of the ngrok API key in the Secret.
+const APIKeySecretKey = "api-key"
+
+// NewClientFromSecret returns the Client authenticated with the API key read from
+// the APIKeySecretKey of the Secret. The key is read once, the client is expected to
+// be recreated when the Secret changes.
+func NewClientFromSecret(ctx context.Context, c client.Reader, key client.ObjectKey) (*Client, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, key, secret); err != nil {
+		return nil, err
+	}
+
+	apiKey := string(secret.Data[APIKeySecretKey])
+	if apiKey == "" {
+		return nil, fmt.Errorf("secret %q has no %q key", key, APIKeySecretKey)
+	}
+
+	return NewClient(apiKey), nil
+}
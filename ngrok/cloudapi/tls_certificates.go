@@ -0,0 +1,130 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudapi
+
+import (
+	"context"
+	"time"
+)
+
+// TLSCertificate is a TLS certificate uploaded to the ngrok account, that the
+// reserved domains and the edges are terminated with.
+type TLSCertificate struct {
+	ID                string    `json:"id"`
+	URI               string    `json:"uri"`
+	CreatedAt         time.Time `json:"created_at"`
+	Description       string    `json:"description"`
+	Metadata          string    `json:"metadata"`
+	CertificatePEM    string    `json:"certificate_pem"`
+	SubjectCommonName string    `json:"subject_common_name"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+}
+
+// TLSCertificateCreate is the request to upload a TLS certificate and its private key.
+type TLSCertificateCreate struct {
+	Description    string `json:"description,omitempty"`
+	Metadata       string `json:"metadata,omitempty"`
+	CertificatePEM string `json:"certificate_pem"`
+	PrivateKeyPEM  string `json:"private_key_pem"`
+}
+
+// TLSCertificateUpdate is the request to update a TLS certificate. The nil fields are unchanged.
+type TLSCertificateUpdate struct {
+	Description *string `json:"description,omitempty"`
+	Metadata    *string `json:"metadata,omitempty"`
+}
+
+// TLSCertificateList is a page of the TLS certificates.
+type TLSCertificateList struct {
+	Page
+	Certificates []TLSCertificate `json:"certificates"`
+}
+
+// TLSCertificatesClient manages the TLS certificates.
+type TLSCertificatesClient struct {
+	resource
+}
+
+// TLSCertificates returns the client of the TLS certificates.
+func (c *Client) TLSCertificates() *TLSCertificatesClient {
+	return &TLSCertificatesClient{resource{c: c, path: "tls_certificates"}}
+}
+
+// Create uploads the TLS certificate.
+func (c *TLSCertificatesClient) Create(ctx context.Context, create *TLSCertificateCreate) (*TLSCertificate, error) {
+	cert := &TLSCertificate{}
+	if err := c.create(ctx, create, cert); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Get returns the TLS certificate with given ID.
+func (c *TLSCertificatesClient) Get(ctx context.Context, id string) (*TLSCertificate, error) {
+	cert := &TLSCertificate{}
+	if err := c.get(ctx, id, cert); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Update updates the TLS certificate with given ID.
+func (c *TLSCertificatesClient) Update(ctx context.Context, id string, update *TLSCertificateUpdate) (*TLSCertificate, error) {
+	cert := &TLSCertificate{}
+	if err := c.update(ctx, id, update, cert); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Delete deletes the TLS certificate with given ID.
+func (c *TLSCertificatesClient) Delete(ctx context.Context, id string) error {
+	return c.delete(ctx, id)
+}
+
+// List returns a page of the TLS certificates.
+func (c *TLSCertificatesClient) List(ctx context.Context, opts *ListOptions) (*TLSCertificateList, error) {
+	list := &TLSCertificateList{}
+	if err := c.list(ctx, opts, list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListAll returns all the TLS certificates.
+func (c *TLSCertificatesClient) ListAll(ctx context.Context) ([]TLSCertificate, error) {
+	var pages []*TLSCertificateList
+	if err := c.listAll(ctx, func() page {
+		list := &TLSCertificateList{}
+		pages = append(pages, list)
+		return list
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []TLSCertificate
+	for _, list := range pages {
+		all = append(all, list.Certificates...)
+	}
+
+	return all, nil
+}
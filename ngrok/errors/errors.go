@@ -20,6 +20,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Error struct {
@@ -27,10 +29,21 @@ type Error struct {
 	StatusCode int         `json:"status_code"`
 	Message    string      `json:"msg"`
 	Details    interface{} `json:"details"`
+	// RetryAfter is the delay the agent asked to wait before retrying, from
+	// the Retry-After header of the response, if any.
+	RetryAfter time.Duration `json:"-"`
+	// Cloud is true for the errors of the ngrok cloud API at api.ngrok.com,
+	// rather than of the agent API.
+	Cloud bool `json:"-"`
 }
 
 func (err Error) Error() string {
-	return fmt.Sprintf("ngrok agent api error: %s - code: %d - see https://ngrok.com/docs/errors for more details", err.Message, err.Code)
+	api := "agent api"
+	if err.Cloud {
+		api = "cloud api"
+	}
+
+	return fmt.Sprintf("ngrok %s error: %s - code: %d - see https://ngrok.com/docs/errors for more details", api, err.Message, err.Code)
 }
 
 func IsNotFound(err error) bool {
@@ -40,3 +53,111 @@ func IsNotFound(err error) bool {
 
 	return false
 }
+
+func IsBadRequest(err error) bool {
+	if nerr := Error(Error{}); errors.As(err, &nerr) {
+		return nerr.StatusCode == http.StatusBadRequest
+	}
+
+	return false
+}
+
+func IsUnauthorized(err error) bool {
+	if nerr := Error(Error{}); errors.As(err, &nerr) {
+		return nerr.StatusCode == http.StatusUnauthorized
+	}
+
+	return false
+}
+
+func IsConflict(err error) bool {
+	if nerr := Error(Error{}); errors.As(err, &nerr) {
+		return nerr.StatusCode == http.StatusConflict
+	}
+
+	return false
+}
+
+func IsTooManyRequests(err error) bool {
+	if nerr := Error(Error{}); errors.As(err, &nerr) {
+		return nerr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// CircuitOpenError is returned without calling the agent API while the circuit
+// breaker of the agent is open, after too many consecutive failed calls.
+type CircuitOpenError struct {
+	// Agent is the name of the agent.
+	Agent string
+	// RetryAfter is the remaining cool-down before the agent is called again.
+	RetryAfter time.Duration
+}
+
+func (err *CircuitOpenError) Error() string {
+	return fmt.Sprintf("ngrok agent %q is unavailable, retry after %s", err.Agent, err.RetryAfter)
+}
+
+func IsCircuitOpen(err error) bool {
+	var cerr *CircuitOpenError
+	return errors.As(err, &cerr)
+}
+
+// ThrottledError is returned without calling the agent API when starting the
+// tunnel would exceed the tunnel start rate limit of the agent.
+type ThrottledError struct {
+	// Agent is the name of the agent.
+	Agent string
+	// RetryAfter is the delay before a tunnel can be started on the agent.
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf("ngrok agent %q tunnel start rate limit exceeded, retry after %s", err.Agent, err.RetryAfter)
+}
+
+func IsThrottled(err error) bool {
+	var terr *ThrottledError
+	return errors.As(err, &terr)
+}
+
+// RetryAfter returns the delay to wait before retrying the call that failed
+// with the given error, when the circuit breaker of the agent is open, the call
+// was throttled or the agent asked to retry after a delay.
+func RetryAfter(err error) (time.Duration, bool) {
+	var cerr *CircuitOpenError
+	if errors.As(err, &cerr) {
+		return cerr.RetryAfter, true
+	}
+
+	var terr *ThrottledError
+	if errors.As(err, &terr) {
+		return terr.RetryAfter, true
+	}
+
+	if nerr := Error(Error{}); errors.As(err, &nerr) && nerr.RetryAfter > 0 {
+		return nerr.RetryAfter, true
+	}
+
+	return 0, false
+}
+
+// ParseRetryAfter parses the Retry-After header value, either in seconds or an HTTP date.
+func ParseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
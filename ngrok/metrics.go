@@ -0,0 +1,48 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// agentRequestDuration is the latency of the agent API requests by the
+	// agent name, the HTTP method, the API resource and the status code.
+	agentRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kngrok_agent_request_duration_seconds",
+		Help:    "Latency of the ngrok agent API requests by agent, method, resource and status code.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"agent", "method", "resource", "code"})
+)
+
+// RegisterMetrics registers the metrics of the agent clients with the registry.
+// The metrics are not registered on import, so that the package can be used
+// outside of the manager, e.g. by the kubectl-ngrok plugin.
+func RegisterMetrics(registry prometheus.Registerer) error {
+	return registry.Register(agentRequestDuration)
+}
+
+// resource returns the agent API resource of the URL, e.g. tunnels or requests,
+// so the metrics are not labelled with the tunnel names or request IDs.
+func (c *AgentClient) resource(u string) string {
+	rel := strings.TrimPrefix(u, c.url())
+	rel = strings.SplitN(rel, "?", 2)[0]
+	return strings.SplitN(rel, "/", 2)[0]
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+// RateLimitedAgent is the Agent that limits the rate its tunnels are started
+// at with a token bucket, which is shared by the agents of the same account
+// since ngrok throttles how fast an account can open tunnels.
+type RateLimitedAgent struct {
+	Agent
+	name    string
+	limiter *rate.Limiter
+}
+
+// NewRateLimitedAgent returns the RateLimitedAgent wrapping the agent with given name.
+func NewRateLimitedAgent(name string, agent Agent, limiter *rate.Limiter) *RateLimitedAgent {
+	return &RateLimitedAgent{Agent: agent, name: name, limiter: limiter}
+}
+
+// Start starts the tunnel if a token is available, otherwise it returns the
+// ThrottledError with the delay before a token is available.
+func (a *RateLimitedAgent) Start(ctx context.Context, tunnelName string, config TunnelConfig) (*Tunnel, error) {
+	r := a.limiter.Reserve()
+	if !r.OK() {
+		return nil, &nerrors.ThrottledError{Agent: a.name}
+	}
+
+	if d := r.Delay(); d > 0 {
+		// give back the token so the throttled start does not delay the others.
+		r.Cancel()
+		return nil, &nerrors.ThrottledError{Agent: a.name, RetryAfter: d}
+	}
+
+	return a.Agent.Start(ctx, tunnelName, config)
+}
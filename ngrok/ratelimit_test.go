@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"golang.org/x/time/rate"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+func TestAgents_WithStartRateLimit(t *testing.T) {
+	c := newTestAgentClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"name":"foo","proto":"tcp"}`))
+	})
+
+	agents := NewAgents()
+	agents.Add(AgentConfig{Name: "us", Account: "acme"}, c)
+	agents.Add(AgentConfig{Name: "eu", Account: "acme"}, c)
+	agents.Add(AgentConfig{Name: "ap"}, c)
+	agents.WithStartRateLimit(rate.Limit(0.1), 1)
+
+	start := func(name string) error {
+		agent, _ := agents.Get(name)
+		_, err := agent.Start(context.Background(), "foo", TunnelConfig{})
+		return err
+	}
+
+	if err := start("us"); err != nil {
+		t.Fatalf("Start() unexpected error: %v", err)
+	}
+
+	// eu shares the token bucket of the acme account with us.
+	err := start("eu")
+	if !nerrors.IsThrottled(err) {
+		t.Fatalf("Start() expected throttled error, got %v", err)
+	}
+
+	if d, ok := nerrors.RetryAfter(err); !ok || d <= 0 {
+		t.Errorf("RetryAfter() = %v, %v, want the delay before a token is available", d, ok)
+	}
+
+	// ap has its own token bucket.
+	if err := start("ap"); err != nil {
+		t.Errorf("Start() unexpected error: %v", err)
+	}
+
+	// the other calls are not limited.
+	agent, _ := agents.Get("eu")
+	if _, err := agent.Find(context.Background(), "foo"); err != nil {
+		t.Errorf("Find() unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// CapturedRequest is an HTTP request, and its response, captured by the agent
+// on the http tunnels with inspection enabled.
+type CapturedRequest struct {
+	URI        string    `json:"uri"`
+	ID         string    `json:"id"`
+	TunnelName string    `json:"tunnel_name"`
+	RemoteAddr string    `json:"remote_addr"`
+	Start      time.Time `json:"start"`
+	// Duration is the round-trip duration of the request.
+	Duration time.Duration `json:"duration"`
+	Request  CapturedHTTP  `json:"request"`
+	Response *CapturedHTTP `json:"response,omitempty"`
+}
+
+// CapturedHTTP is the captured HTTP request or response.
+type CapturedHTTP struct {
+	// Method and URI are only set on the request.
+	Method string `json:"method,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	// Status and StatusCode are only set on the response.
+	Status     string      `json:"status,omitempty"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Proto      string      `json:"proto"`
+	Headers    http.Header `json:"headers"`
+	// Raw is the raw bytes of the request or response, including the body.
+	Raw []byte `json:"raw"`
+}
+
+// ListRequestsOptions filters the captured requests.
+type ListRequestsOptions struct {
+	// TunnelName filters the requests captured on the given tunnel.
+	TunnelName string
+	// Limit is the maximum number of requests returned. The agent default is used when zero.
+	Limit int
+}
+
+// ListRequests returns the captured requests, the most recent first.
+func (c *AgentClient) ListRequests(ctx context.Context, opts ListRequestsOptions) ([]CapturedRequest, error) {
+	q := url.Values{}
+	if opts.TunnelName != "" {
+		q.Set("tunnel_name", opts.TunnelName)
+	}
+
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	u := c.url("requests", "http")
+	if len(q) > 0 {
+		u = u + "?" + q.Encode()
+	}
+
+	list := &struct {
+		URI      string            `json:"uri"`
+		Requests []CapturedRequest `json:"requests"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, u, nil, http.StatusOK, list); err != nil {
+		return nil, err
+	}
+
+	return list.Requests, nil
+}
+
+// GetRequest returns the captured request with given id, with its full request and response.
+func (c *AgentClient) GetRequest(ctx context.Context, id string) (*CapturedRequest, error) {
+	req := &CapturedRequest{}
+	if err := c.do(ctx, http.MethodGet, c.url("requests", "http", id), nil, http.StatusOK, req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// ReplayRequest replays the captured request with given id on the tunnel it was
+// captured on, or on the tunnel with given name when it is not empty.
+func (c *AgentClient) ReplayRequest(ctx context.Context, id string, tunnelName string) error {
+	b := struct {
+		ID         string `json:"id"`
+		TunnelName string `json:"tunnel_name,omitempty"`
+	}{
+		ID:         id,
+		TunnelName: tunnelName,
+	}
+
+	return c.do(ctx, http.MethodPost, c.url("requests", "http"), b, http.StatusNoContent, nil)
+}
+
+// ClearRequests deletes all the captured requests from the agent capture buffer.
+func (c *AgentClient) ClearRequests(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, c.url("requests", "http"), nil, http.StatusNoContent, nil)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+// RetryConfig configures the retry of the agent API calls.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of retries of a failed call. Only the
+	// idempotent calls are retried, and the calls the agent rejected with
+	// 429 Too Many Requests since they were not processed.
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry. It doubles on every retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. A call the agent asked to
+	// retry after a longer delay is not retried.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryConfig is the default RetryConfig.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries:     3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// BreakerConfig configures the circuit breaker of the agent.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed calls that opens the
+	// circuit. The circuit breaker is disabled when it is zero.
+	FailureThreshold int
+	// CoolDown is the time the circuit stays open before a call is let through
+	// to probe the agent. The circuit is closed again when that call succeeds.
+	CoolDown time.Duration
+}
+
+// DefaultBreakerConfig is the default BreakerConfig.
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	CoolDown:         30 * time.Second,
+}
+
+// RetryAgent is the Agent that retries the failed calls of the underlying agent
+// with exponential backoff and jitter, and fails fast with the CircuitOpenError
+// while its circuit breaker is open.
+type RetryAgent struct {
+	name    string
+	agent   Agent
+	retry   RetryConfig
+	breaker BreakerConfig
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var _ Agent = &RetryAgent{}
+
+// NewRetryAgent returns the RetryAgent wrapping the agent with given name.
+func NewRetryAgent(name string, agent Agent, retry RetryConfig, breaker BreakerConfig) *RetryAgent {
+	return &RetryAgent{name: name, agent: agent, retry: retry, breaker: breaker}
+}
+
+func (a *RetryAgent) List(ctx context.Context) (list []Tunnel, err error) {
+	err = a.call(ctx, true, func(ctx context.Context) error {
+		list, err = a.agent.List(ctx)
+		return err
+	})
+
+	return list, err
+}
+
+func (a *RetryAgent) Find(ctx context.Context, tunnelName string) (tunnel *Tunnel, err error) {
+	err = a.call(ctx, true, func(ctx context.Context) error {
+		tunnel, err = a.agent.Find(ctx, tunnelName)
+		return err
+	})
+
+	return tunnel, err
+}
+
+func (a *RetryAgent) Start(ctx context.Context, tunnelName string, config TunnelConfig) (tunnel *Tunnel, err error) {
+	err = a.call(ctx, false, func(ctx context.Context) error {
+		tunnel, err = a.agent.Start(ctx, tunnelName, config)
+		return err
+	})
+
+	return tunnel, err
+}
+
+func (a *RetryAgent) Stop(ctx context.Context, tunnelName string) error {
+	return a.call(ctx, true, func(ctx context.Context) error {
+		return a.agent.Stop(ctx, tunnelName)
+	})
+}
+
+func (a *RetryAgent) ListRequests(ctx context.Context, opts ListRequestsOptions) (reqs []CapturedRequest, err error) {
+	err = a.call(ctx, true, func(ctx context.Context) error {
+		reqs, err = a.agent.ListRequests(ctx, opts)
+		return err
+	})
+
+	return reqs, err
+}
+
+func (a *RetryAgent) GetRequest(ctx context.Context, id string) (req *CapturedRequest, err error) {
+	err = a.call(ctx, true, func(ctx context.Context) error {
+		req, err = a.agent.GetRequest(ctx, id)
+		return err
+	})
+
+	return req, err
+}
+
+func (a *RetryAgent) ReplayRequest(ctx context.Context, id string, tunnelName string) error {
+	return a.call(ctx, false, func(ctx context.Context) error {
+		return a.agent.ReplayRequest(ctx, id, tunnelName)
+	})
+}
+
+func (a *RetryAgent) ClearRequests(ctx context.Context) error {
+	return a.call(ctx, true, func(ctx context.Context) error {
+		return a.agent.ClearRequests(ctx)
+	})
+}
+
+// call calls fn through the circuit breaker, and retries it when it fails
+// with a retryable error.
+func (a *RetryAgent) call(ctx context.Context, idempotent bool, fn func(ctx context.Context) error) error {
+	if err := a.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(ctx); err == nil || attempt >= a.retry.MaxRetries || !retryable(err, idempotent) {
+			break
+		}
+
+		delay := a.backoff(attempt)
+		if d, ok := nerrors.RetryAfter(err); ok {
+			if d > a.retry.MaxBackoff {
+				// let the caller retry after the delay the agent asked for.
+				break
+			}
+
+			delay = d
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			a.done(err)
+			return err
+		case <-t.C:
+		}
+	}
+
+	a.done(err)
+	return err
+}
+
+// backoff returns the exponential backoff of the attempt with equal jitter.
+func (a *RetryAgent) backoff(attempt int) time.Duration {
+	d := a.retry.InitialBackoff << uint(attempt)
+	if d <= 0 || d > a.retry.MaxBackoff {
+		d = a.retry.MaxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// allow returns the CircuitOpenError while the circuit is open. Once the cool-down
+// has elapsed, a single call is let through to probe the agent.
+func (a *RetryAgent) allow() error {
+	if a.breaker.FailureThreshold <= 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failures < a.breaker.FailureThreshold {
+		return nil
+	}
+
+	if remaining := time.Until(a.openUntil); remaining > 0 || a.probing {
+		if remaining <= 0 {
+			// another call is probing the agent.
+			remaining = time.Second
+		}
+
+		return &nerrors.CircuitOpenError{Agent: a.name, RetryAfter: remaining}
+	}
+
+	a.probing = true
+	return nil
+}
+
+// done records the result of the call. The circuit is opened after FailureThreshold
+// consecutive calls failed because the agent is unavailable, and is closed by
+// the first successful call.
+func (a *RetryAgent) done(err error) {
+	if a.breaker.FailureThreshold <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.probing = false
+	if err == nil || !unavailable(err) {
+		a.failures = 0
+		return
+	}
+
+	a.failures++
+	if a.failures >= a.breaker.FailureThreshold {
+		a.openUntil = time.Now().Add(a.breaker.CoolDown)
+	}
+}
+
+// unavailable returns true if the error shows the agent is unavailable,
+// rather than the call being rejected.
+func unavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var nerr nerrors.Error
+	if errors.As(err, &nerr) {
+		return nerr.StatusCode >= http.StatusInternalServerError
+	}
+
+	return false
+}
+
+// retryable returns true if the call that failed with the error can be retried.
+// A call the agent rejected with 429 Too Many Requests was not processed so it
+// is always retryable, other calls are only retried when they are idempotent
+// and the agent is unavailable.
+func retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if nerrors.IsTooManyRequests(err) {
+		return true
+	}
+
+	return idempotent && unavailable(err)
+}
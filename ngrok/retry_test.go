@@ -0,0 +1,168 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ngrok
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nerrors "github.com/prksu/kngrok/ngrok/errors"
+)
+
+var testRetryConfig = RetryConfig{
+	MaxRetries:     2,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     10 * time.Millisecond,
+}
+
+// newTestRetryAgent returns the RetryAgent of the agent API answering with the
+// given status codes in turn, and the number of calls the API received.
+func newTestRetryAgent(t *testing.T, breaker BreakerConfig, retryAfter string, statuses ...int) (*RetryAgent, *int32) {
+	var calls int32
+	c := newTestAgentClient(t, func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1)) - 1
+		status := statuses[len(statuses)-1]
+		if n < len(statuses) {
+			status = statuses[n]
+		}
+
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+
+		w.WriteHeader(status)
+		switch {
+		case status == http.StatusCreated:
+		case status == http.StatusOK:
+			_, _ = w.Write([]byte(`{"name":"foo","proto":"tcp","public_url":"tcp://0.tcp.ngrok.io:12345"}`))
+		default:
+			_, _ = w.Write([]byte(`{"error_code":100,"status_code":` + strconv.Itoa(status) + `,"msg":"` + http.StatusText(status) + `"}`))
+		}
+	})
+
+	return NewRetryAgent("default", c, testRetryConfig, breaker), &calls
+}
+
+func TestRetryAgent_Retry(t *testing.T) {
+	tests := []struct {
+		name       string
+		call       func(a *RetryAgent) error
+		retryAfter string
+		statuses   []int
+		wantCalls  int32
+		wantErr    bool
+	}{
+		{
+			name:      "idempotent call is retried while the agent is unavailable",
+			call:      func(a *RetryAgent) error { _, err := a.Find(context.Background(), "foo"); return err },
+			statuses:  []int{503, 503, 200},
+			wantCalls: 3,
+		},
+		{
+			name:      "retries are bounded",
+			call:      func(a *RetryAgent) error { _, err := a.Find(context.Background(), "foo"); return err },
+			statuses:  []int{503},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+		{
+			name:      "rejected call is not retried",
+			call:      func(a *RetryAgent) error { _, err := a.Find(context.Background(), "foo"); return err },
+			statuses:  []int{400},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "non idempotent call is not retried while the agent is unavailable",
+			call:      func(a *RetryAgent) error { return a.ReplayRequest(context.Background(), "foo", "") },
+			statuses:  []int{503},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "non idempotent call is retried on too many requests",
+			call:      func(a *RetryAgent) error { _, err := a.Start(context.Background(), "foo", TunnelConfig{}); return err },
+			statuses:  []int{429, 201, 200},
+			wantCalls: 3,
+		},
+		{
+			name:       "call is not retried when the agent asks to retry after the max backoff",
+			call:       func(a *RetryAgent) error { _, err := a.Find(context.Background(), "foo"); return err },
+			retryAfter: "60",
+			statuses:   []int{429},
+			wantCalls:  1,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, calls := newTestRetryAgent(t, BreakerConfig{}, tt.retryAfter, tt.statuses...)
+			err := tt.call(a)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if got := atomic.LoadInt32(calls); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryAgent_RetryAfter(t *testing.T) {
+	a, _ := newTestRetryAgent(t, BreakerConfig{}, "60", 429)
+	_, err := a.Find(context.Background(), "foo")
+	if d, ok := nerrors.RetryAfter(err); !ok || d != time.Minute {
+		t.Errorf("RetryAfter() = %v, %v, want %v", d, ok, time.Minute)
+	}
+}
+
+func TestRetryAgent_CircuitBreaker(t *testing.T) {
+	a, calls := newTestRetryAgent(t, BreakerConfig{FailureThreshold: 2, CoolDown: 50 * time.Millisecond}, "", 503, 503, 503, 503, 503, 503, 200)
+	for i := 0; i < 2; i++ {
+		if _, err := a.Find(context.Background(), "foo"); err == nil || nerrors.IsCircuitOpen(err) {
+			t.Fatalf("Find() expected agent error, got %v", err)
+		}
+	}
+
+	_, err := a.Find(context.Background(), "foo")
+	if !nerrors.IsCircuitOpen(err) {
+		t.Fatalf("Find() expected circuit open error, got %v", err)
+	}
+
+	if d, ok := nerrors.RetryAfter(err); !ok || d <= 0 || d > 50*time.Millisecond {
+		t.Errorf("RetryAfter() = %v, %v, want the remaining cool-down", d, ok)
+	}
+
+	if got := atomic.LoadInt32(calls); got != 6 {
+		t.Errorf("got %d calls, want no call while the circuit is open", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := a.Find(context.Background(), "foo"); err != nil {
+		t.Fatalf("Find() unexpected error after the cool-down: %v", err)
+	}
+
+	if _, err := a.Find(context.Background(), "foo"); err != nil {
+		t.Errorf("Find() unexpected error once the circuit is closed: %v", err)
+	}
+}
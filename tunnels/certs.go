@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// CertificatePaths returns the paths of the certificate and private key files of
+// the named tunnel in the certificate directory of the agent.
+func CertificatePaths(dir, tunnelName string) (crt, key string) {
+	return filepath.Join(dir, tunnelName+".crt"), filepath.Join(dir, tunnelName+".key")
+}
+
+// WriteCertificate writes the certificate and private key files of the named tunnel
+// into the certificate directory of the agent, and returns their paths. The files are
+// replaced atomically so the agent never reads a partially written file.
+func WriteCertificate(dir, tunnelName string, cert *Certificate) (crt, key string, err error) {
+	crt, key = CertificatePaths(dir, tunnelName)
+	if err := writeFile(crt, cert.Cert); err != nil {
+		return "", "", err
+	}
+
+	if err := writeFile(key, cert.Key); err != nil {
+		return "", "", err
+	}
+
+	return crt, key, nil
+}
+
+// RemoveCertificate removes the certificate and private key files of the named tunnel
+// from the certificate directory of the agent. Missing files are ignored.
+func RemoveCertificate(dir, tunnelName string) error {
+	crt, key := CertificatePaths(dir, tunnelName)
+	for _, name := range []string{crt, key} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes the data to a temporary file renamed to name once written.
+func writeFile(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	// the agent container reads the files through the group of the shared directory.
+	if err := f.Chmod(0o640); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteCertificate(t *testing.T) {
+	dir := t.TempDir()
+	for _, cert := range []*Certificate{
+		{Cert: []byte("cert"), Key: []byte("key")},
+		// the renewed certificate replaces the files.
+		{Cert: []byte("renewed cert"), Key: []byte("renewed key")},
+	} {
+		crt, key, err := WriteCertificate(dir, "default-foo", cert)
+		if err != nil {
+			t.Fatalf("WriteCertificate() unexpected error: %v", err)
+		}
+
+		for name, want := range map[string][]byte{crt: cert.Cert, key: cert.Key} {
+			got, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatalf("WriteCertificate() file %s not written: %v", name, err)
+			}
+
+			if string(got) != string(want) {
+				t.Errorf("WriteCertificate() file %s = %q, want %q", name, got, want)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("WriteCertificate() left %d files in the directory, want 2", len(entries))
+	}
+
+	if err := RemoveCertificate(dir, "default-foo"); err != nil {
+		t.Fatalf("RemoveCertificate() unexpected error: %v", err)
+	}
+
+	if err := RemoveCertificate(dir, "default-foo"); err != nil {
+		t.Errorf("RemoveCertificate() unexpected error on removed files: %v", err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("RemoveCertificate() left %d files in the directory", len(entries))
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+// DefaultClass returns the TunnelClass of the given LoadBalancer class name that
+// is served without TunnelClass object. It runs the tunnels on the default agent,
+// or on any agent connected to the region requested by the service.
+func DefaultClass(loadBalancerClass string) *v1alpha1.TunnelClass {
+	return &v1alpha1.TunnelClass{
+		Spec: v1alpha1.TunnelClassSpec{
+			LoadBalancerClass: loadBalancerClass,
+		},
+	}
+}
+
+// ClassFor returns the TunnelClass that serves the LoadBalancer class of the service.
+// The defaultClass is served by the DefaultClass unless a TunnelClass object
+// overrides it. It returns nil when the service LoadBalancer class is not served.
+func ClassFor(ctx context.Context, c client.Reader, defaultClass string, svc *corev1.Service) (*v1alpha1.TunnelClass, error) {
+	loadBalancerClass := pointer.StringDeref(svc.Spec.LoadBalancerClass, "")
+	if loadBalancerClass == "" {
+		return nil, nil
+	}
+
+	classes := &v1alpha1.TunnelClassList{}
+	if err := c.List(ctx, classes); err != nil {
+		return nil, err
+	}
+
+	var matched []v1alpha1.TunnelClass
+	for _, class := range classes.Items {
+		if class.Spec.LoadBalancerClass == loadBalancerClass {
+			matched = append(matched, class)
+		}
+	}
+
+	switch len(matched) {
+	case 0:
+		if loadBalancerClass == defaultClass {
+			return DefaultClass(defaultClass), nil
+		}
+
+		return nil, nil
+	case 1:
+		return &matched[0], nil
+	default:
+		return nil, fmt.Errorf("found %d TunnelClasses for LoadBalancer class %q, expected one", len(matched), loadBalancerClass)
+	}
+}
+
+// ServedClasses returns the names of the LoadBalancer classes that are served,
+// which are the defaultClass and the classes of the TunnelClass objects.
+func ServedClasses(ctx context.Context, c client.Reader, defaultClass string) (sets.String, error) {
+	classes := &v1alpha1.TunnelClassList{}
+	if err := c.List(ctx, classes); err != nil {
+		return nil, err
+	}
+
+	served := sets.NewString(defaultClass)
+	for _, class := range classes.Items {
+		served.Insert(class.Spec.LoadBalancerClass)
+	}
+
+	return served, nil
+}
+
+// Allowed returns true if the services of the class are allowed to set the tunnel option.
+func Allowed(class *v1alpha1.TunnelClass, option string) bool {
+	if len(class.Spec.AllowedAnnotations) == 0 {
+		return true
+	}
+
+	for _, allowed := range class.Spec.AllowedAnnotations {
+		if allowed == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Option returns the value of the tunnel option for the service. The service annotation
+// takes precedence over the TunnelClass options when it is allowed by the class.
+func Option(svc *corev1.Service, class *v1alpha1.TunnelClass, option string) (string, bool) {
+	if v, ok := svc.Annotations[v1alpha1.TunnelAnnotation(option)]; ok && Allowed(class, option) {
+		return v, true
+	}
+
+	v, ok := class.Spec.Options[option]
+	return v, ok
+}
+
+// PortOption returns the value of the tunnel option for the service port. The annotation
+// of the named port takes precedence over the service annotation and the TunnelClass
+// options when it is allowed by the class.
+func PortOption(svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort, option string) (string, bool) {
+	if sp.Name != "" {
+		if v, ok := svc.Annotations[v1alpha1.PortTunnelAnnotation(sp.Name, option)]; ok && Allowed(class, option) {
+			return v, true
+		}
+	}
+
+	return Option(svc, class, option)
+}
+
+// Region returns the ngrok region the tunnels of the service are requested in.
+// It defaults to the region of the TunnelClass.
+func Region(svc *corev1.Service, class *v1alpha1.TunnelClass) string {
+	if region, ok := Option(svc, class, v1alpha1.RegionOption); ok {
+		return region
+	}
+
+	return class.Spec.Region
+}
+
+// AgentFor returns the name of the agent that runs the tunnels of the service.
+// It is connected to the region requested by the service, since the agent
+// session is region-bound.
+func AgentFor(agents *ngrok.Agents, svc *corev1.Service, class *v1alpha1.TunnelClass) (string, error) {
+	return agents.Select(class.Spec.Agent, Region(svc, class), client.ObjectKeyFromObject(svc).String())
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+func TestClassFor(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	eu := &v1alpha1.TunnelClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "eu-public"},
+		Spec: v1alpha1.TunnelClassSpec{
+			LoadBalancerClass: "k-ngrok.io/eu-public",
+			Agent:             "eu",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		class     *string
+		objs      []client.Object
+		wantAgent string
+		wantNil   bool
+		wantErr   bool
+	}{
+		{
+			name:    "No LoadBalancer class",
+			wantNil: true,
+		},
+		{
+			name:      "Default class",
+			class:     pointer.String("k-ngrok.io/default"),
+			wantAgent: "",
+		},
+		{
+			name:      "TunnelClass",
+			class:     pointer.String("k-ngrok.io/eu-public"),
+			objs:      []client.Object{eu},
+			wantAgent: "eu",
+		},
+		{
+			name:    "Unknown class",
+			class:   pointer.String("k-ngrok.io/us-private"),
+			objs:    []client.Object{eu},
+			wantNil: true,
+		},
+		{
+			name:  "Duplicated TunnelClass",
+			class: pointer.String("k-ngrok.io/eu-public"),
+			objs: []client.Object{eu, &v1alpha1.TunnelClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "eu-public-dup"},
+				Spec:       eu.Spec,
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.objs...).Build()
+			svc := &corev1.Service{Spec: corev1.ServiceSpec{LoadBalancerClass: tt.class}}
+			got, err := ClassFor(context.Background(), c, "k-ngrok.io/default", svc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ClassFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("ClassFor() = %v, wantNil %v", got, tt.wantNil)
+			}
+
+			if got != nil && got.Spec.Agent != tt.wantAgent {
+				t.Errorf("ClassFor() agent = %q, want %q", got.Spec.Agent, tt.wantAgent)
+			}
+		})
+	}
+}
+
+func TestOption(t *testing.T) {
+	class := &v1alpha1.TunnelClass{
+		Spec: v1alpha1.TunnelClassSpec{
+			Options:            map[string]string{"protocol": "http"},
+			AllowedAnnotations: []string{"protocol"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		option      string
+		want        string
+		wantOK      bool
+	}{
+		{
+			name:   "Class default",
+			option: "protocol",
+			want:   "http",
+			wantOK: true,
+		},
+		{
+			name:        "Service annotation overrides class default",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "tls"},
+			option:      "protocol",
+			want:        "tls",
+			wantOK:      true,
+		},
+		{
+			name:        "Not allowed annotation is ignored",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "eu"},
+			option:      "region",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got, ok := Option(svc, class, tt.option)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Option() = (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPortOption(t *testing.T) {
+	class := &v1alpha1.TunnelClass{
+		Spec: v1alpha1.TunnelClassSpec{
+			Options:            map[string]string{"protocol": "http"},
+			AllowedAnnotations: []string{"protocol", "remote-addr"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		port        corev1.ServicePort
+		option      string
+		want        string
+		wantOK      bool
+	}{
+		{
+			name:        "Service annotation",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "tls"},
+			port:        corev1.ServicePort{Name: "http"},
+			option:      "protocol",
+			want:        "tls",
+			wantOK:      true,
+		},
+		{
+			name: "Port annotation overrides service annotation",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":    "tls",
+				"db.tunnel.k-ngrok.io/protocol": "tcp",
+			},
+			port:   corev1.ServicePort{Name: "db"},
+			option: "protocol",
+			want:   "tcp",
+			wantOK: true,
+		},
+		{
+			name:        "Annotation of another port is ignored",
+			annotations: map[string]string{"db.tunnel.k-ngrok.io/protocol": "tcp"},
+			port:        corev1.ServicePort{Name: "http"},
+			option:      "protocol",
+			want:        "http",
+			wantOK:      true,
+		},
+		{
+			name:        "Not allowed port annotation is ignored",
+			annotations: map[string]string{"http.tunnel.k-ngrok.io/basic-auth": "basic-auth"},
+			port:        corev1.ServicePort{Name: "http"},
+			option:      "basic-auth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got, ok := PortOption(svc, class, tt.port, tt.option)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("PortOption() = (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
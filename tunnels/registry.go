@@ -0,0 +1,161 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+// RegistryVersion is the version of the registry format recorded by the controller.
+const RegistryVersion = "v1"
+
+// Registry is the record of the tunnels running for the service ports,
+// stored in the TunnelsAnnotation.
+type Registry struct {
+	// Version is the version of the registry format.
+	Version string `json:"version"`
+	// Tunnels are the running tunnels, in the order of the service ports.
+	Tunnels []RegistryEntry `json:"tunnels"`
+}
+
+// RegistryEntry records the tunnel running for a service port.
+type RegistryEntry struct {
+	// Name is the tunnel name.
+	Name string `json:"name"`
+	// Port is the service port the tunnel forwards to.
+	Port int32 `json:"port,omitempty"`
+	// Agent is the name of the agent that runs the tunnel.
+	Agent string `json:"agent,omitempty"`
+	// PublicURL is the public URL of the tunnel.
+	PublicURL string `json:"publicURL,omitempty"`
+	// Hash is the hash of the tunnel config the tunnel was started with.
+	Hash string `json:"hash,omitempty"`
+	// StartTime is the time the tunnel was started at, when it is known.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+}
+
+// NewRegistry returns an empty Registry of the current version.
+func NewRegistry() *Registry {
+	return &Registry{Version: RegistryVersion, Tunnels: []RegistryEntry{}}
+}
+
+// ParseRegistry parses the registry recorded in the service annotations. The JSON list
+// of tunnel names of the unversioned format is migrated, along with the config hashes
+// recorded in the TunnelHashesAnnotation, to entries whose agent is unknown.
+// It returns the entries it could recover, and an error when the recorded value is
+// corrupt or of an unknown version.
+func ParseRegistry(annotations map[string]string) (*Registry, error) {
+	r := NewRegistry()
+	value, ok := annotations[v1alpha1.TunnelsAnnotation]
+	if !ok {
+		return r, nil
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		return parseLegacyRegistry(value, annotations[v1alpha1.TunnelHashesAnnotation])
+	}
+
+	parsed := &Registry{}
+	if err := json.Unmarshal([]byte(value), parsed); err != nil {
+		return r, fmt.Errorf("invalid tunnel registry: %w", err)
+	}
+
+	if parsed.Version != RegistryVersion {
+		return r, fmt.Errorf("unsupported tunnel registry version %q", parsed.Version)
+	}
+
+	for _, entry := range parsed.Tunnels {
+		if entry.Name == "" {
+			return r, fmt.Errorf("invalid tunnel registry: tunnel without name")
+		}
+
+		r.Set(entry)
+	}
+
+	return r, nil
+}
+
+func parseLegacyRegistry(value, hashes string) (*Registry, error) {
+	r := NewRegistry()
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return r, fmt.Errorf("invalid tunnel registry: %w", err)
+	}
+
+	entryHashes := make(map[string]string)
+	var err error
+	if hashes != "" {
+		if jsonErr := json.Unmarshal([]byte(hashes), &entryHashes); jsonErr != nil {
+			// the tunnels are kept, they are not restarted on config change until they are started again.
+			err = fmt.Errorf("invalid tunnel hashes: %w", jsonErr)
+		}
+	}
+
+	for _, name := range names {
+		if name != "" {
+			r.Set(RegistryEntry{Name: name, Hash: entryHashes[name]})
+		}
+	}
+
+	return r, err
+}
+
+// Get returns the entry of the named tunnel.
+func (r *Registry) Get(name string) (RegistryEntry, bool) {
+	for _, entry := range r.Tunnels {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+
+	return RegistryEntry{}, false
+}
+
+// Set records the entry, replacing the entry of the same tunnel name.
+func (r *Registry) Set(entry RegistryEntry) {
+	for i := range r.Tunnels {
+		if r.Tunnels[i].Name == entry.Name {
+			r.Tunnels[i] = entry
+			return
+		}
+	}
+
+	r.Tunnels = append(r.Tunnels, entry)
+}
+
+// Names returns the names of the recorded tunnels.
+func (r *Registry) Names() sets.String {
+	names := sets.NewString()
+	for _, entry := range r.Tunnels {
+		names.Insert(entry.Name)
+	}
+
+	return names
+}
+
+// String returns the JSON encoding of the registry recorded in the TunnelsAnnotation.
+func (r *Registry) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+func TestParseRegistry(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []RegistryEntry
+		wantErr     bool
+	}{
+		{
+			name: "No registry",
+			want: []RegistryEntry{},
+		},
+		{
+			name: "Registry",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation: `{"version":"v1","tunnels":[{"name":"default-foo-http","port":80,"agent":"eu",` +
+					`"publicURL":"https://foo.eu.ngrok.io","hash":"abc"}]}`,
+			},
+			want: []RegistryEntry{{Name: "default-foo-http", Port: 80, Agent: "eu", PublicURL: "https://foo.eu.ngrok.io", Hash: "abc"}},
+		},
+		{
+			name: "Migrate unversioned registry",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation:      `["default-foo-http","default-foo-https"]` + "\n",
+				v1alpha1.TunnelHashesAnnotation: `{"default-foo-http":"abc"}`,
+			},
+			want: []RegistryEntry{{Name: "default-foo-http", Hash: "abc"}, {Name: "default-foo-https"}},
+		},
+		{
+			name: "Migrate unversioned registry with corrupt hashes",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation:      `["default-foo-http"]`,
+				v1alpha1.TunnelHashesAnnotation: `{"default-foo-http":`,
+			},
+			want:    []RegistryEntry{{Name: "default-foo-http"}},
+			wantErr: true,
+		},
+		{
+			name: "Corrupt registry",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation: `{"version":"v1","tunnels":[{"name":`,
+			},
+			want:    []RegistryEntry{},
+			wantErr: true,
+		},
+		{
+			name: "Unknown registry version",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation: `{"version":"v2","tunnels":[{"name":"default-foo-http"}]}`,
+			},
+			want:    []RegistryEntry{},
+			wantErr: true,
+		},
+		{
+			name: "Tunnel without name",
+			annotations: map[string]string{
+				v1alpha1.TunnelsAnnotation: `{"version":"v1","tunnels":[{"name":"default-foo-http"},{"port":80}]}`,
+			},
+			want:    []RegistryEntry{{Name: "default-foo-http"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRegistry(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRegistry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got.Version != RegistryVersion {
+				t.Errorf("ParseRegistry() version = %q, want %q", got.Version, RegistryVersion)
+			}
+
+			if !reflect.DeepEqual(got.Tunnels, tt.want) {
+				t.Errorf("ParseRegistry() tunnels = %+v, want %+v", got.Tunnels, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistry_String(t *testing.T) {
+	r := NewRegistry()
+	r.Set(RegistryEntry{Name: "default-foo", Port: 80, Agent: "default", Hash: "abc"})
+	r.Set(RegistryEntry{Name: "default-foo", Port: 80, Agent: "eu", Hash: "def"})
+
+	got, err := ParseRegistry(map[string]string{v1alpha1.TunnelsAnnotation: r.String()})
+	if err != nil {
+		t.Fatalf("ParseRegistry() unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("ParseRegistry() = %+v, want %+v", got, r)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+// Tunnel is the desired tunnel of a service port.
+type Tunnel struct {
+	// Name is the tunnel name.
+	Name string
+	// Config is the tunnel config, including the credentials.
+	Config ngrok.TunnelConfig
+	// Hash identifies the revision of the tunnel config. It is computed from
+	// the config without credentials and from the resourceVersion of the
+	// referenced Secrets, so it is safe to be recorded.
+	Hash string
+	// Certificate is the certificate the tls tunnel is terminated with by the agent.
+	// It must be written where the agent reads it from before the tunnel is started.
+	Certificate *Certificate
+}
+
+// Certificate is a PEM encoded certificate, and its private key.
+type Certificate struct {
+	Cert []byte
+	Key  []byte
+}
+
+// Resolver resolves the desired tunnels of the service ports.
+type Resolver struct {
+	Client client.Reader
+}
+
+// Resolve returns the desired tunnel of the service port.
+func (r *Resolver) Resolve(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort) (*Tunnel, error) {
+	config := Config(svc, class, sp)
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(config); err != nil {
+		return nil, err
+	}
+
+	if name, ok := PortOption(svc, class, sp, v1alpha1.BasicAuthOption); ok {
+		secret, err := r.secret(ctx, svc.Namespace, name, v1alpha1.BasicAuthOption)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Auth = string(secret.Data[corev1.BasicAuthUsernameKey]) + ":" + string(secret.Data[corev1.BasicAuthPasswordKey])
+		fmt.Fprintf(h, "%s/%s@%s\n", v1alpha1.BasicAuthOption, secret.Name, secret.ResourceVersion)
+	}
+
+	if name, ok := PortOption(svc, class, sp, v1alpha1.OAuthSecretOption); ok {
+		secret, err := r.secret(ctx, svc.Namespace, name, v1alpha1.OAuthSecretOption)
+		if err != nil {
+			return nil, err
+		}
+
+		clientID, clientSecret := string(secret.Data[v1alpha1.OAuthClientIDKey]), string(secret.Data[v1alpha1.OAuthClientSecretKey])
+		switch {
+		case config.OAuth != nil:
+			config.OAuth.ClientID, config.OAuth.ClientSecret = clientID, clientSecret
+		case config.OIDC != nil:
+			config.OIDC.ClientID, config.OIDC.ClientSecret = clientID, clientSecret
+		}
+
+		fmt.Fprintf(h, "%s/%s@%s\n", v1alpha1.OAuthSecretOption, secret.Name, secret.ResourceVersion)
+	}
+
+	var cert *Certificate
+	if name, ok := PortOption(svc, class, sp, v1alpha1.TLSSecretOption); ok {
+		secret, err := r.secret(ctx, svc.Namespace, name, v1alpha1.TLSSecretOption)
+		if err != nil {
+			return nil, err
+		}
+
+		// the renewed certificate changes the hash, so the tunnel is restarted with it.
+		cert = &Certificate{Cert: secret.Data[corev1.TLSCertKey], Key: secret.Data[corev1.TLSPrivateKeyKey]}
+		fmt.Fprintf(h, "%s/%s@%s\n", v1alpha1.TLSSecretOption, secret.Name, secret.ResourceVersion)
+	}
+
+	return &Tunnel{
+		Name:        Name(svc, sp),
+		Config:      config,
+		Hash:        hex.EncodeToString(h.Sum(nil))[:16],
+		Certificate: cert,
+	}, nil
+}
+
+// secret returns the Secret with given name referenced by the tunnel option.
+func (r *Resolver) secret(ctx context.Context, namespace, name, option string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, err
+	}
+
+	ref, _ := SecretReferenceOf(option)
+	if err := ref.Check(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// SecretReference describes the Secret a tunnel option references by name. The
+// Secret is always in the namespace of the service.
+type SecretReference struct {
+	// Option is the tunnel option name.
+	Option string
+	// Type is the type the Secret must be of. Any type is accepted when empty.
+	Type corev1.SecretType
+	// Keys are the keys the Secret must have.
+	Keys []string
+}
+
+// SecretReferences are the Secret references of the tunnel options.
+var SecretReferences = []SecretReference{
+	{
+		Option: v1alpha1.BasicAuthOption,
+		Type:   corev1.SecretTypeBasicAuth,
+		Keys:   []string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey},
+	},
+	{
+		Option: v1alpha1.OAuthSecretOption,
+		Keys:   []string{v1alpha1.OAuthClientIDKey, v1alpha1.OAuthClientSecretKey},
+	},
+	{
+		Option: v1alpha1.TLSSecretOption,
+		Type:   corev1.SecretTypeTLS,
+		Keys:   []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey},
+	},
+}
+
+// SecretReferenceOf returns the SecretReference of the tunnel option.
+func SecretReferenceOf(option string) (SecretReference, bool) {
+	for _, ref := range SecretReferences {
+		if ref.Option == option {
+			return ref, true
+		}
+	}
+
+	return SecretReference{Option: option}, false
+}
+
+// Check returns an error when the Secret is not of the expected type or misses an expected key.
+func (ref SecretReference) Check(secret *corev1.Secret) error {
+	if ref.Type != "" && secret.Type != ref.Type {
+		return fmt.Errorf("secret %q is of type %q, expected %q", secret.Name, secret.Type, ref.Type)
+	}
+
+	for _, key := range ref.Keys {
+		if len(secret.Data[key]) == 0 {
+			return fmt.Errorf("secret %q has no %q key", secret.Name, key)
+		}
+	}
+
+	return nil
+}
+
+// ReferencedSecrets returns the names of the Secrets referenced by the annotations
+// of the service and its ports, whether or not the options are allowed by the class.
+// The Secrets referenced by the TunnelClass options are not included.
+func ReferencedSecrets(svc *corev1.Service) []string {
+	names := sets.NewString()
+	for _, ref := range SecretReferences {
+		if name, ok := svc.Annotations[v1alpha1.TunnelAnnotation(ref.Option)]; ok && name != "" {
+			names.Insert(name)
+		}
+
+		for _, sp := range svc.Spec.Ports {
+			if sp.Name == "" {
+				continue
+			}
+
+			if name, ok := svc.Annotations[v1alpha1.PortTunnelAnnotation(sp.Name, ref.Option)]; ok && name != "" {
+				names.Insert(name)
+			}
+		}
+	}
+
+	return names.List()
+}
+
+// References returns true if the service, or one of its ports, references the Secret with given name.
+func References(svc *corev1.Service, class *v1alpha1.TunnelClass, secretName string) bool {
+	for _, ref := range SecretReferences {
+		if name, ok := Option(svc, class, ref.Option); ok && name == secretName {
+			return true
+		}
+
+		for _, sp := range svc.Spec.Ports {
+			if name, ok := PortOption(svc, class, sp, ref.Option); ok && name == secretName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "preview-auth", Namespace: "default"},
+		Type:       corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("user"),
+			corev1.BasicAuthPasswordKey: []byte("secret"),
+		},
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "preview",
+			Namespace:   "default",
+			Annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "preview-auth"},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 8080}},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret).Build()
+	resolver := &Resolver{Client: c}
+	class := DefaultClass("k-ngrok.io/default")
+
+	tunnel, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	if tunnel.Name != "default-preview" {
+		t.Errorf("Resolve() name = %q, want %q", tunnel.Name, "default-preview")
+	}
+
+	if tunnel.Config.Auth != "user:secret" || tunnel.Config.Proto != "http" || tunnel.Config.Addr != "10.0.0.1:8080" {
+		t.Errorf("Resolve() unexpected config: %+v", tunnel.Config)
+	}
+
+	secret.Data[corev1.BasicAuthPasswordKey] = []byte("rotated")
+	if err := c.Update(ctx, secret); err != nil {
+		t.Fatalf("Unexpected error updating secret: %v", err)
+	}
+
+	rotated, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	if rotated.Hash == tunnel.Hash {
+		t.Errorf("Resolve() hash is expected to change when the Secret is changed")
+	}
+
+	delete(svc.Annotations, v1alpha1.TunnelAnnotation(v1alpha1.BasicAuthOption))
+	if _, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0]); err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	svc.Annotations[v1alpha1.TunnelAnnotation(v1alpha1.BasicAuthOption)] = "missing"
+	if _, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0]); err == nil {
+		t.Errorf("Resolve() expected error for missing Secret")
+	}
+	delete(secret.Data, corev1.BasicAuthPasswordKey)
+	if err := c.Update(ctx, secret); err != nil {
+		t.Fatalf("Unexpected error updating secret: %v", err)
+	}
+
+	svc.Annotations[v1alpha1.TunnelAnnotation(v1alpha1.BasicAuthOption)] = secret.Name
+	if _, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0]); err == nil {
+		t.Errorf("Resolve() expected error for Secret without password")
+	}
+}
+
+func TestResolver_ResolveCertificate(t *testing.T) {
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "preview-tls", Namespace: "default"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte("cert"),
+			corev1.TLSPrivateKeyKey: []byte("key"),
+		},
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "preview",
+			Namespace:   "default",
+			Annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "tls", "tunnel.k-ngrok.io/tls-secret": "preview-tls"},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 8443}},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret).Build()
+	resolver := &Resolver{Client: c}
+	class := DefaultClass("k-ngrok.io/default")
+
+	tunnel, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	if want := (&Certificate{Cert: []byte("cert"), Key: []byte("key")}); !reflect.DeepEqual(tunnel.Certificate, want) {
+		t.Errorf("Resolve() certificate = %+v, want %+v", tunnel.Certificate, want)
+	}
+
+	// the certificate renewed by cert-manager restarts the tunnel.
+	secret.Data[corev1.TLSCertKey] = []byte("renewed")
+	if err := c.Update(ctx, secret); err != nil {
+		t.Fatalf("Unexpected error updating secret: %v", err)
+	}
+
+	renewed, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	if renewed.Hash == tunnel.Hash {
+		t.Errorf("Resolve() hash is expected to change when the certificate is renewed")
+	}
+
+	delete(secret.Data, corev1.TLSPrivateKeyKey)
+	if err := c.Update(ctx, secret); err != nil {
+		t.Fatalf("Unexpected error updating secret: %v", err)
+	}
+
+	if _, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0]); err == nil {
+		t.Errorf("Resolve() expected error for Secret without private key")
+	}
+
+	delete(svc.Annotations, v1alpha1.TunnelAnnotation(v1alpha1.TLSSecretOption))
+	passthrough, err := resolver.Resolve(ctx, svc, class, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+
+	if passthrough.Certificate != nil {
+		t.Errorf("Resolve() certificate = %+v, want nil for a pass-through tunnel", passthrough.Certificate)
+	}
+}
+
+func TestReferencedSecrets(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "preview",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tunnel.k-ngrok.io/basic-auth":         "preview-auth",
+				"web.tunnel.k-ngrok.io/oauth-secret":   "preview-oauth",
+				"admin.tunnel.k-ngrok.io/basic-auth":   "preview-auth",
+				"grpc.tunnel.k-ngrok.io/tls-secret":    "unknown-port",
+				"tunnel.k-ngrok.io/subdomain":          "preview",
+				"metrics.tunnel.k-ngrok.io/protocol":   "http",
+				"metrics.tunnel.k-ngrok.io/tls-secret": "",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "web", Port: 80}, {Name: "admin", Port: 8080}, {Name: "metrics", Port: 9090}},
+		},
+	}
+
+	want := []string{"preview-auth", "preview-oauth"}
+	if got := ReferencedSecrets(svc); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReferencedSecrets() = %v, want %v", got, want)
+	}
+}
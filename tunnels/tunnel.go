@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+// Name returns the tunnel name of the service port.
+func Name(svc *corev1.Service, sp corev1.ServicePort) string {
+	tunnelName := strings.ReplaceAll(client.ObjectKeyFromObject(svc).String(), "/", "-")
+	if len(svc.Spec.Ports) > 1 || sp.Name != "" {
+		// add port name in the end of tunnelName when it's defined or
+		// more than one ports is defined.
+		tunnelName = tunnelName + "-" + sp.Name
+	}
+
+	return tunnelName
+}
+
+// Protocol returns the tunnel protocol of the service port. It defaults to the
+// protocol of the TunnelClass, then to the service port protocol.
+func Protocol(svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort) string {
+	if proto, ok := PortOption(svc, class, sp, v1alpha1.ProtocolOption); ok {
+		return strings.ToLower(proto)
+	}
+
+	if class.Spec.Protocol != "" {
+		return class.Spec.Protocol
+	}
+
+	return strings.ToLower(string(sp.Protocol))
+}
+
+// List returns the values of the comma-separated list tunnel option for the service port.
+func List(svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort, option string) []string {
+	v, ok := PortOption(svc, class, sp, option)
+	if !ok {
+		return nil
+	}
+
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Config returns the tunnel config of the service port, from the options of the
+// port overriding the options of the service. The config does not
+// include the credentials from the Secrets referenced by the service,
+// they are populated by the Resolver.
+func Config(svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort) ngrok.TunnelConfig {
+	config := ngrok.TunnelConfig{
+		Addr:  net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(sp.Port))),
+		Proto: Protocol(svc, class, sp),
+	}
+
+	if remoteAddr, ok := PortOption(svc, class, sp, v1alpha1.RemoteAddrOption); ok {
+		config.RemoteAddr = remoteAddr
+	}
+
+	if hostname, ok := PortOption(svc, class, sp, v1alpha1.HostnameOption); ok {
+		config.Hostname = strings.ToLower(hostname)
+	}
+
+	if provider, ok := PortOption(svc, class, sp, v1alpha1.OAuthProviderOption); ok {
+		allowEmails := List(svc, class, sp, v1alpha1.OAuthAllowEmailsOption)
+		allowDomains := List(svc, class, sp, v1alpha1.OAuthAllowDomainsOption)
+		scopes := List(svc, class, sp, v1alpha1.OAuthScopesOption)
+		if provider == v1alpha1.OIDCProvider {
+			issuerURL, _ := PortOption(svc, class, sp, v1alpha1.OIDCIssuerURLOption)
+			config.OIDC = &ngrok.OIDC{
+				IssuerURL:    issuerURL,
+				AllowEmails:  allowEmails,
+				AllowDomains: allowDomains,
+				Scopes:       scopes,
+			}
+		} else {
+			config.OAuth = &ngrok.OAuth{
+				Provider:     provider,
+				AllowEmails:  allowEmails,
+				AllowDomains: allowDomains,
+				Scopes:       scopes,
+			}
+		}
+	}
+
+	allow, deny := SourceRanges(svc), List(svc, class, sp, v1alpha1.DenySourceRangesOption)
+	if len(allow) > 0 || len(deny) > 0 {
+		config.IPRestriction = &ngrok.IPRestriction{
+			AllowCIDRs: allow,
+			DenyCIDRs:  deny,
+		}
+	}
+
+	return config
+}
+
+// SourceRanges returns the CIDRs allowed to connect to the service LoadBalancer
+// from spec.loadBalancerSourceRanges, or from the legacy source ranges annotation.
+func SourceRanges(svc *corev1.Service) []string {
+	ranges := svc.Spec.LoadBalancerSourceRanges
+	if len(ranges) == 0 {
+		if v, ok := svc.Annotations[corev1.AnnotationLoadBalancerSourceRangesKey]; ok {
+			ranges = strings.Split(v, ",")
+		}
+	}
+
+	var list []string
+	for _, cidr := range ranges {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			list = append(list, cidr)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnels
+
+import (
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// URLsConfigMapName returns the name of the ConfigMap the public URLs of the
+// tunnels of the service are published in.
+func URLsConfigMapName(svc *corev1.Service) string {
+	return svc.Name + "-tunnel-urls"
+}
+
+// URLKey returns the ConfigMap key of the public URL of the tunnel of the service
+// port, which is the port name, or the port number when the port is not named.
+func URLKey(sp corev1.ServicePort) string {
+	if sp.Name != "" {
+		return sp.Name
+	}
+
+	return strconv.Itoa(int(sp.Port))
+}
+
+// URLEnvName returns the name of the environment variable the public URL of the tunnel
+// of the service port is injected as, e.g. HELLO_APP_HTTP_TUNNEL_URL.
+func URLEnvName(svc *corev1.Service, sp corev1.ServicePort) string {
+	name := strings.ToUpper(svc.Name + "_" + URLKey(sp) + "_TUNNEL_URL")
+	return strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
@@ -18,15 +18,68 @@ package patch
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 )
 
+// ApplyConfigurationFunc returns the apply configuration of the object and the apply
+// configuration of its status, that only contain the fields owned by the field manager.
+type ApplyConfigurationFunc func(obj client.Object) (applyConfig, statusApplyConfig client.Object, err error)
+
+// Option configures the Patcher.
+type Option func(*Patcher)
+
+// WithServerSideApply configures the Patcher to server-side apply the apply configurations
+// returned by the given func, instead of patching the changes with JSON merge patches
+// that may overwrite the fields owned by other managers. The client.FieldOwner patch
+// option is required, and client.ForceOwnership takes the ownership of the conflicting fields.
+// The finalizers and the annotations removed from the object are removed with a JSON patch
+// beforehand, since leaving them out of the apply configuration does not remove them
+// when they were set by an update, e.g. with a JSON merge patch before switching modes.
+func WithServerSideApply(applyConfig ApplyConfigurationFunc) Option {
+	return func(p *Patcher) {
+		p.applyConfig = applyConfig
+	}
+}
+
+// WithOptimisticLock configures the Patcher to send the resourceVersion of the object
+// with the patches, so they fail with a conflict when the object was modified since it
+// was read. The Patcher then refetches the object, reapplies the changes on top of it
+// and patches it again. The finalizers are added and removed one by one, so the ones
+// added concurrently are kept. The conflict is returned when another list the changes
+// replace was modified concurrently, since reapplying them would overwrite it.
+func WithOptimisticLock() Option {
+	return func(p *Patcher) {
+		p.optimisticLock = true
+	}
+}
+
+// WithOwnedConditions configures the Patcher to only patch the given condition types
+// of the status conditions, instead of replacing the whole list, so the conditions
+// set by the other controllers are kept. The status is patched with the optimistic lock,
+// so the conditions set concurrently are not overwritten.
+func WithOwnedConditions(conditionTypes ...string) Option {
+	return func(p *Patcher) {
+		p.ownedConditions = sets.NewString(conditionTypes...)
+	}
+}
+
 type Patcher struct {
 	client          client.Client
 	before          map[string]interface{}
@@ -34,9 +87,12 @@ type Patcher struct {
 	beforeHasStatus bool
 	patch           client.Patch
 	statusPatch     client.Patch
+	applyConfig     ApplyConfigurationFunc
+	optimisticLock  bool
+	ownedConditions sets.String
 }
 
-func NewPatcher(c client.Client, obj client.Object) (*Patcher, error) {
+func NewPatcher(c client.Client, obj client.Object, opts ...Option) (*Patcher, error) {
 	// If the object is already unstructured, we need to perform a deepcopy first
 	// because the `DefaultUnstructuredConverter.ToUnstructured` function returns
 	// the underlying unstructured object map without making a copy.
@@ -63,14 +119,20 @@ func NewPatcher(c client.Client, obj client.Object) (*Patcher, error) {
 		unstructured.RemoveNestedField(before, "status")
 	}
 
-	return &Patcher{
+	p := &Patcher{
 		client:          c,
 		before:          before,
 		beforeStatus:    beforeStatus,
 		beforeHasStatus: beforeHasStatus,
 		patch:           client.MergeFrom(obj.DeepCopyObject().(client.Object)),
 		statusPatch:     client.MergeFrom(obj.DeepCopyObject().(client.Object)),
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p, nil
 }
 
 func (p *Patcher) Patch(ctx context.Context, obj client.Object, opts ...client.PatchOption) error {
@@ -99,6 +161,16 @@ func (p *Patcher) Patch(ctx context.Context, obj client.Object, opts ...client.P
 		unstructured.RemoveNestedField(after, "status")
 	}
 
+	if p.applyConfig != nil {
+		return p.apply(ctx, obj, !reflect.DeepEqual(p.before, after),
+			(p.beforeHasStatus || afterHasStatus) && !reflect.DeepEqual(p.beforeStatus, afterStatus), opts...)
+	}
+
+	if p.optimisticLock || p.ownedConditions.Len() > 0 {
+		return p.merge(ctx, obj, !reflect.DeepEqual(p.before, after),
+			(p.beforeHasStatus || afterHasStatus) && !reflect.DeepEqual(p.beforeStatus, afterStatus), opts...)
+	}
+
 	var errs []error
 	if !reflect.DeepEqual(p.before, after) {
 		// Only issue a Patch if the before and after resources (minus status) differ
@@ -117,3 +189,406 @@ func (p *Patcher) Patch(ctx context.Context, obj client.Object, opts ...client.P
 
 	return kerrors.NewAggregate(errs)
 }
+
+// apply server-side applies the apply configurations of the object and of its status when they have changed.
+func (p *Patcher) apply(ctx context.Context, obj client.Object, changed, statusChanged bool, opts ...client.PatchOption) error {
+	if !changed && !statusChanged {
+		return nil
+	}
+
+	applyConfig, statusApplyConfig, err := p.applyConfig(obj)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		if err := p.removeMetadata(ctx, obj); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	if changed && applyConfig != nil {
+		if err := p.client.Patch(ctx, applyConfig, client.Apply, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if statusChanged && statusApplyConfig != nil {
+		if err := p.client.Status().Patch(ctx, statusApplyConfig, client.Apply, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
+
+// removeMetadata removes the finalizers and the annotations removed from the object with
+// a JSON patch. Each removal is preceded by a test of the removed value, so the patch fails
+// instead of removing another entry when the object was modified since it was read.
+func (p *Patcher) removeMetadata(ctx context.Context, obj client.Object) error {
+	var ops []jsonPatchOp
+	finalizers, _, err := unstructured.NestedStringSlice(p.before, "metadata", "finalizers")
+	if err != nil {
+		return err
+	}
+
+	keep := sets.NewString(obj.GetFinalizers()...)
+	// the finalizers are removed from the last one, so the indices of the others are kept.
+	for i := len(finalizers) - 1; i >= 0; i-- {
+		if keep.Has(finalizers[i]) {
+			continue
+		}
+
+		path := fmt.Sprintf("/metadata/finalizers/%d", i)
+		ops = append(ops, jsonPatchOp{Op: "test", Path: path, Value: &finalizers[i]}, jsonPatchOp{Op: "remove", Path: path})
+	}
+
+	annotations, _, err := unstructured.NestedStringMap(p.before, "metadata", "annotations")
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if _, ok := obj.GetAnnotations()[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := annotations[key]
+		path := "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+		ops = append(ops, jsonPatchOp{Op: "test", Path: path, Value: &value}, jsonPatchOp{Op: "remove", Path: path})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	// the object is patched as a copy, so the changes made to it are kept.
+	return p.client.Patch(ctx, obj.DeepCopyObject().(client.Object), client.RawPatch(types.JSONPatchType, data))
+}
+
+// jsonPatchOp is a JSON patch operation.
+type jsonPatchOp struct {
+	Op    string  `json:"op"`
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
+// merge patches the changes made to the object, and to its status, on top of the object
+// that was read. When the object was modified since, the changes are reapplied on top
+// of the latest object.
+func (p *Patcher) merge(ctx context.Context, obj client.Object, changed, statusChanged bool, opts ...client.PatchOption) error {
+	if !changed && !statusChanged {
+		return nil
+	}
+
+	gvk, err := apiutil.GVKForObject(obj, p.client.Scheme())
+	if err != nil {
+		return err
+	}
+
+	after, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+
+	before := runtime.DeepCopyJSON(p.before)
+	if p.beforeHasStatus {
+		before["status"] = runtime.DeepCopyJSONValue(p.beforeStatus)
+	}
+
+	changes, err := p.changes(before, after)
+	if err != nil {
+		return err
+	}
+
+	finalizers, err := finalizerChanges(before, after)
+	if err != nil {
+		return err
+	}
+
+	conditions, err := p.conditions(after)
+	if err != nil {
+		return err
+	}
+
+	base := &unstructured.Unstructured{Object: before}
+	base.SetGroupVersionKind(gvk)
+
+	var errs []error
+	if changed {
+		if base, err = p.patchWithRetry(ctx, base, changes, conditions, finalizers, false, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if statusChanged {
+		if _, err := p.patchWithRetry(ctx, base, changes, conditions, finalizers, true, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
+
+// patchWithRetry patches the changes and the owned conditions on top of the base object.
+// On a conflict, the latest object is refetched and the patch is retried on top of it,
+// unless a list replaced by the changes was modified since the object was read.
+// It returns the patched object, or the latest base object on failure.
+func (p *Patcher) patchWithRetry(ctx context.Context, base *unstructured.Unstructured, changes []byte, conditions []interface{}, finalizers finalizerEdits, status bool, opts ...client.PatchOption) (*unstructured.Unstructured, error) {
+	var stale bool
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) && !stale
+	}, func() error {
+		desired, err := p.reapply(base, changes, conditions, finalizers)
+		if err != nil {
+			return err
+		}
+
+		patch := client.MergeFrom(base)
+		// the status is always patched with the optimistic lock when the conditions are
+		// owned, since the conditions list is replaced as a whole by the merge patch.
+		if p.optimisticLock || (status && p.ownedConditions.Len() > 0) {
+			patch = client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})
+		}
+
+		if status {
+			err = p.client.Status().Patch(ctx, desired, patch, opts...)
+		} else {
+			err = p.client.Patch(ctx, desired, patch, opts...)
+		}
+
+		if err == nil {
+			base = desired
+			return nil
+		}
+
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		latest := &unstructured.Unstructured{}
+		latest.SetGroupVersionKind(base.GroupVersionKind())
+		if err := p.client.Get(ctx, client.ObjectKeyFromObject(base), latest); err != nil {
+			return err
+		}
+
+		base = latest
+		modified, listErr := p.listsModified(latest.Object, changes)
+		if listErr != nil {
+			return listErr
+		}
+
+		stale = modified
+		return err
+	})
+
+	return base, err
+}
+
+// listsModified returns true when a list replaced by the changes differs in the latest
+// object from the object that was read. The changes can't be reapplied on top of it
+// without overwriting the concurrent modification.
+func (p *Patcher) listsModified(latest map[string]interface{}, changes []byte) (bool, error) {
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(changes, &patch); err != nil {
+		return false, err
+	}
+
+	before := runtime.DeepCopyJSON(p.before)
+	if p.beforeHasStatus {
+		before["status"] = runtime.DeepCopyJSONValue(p.beforeStatus)
+	}
+
+	return listsModified(before, latest, patch), nil
+}
+
+func listsModified(before, latest, patch map[string]interface{}) bool {
+	for key, value := range patch {
+		switch v := value.(type) {
+		case []interface{}:
+			if !equality.Semantic.DeepEqual(before[key], latest[key]) {
+				return true
+			}
+		case map[string]interface{}:
+			b, _ := before[key].(map[string]interface{})
+			l, _ := latest[key].(map[string]interface{})
+			if listsModified(b, l, v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// finalizerEdits are the finalizers added to and removed from the object.
+type finalizerEdits struct {
+	added   []string
+	removed sets.String
+}
+
+// finalizerChanges returns the finalizers added to and removed from the object.
+func finalizerChanges(before, after map[string]interface{}) (finalizerEdits, error) {
+	beforeFinalizers, _, err := unstructured.NestedStringSlice(before, "metadata", "finalizers")
+	if err != nil {
+		return finalizerEdits{}, err
+	}
+
+	afterFinalizers, _, err := unstructured.NestedStringSlice(after, "metadata", "finalizers")
+	if err != nil {
+		return finalizerEdits{}, err
+	}
+
+	edits := finalizerEdits{removed: sets.NewString(beforeFinalizers...).Delete(afterFinalizers...)}
+	existing := sets.NewString(beforeFinalizers...)
+	for _, finalizer := range afterFinalizers {
+		if !existing.Has(finalizer) {
+			edits.added = append(edits.added, finalizer)
+		}
+	}
+
+	return edits, nil
+}
+
+// changes returns the JSON merge patch of the changes made to the object.
+// The finalizers are left out, since they are added and removed one by one, and
+// the owned conditions are left out, since they are merged by type.
+func (p *Patcher) changes(before, after map[string]interface{}) ([]byte, error) {
+	before, after = runtime.DeepCopyJSON(before), runtime.DeepCopyJSON(after)
+	unstructured.RemoveNestedField(before, "metadata", "finalizers")
+	unstructured.RemoveNestedField(after, "metadata", "finalizers")
+	if p.ownedConditions.Len() > 0 {
+		unstructured.RemoveNestedField(before, "status", "conditions")
+		unstructured.RemoveNestedField(after, "status", "conditions")
+	}
+
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return nil, err
+	}
+
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonpatch.CreateMergePatch(beforeJSON, afterJSON)
+}
+
+// conditions returns the owned conditions of the object.
+func (p *Patcher) conditions(obj map[string]interface{}) ([]interface{}, error) {
+	conditions, _, err := unstructured.NestedSlice(obj, "status", "conditions")
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []interface{}
+	for _, condition := range conditions {
+		if p.ownedConditions.Has(conditionType(condition)) {
+			owned = append(owned, condition)
+		}
+	}
+
+	return owned, nil
+}
+
+// reapply returns the base object with the changes, the finalizers and the owned conditions
+// applied. The finalizers are added and removed one by one. The owned conditions replace the
+// conditions of the same type in place, the owned conditions types that are missing are
+// removed, and the other conditions are kept.
+func (p *Patcher) reapply(base *unstructured.Unstructured, changes []byte, conditions []interface{}, finalizers finalizerEdits) (*unstructured.Unstructured, error) {
+	baseJSON, err := base.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	desiredJSON, err := jsonpatch.MergePatch(baseJSON, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &unstructured.Unstructured{}
+	if err := desired.UnmarshalJSON(desiredJSON); err != nil {
+		return nil, err
+	}
+
+	var desiredFinalizers []string
+	for _, finalizer := range desired.GetFinalizers() {
+		if !finalizers.removed.Has(finalizer) {
+			desiredFinalizers = append(desiredFinalizers, finalizer)
+		}
+	}
+
+	for _, finalizer := range finalizers.added {
+		if !sets.NewString(desiredFinalizers...).Has(finalizer) {
+			desiredFinalizers = append(desiredFinalizers, finalizer)
+		}
+	}
+
+	desired.SetFinalizers(desiredFinalizers)
+
+	if p.ownedConditions.Len() == 0 {
+		return desired, nil
+	}
+
+	current, _, err := unstructured.NestedSlice(desired.Object, "status", "conditions")
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[string]interface{}, len(conditions))
+	for _, condition := range conditions {
+		owned[conditionType(condition)] = condition
+	}
+
+	var merged []interface{}
+	for _, condition := range current {
+		t := conditionType(condition)
+		if !p.ownedConditions.Has(t) {
+			merged = append(merged, condition)
+			continue
+		}
+
+		if c, ok := owned[t]; ok {
+			merged = append(merged, c)
+			delete(owned, t)
+		}
+	}
+
+	for _, condition := range conditions {
+		if _, ok := owned[conditionType(condition)]; ok {
+			merged = append(merged, condition)
+		}
+	}
+
+	if len(merged) == 0 {
+		unstructured.RemoveNestedField(desired.Object, "status", "conditions")
+		return desired, nil
+	}
+
+	if err := unstructured.SetNestedSlice(desired.Object, merged, "status", "conditions"); err != nil {
+		return nil, err
+	}
+
+	return desired, nil
+}
+
+func conditionType(condition interface{}) string {
+	c, ok := condition.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	t, _ := c["type"].(string)
+	return t
+}
@@ -22,7 +22,10 @@ import (
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -99,3 +102,368 @@ func TestPatcher_Patch(t *testing.T) {
 		})
 	}
 }
+
+// applyRecorder records the patches instead of sending them, since the fake
+// client does not support server-side apply.
+type applyRecorder struct {
+	client.Client
+	patches []string
+}
+
+func (r *applyRecorder) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == types.JSONPatchType {
+		// the removals are sent to the client.
+		return r.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	r.record("object", patch, opts...)
+	return nil
+}
+
+func (r *applyRecorder) Status() client.StatusWriter {
+	return &statusApplyRecorder{StatusWriter: r.Client.Status(), recorder: r}
+}
+
+func (r *applyRecorder) record(subresource string, patch client.Patch, opts ...client.PatchOption) {
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	if patch.Type() != types.ApplyPatchType || patchOpts.FieldManager == "" || patchOpts.Force == nil || !*patchOpts.Force {
+		subresource += " not applied"
+	}
+
+	r.patches = append(r.patches, subresource)
+}
+
+type statusApplyRecorder struct {
+	client.StatusWriter
+	recorder *applyRecorder
+}
+
+func (r *statusApplyRecorder) Patch(_ context.Context, _ client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	r.recorder.record("status", patch, opts...)
+	return nil
+}
+
+func TestPatcher_ServerSideApply(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(pod *corev1.Pod)
+		want   []string
+	}{
+		{
+			name:   "No changes",
+			mutate: func(pod *corev1.Pod) {},
+		},
+		{
+			name: "Apply annotation",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"foo": "bar"}
+			},
+			want: []string{"object"},
+		},
+		{
+			name: "Apply status",
+			mutate: func(pod *corev1.Pod) {
+				pod.Status.Phase = corev1.PodRunning
+			},
+			want: []string{"status"},
+		},
+		{
+			name: "Apply annotation and status",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"foo": "bar"}
+				pod.Status.Phase = corev1.PodRunning
+			},
+			want: []string{"object", "status"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := pod.DeepCopy()
+			recorder := &applyRecorder{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()}
+			patcher, err := NewPatcher(recorder, before, WithServerSideApply(func(obj client.Object) (client.Object, client.Object, error) {
+				return obj, obj, nil
+			}))
+			if err != nil {
+				t.Fatalf("Expected no error initializing patcher: %v", err)
+			}
+
+			after := before.DeepCopy()
+			tt.mutate(after)
+			if err := patcher.Patch(context.Background(), after, client.FieldOwner("test"), client.ForceOwnership); err != nil {
+				t.Errorf("Patcher.Patch() unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(recorder.patches, tt.want) {
+				t.Errorf("Patcher.Patch() patches = %v, want %v", recorder.patches, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatcher_PatchConflict(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            []Option
+		finalizers      []string
+		conditions      []corev1.PodCondition
+		mutate          func(pod *corev1.Pod)
+		concurrent      func(pod *corev1.Pod)
+		wantAnnotations map[string]string
+		wantFinalizers  []string
+		wantConditions  []corev1.PodCondition
+		wantErr         bool
+	}{
+		{
+			name: "Reapply changes on conflict",
+			opts: []Option{WithOptimisticLock()},
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"foo": "bar"}
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"baz": "qux"}
+			},
+			wantAnnotations: map[string]string{"foo": "bar", "baz": "qux"},
+		},
+		{
+			name: "Reapply changes and status on conflict",
+			opts: []Option{WithOptimisticLock(), WithOwnedConditions("Ready")},
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"foo": "bar"}
+				pod.Status.Conditions = []corev1.PodCondition{{Type: "Ready", Status: corev1.ConditionTrue}}
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Status.Conditions = []corev1.PodCondition{{Type: "Scheduled", Status: corev1.ConditionTrue}}
+			},
+			wantAnnotations: map[string]string{"foo": "bar"},
+			wantConditions: []corev1.PodCondition{
+				{Type: "Scheduled", Status: corev1.ConditionTrue},
+				{Type: "Ready", Status: corev1.ConditionTrue},
+			},
+		},
+		{
+			name: "Keep finalizer added concurrently",
+			opts: []Option{WithOptimisticLock()},
+			mutate: func(pod *corev1.Pod) {
+				pod.Finalizers = append(pod.Finalizers, "test.io/finalizer")
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Finalizers = append(pod.Finalizers, "other.io/finalizer")
+			},
+			wantFinalizers: []string{"other.io/finalizer", "test.io/finalizer"},
+		},
+		{
+			name:       "Remove finalizer and keep finalizer added concurrently",
+			opts:       []Option{WithOptimisticLock()},
+			finalizers: []string{"test.io/finalizer"},
+			mutate: func(pod *corev1.Pod) {
+				pod.Finalizers = nil
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Finalizers = append(pod.Finalizers, "other.io/finalizer")
+			},
+			wantFinalizers: []string{"other.io/finalizer"},
+		},
+		{
+			name: "Return conflict when replaced list is modified concurrently",
+			opts: []Option{WithOptimisticLock()},
+			mutate: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = []corev1.Toleration{{Key: "foo", Operator: corev1.TolerationOpExists}}
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = []corev1.Toleration{{Key: "bar", Operator: corev1.TolerationOpExists}}
+			},
+			wantErr: true,
+		},
+		{
+			name:       "Update owned condition in place",
+			opts:       []Option{WithOptimisticLock(), WithOwnedConditions("Ready")},
+			conditions: []corev1.PodCondition{{Type: "Ready", Status: corev1.ConditionFalse}, {Type: "Scheduled", Status: corev1.ConditionFalse}},
+			mutate: func(pod *corev1.Pod) {
+				pod.Status.Conditions[0].Status = corev1.ConditionTrue
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Status.Conditions[1].Status = corev1.ConditionTrue
+			},
+			wantConditions: []corev1.PodCondition{
+				{Type: "Ready", Status: corev1.ConditionTrue},
+				{Type: "Scheduled", Status: corev1.ConditionTrue},
+			},
+		},
+		{
+			name:       "Remove owned condition",
+			opts:       []Option{WithOwnedConditions("Ready")},
+			conditions: []corev1.PodCondition{{Type: "Ready", Status: corev1.ConditionTrue}},
+			mutate: func(pod *corev1.Pod) {
+				pod.Status.Conditions = nil
+			},
+			concurrent: func(pod *corev1.Pod) {
+				pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{Type: "Scheduled", Status: corev1.ConditionTrue})
+			},
+			wantConditions: []corev1.PodCondition{{Type: "Scheduled", Status: corev1.ConditionTrue}},
+		},
+		{
+			name:       "Ignore changes of not owned conditions",
+			opts:       []Option{WithOptimisticLock(), WithOwnedConditions("Ready")},
+			conditions: []corev1.PodCondition{{Type: "Ready", Status: corev1.ConditionFalse}, {Type: "Scheduled", Status: corev1.ConditionTrue}},
+			mutate: func(pod *corev1.Pod) {
+				pod.Status.Conditions = []corev1.PodCondition{{Type: "Ready", Status: corev1.ConditionTrue}}
+			},
+			wantConditions: []corev1.PodCondition{
+				{Type: "Ready", Status: corev1.ConditionTrue},
+				{Type: "Scheduled", Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "test-pod",
+					Namespace:  "test-namespace",
+					Finalizers: tt.finalizers,
+				},
+				Status: corev1.PodStatus{
+					Conditions: tt.conditions,
+				},
+			}
+
+			fclient := fake.NewClientBuilder().WithObjects(pod).WithScheme(clientgoscheme.Scheme).Build()
+			before := &corev1.Pod{}
+			if err := fclient.Get(ctx, client.ObjectKeyFromObject(pod), before); err != nil {
+				t.Fatalf("Unexpected error getting object: %v", err)
+			}
+
+			patcher, err := NewPatcher(fclient, before, tt.opts...)
+			if err != nil {
+				t.Fatalf("Expected no error initializing patcher: %v", err)
+			}
+
+			if tt.concurrent != nil {
+				other := before.DeepCopy()
+				tt.concurrent(other)
+				if err := fclient.Update(ctx, other); err != nil {
+					t.Fatalf("Unexpected error updating object concurrently: %v", err)
+				}
+			}
+
+			after := before.DeepCopy()
+			tt.mutate(after)
+			err = patcher.Patch(ctx, after)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Patcher.Patch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if agg, ok := err.(kerrors.Aggregate); !ok || !apierrors.IsConflict(kerrors.Reduce(agg)) {
+					t.Errorf("Patcher.Patch() error = %v, want a conflict", err)
+				}
+				return
+			}
+
+			patched := &corev1.Pod{}
+			if err := fclient.Get(ctx, client.ObjectKeyFromObject(pod), patched); err != nil {
+				t.Fatalf("Unexpected error getting patched object: %v", err)
+			}
+
+			if !reflect.DeepEqual(patched.Annotations, tt.wantAnnotations) {
+				t.Errorf("Patcher.Patch() annotations = %v, want %v", patched.Annotations, tt.wantAnnotations)
+			}
+
+			if !reflect.DeepEqual(patched.Finalizers, tt.wantFinalizers) {
+				t.Errorf("Patcher.Patch() finalizers = %v, want %v", patched.Finalizers, tt.wantFinalizers)
+			}
+
+			if !reflect.DeepEqual(patched.Status.Conditions, tt.wantConditions) {
+				t.Errorf("Patcher.Patch() conditions = %v, want %v", patched.Status.Conditions, tt.wantConditions)
+			}
+		})
+	}
+}
+
+func TestPatcher_ServerSideApplyRemovals(t *testing.T) {
+	ctx := context.Background()
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "test-namespace",
+		},
+	}
+
+	fclient := fake.NewClientBuilder().WithObjects(svc).WithScheme(clientgoscheme.Scheme).Build()
+	before := &corev1.Service{}
+	if err := fclient.Get(ctx, client.ObjectKeyFromObject(svc), before); err != nil {
+		t.Fatalf("Unexpected error getting object: %v", err)
+	}
+
+	// the finalizer and the annotation are set with a merge patch first.
+	patcher, err := NewPatcher(fclient, before, WithOptimisticLock())
+	if err != nil {
+		t.Fatalf("Expected no error initializing patcher: %v", err)
+	}
+
+	after := before.DeepCopy()
+	after.Finalizers = []string{"test.io/finalizer"}
+	after.Annotations = map[string]string{"test.io/annotation": "foo"}
+	if err := patcher.Patch(ctx, after); err != nil {
+		t.Fatalf("Patcher.Patch() unexpected error: %v", err)
+	}
+
+	// another manager adds its own finalizer and annotation.
+	other := &corev1.Service{}
+	if err := fclient.Get(ctx, client.ObjectKeyFromObject(svc), other); err != nil {
+		t.Fatalf("Unexpected error getting object: %v", err)
+	}
+
+	other.Finalizers = append(other.Finalizers, "other.io/finalizer")
+	other.Annotations["other.io/annotation"] = "bar"
+	if err := fclient.Update(ctx, other); err != nil {
+		t.Fatalf("Unexpected error updating object: %v", err)
+	}
+
+	// then they are removed in server-side apply mode.
+	before = &corev1.Service{}
+	if err := fclient.Get(ctx, client.ObjectKeyFromObject(svc), before); err != nil {
+		t.Fatalf("Unexpected error getting object: %v", err)
+	}
+
+	recorder := &applyRecorder{Client: fclient}
+	patcher, err = NewPatcher(recorder, before, WithServerSideApply(func(obj client.Object) (client.Object, client.Object, error) {
+		return obj, nil, nil
+	}))
+	if err != nil {
+		t.Fatalf("Expected no error initializing patcher: %v", err)
+	}
+
+	after = before.DeepCopy()
+	after.Finalizers = []string{"other.io/finalizer"}
+	after.Annotations = map[string]string{"other.io/annotation": "bar"}
+	if err := patcher.Patch(ctx, after, client.FieldOwner("test"), client.ForceOwnership); err != nil {
+		t.Fatalf("Patcher.Patch() unexpected error: %v", err)
+	}
+
+	patched := &corev1.Service{}
+	if err := fclient.Get(ctx, client.ObjectKeyFromObject(svc), patched); err != nil {
+		t.Fatalf("Unexpected error getting patched object: %v", err)
+	}
+
+	if want := []string{"other.io/finalizer"}; !reflect.DeepEqual(patched.Finalizers, want) {
+		t.Errorf("Patcher.Patch() finalizers = %v, want %v", patched.Finalizers, want)
+	}
+
+	if want := map[string]string{"other.io/annotation": "bar"}; !reflect.DeepEqual(patched.Annotations, want) {
+		t.Errorf("Patcher.Patch() annotations = %v, want %v", patched.Annotations, want)
+	}
+
+	if want := []string{"object"}; !reflect.DeepEqual(recorder.patches, want) {
+		t.Errorf("Patcher.Patch() patches = %v, want %v", recorder.patches, want)
+	}
+}
@@ -17,8 +17,8 @@ limitations under the License.
 package util
 
 import (
+	"fmt"
 	"math/rand"
-	"net"
 	"net/url"
 	"strconv"
 	"time"
@@ -35,15 +35,24 @@ func RandomString(n int) string {
 	return string(result)
 }
 
+// SplitHostPort splits the URL host into hostname and port. The port defaults
+// to the well-known port of the URL scheme when it is not present.
 func SplitHostPort(rawURL string) (string, int32, error) {
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return "", -1, err
 	}
 
-	host, strport, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		return "", -1, err
+	host, strport := u.Hostname(), u.Port()
+	if strport == "" {
+		switch u.Scheme {
+		case "http":
+			strport = "80"
+		case "https":
+			strport = "443"
+		default:
+			return "", -1, fmt.Errorf("missing port in url %q", rawURL)
+		}
 	}
 
 	port, err := strconv.Atoi(strport)
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// namespaceDefaults returns the default service annotations declared by the
+// namespace annotations, which are the tunnel annotations and the source ranges
+// annotation. It returns nil when the namespace can't be read.
+func (w *ServiceWebhook) namespaceDefaults(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass) (map[string]string, error) {
+	ns := &corev1.Namespace{}
+	if err := w.Client.Get(ctx, client.ObjectKey{Name: svc.Namespace}, ns); err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defaults := make(map[string]string)
+	for key, value := range ns.Annotations {
+		switch {
+		case key == corev1.AnnotationLoadBalancerSourceRangesKey:
+		case strings.HasPrefix(key, v1alpha1.TunnelAnnotationPrefix):
+			option := strings.TrimPrefix(key, v1alpha1.TunnelAnnotationPrefix)
+			// a reserved address or hostname is bound to a single tunnel, so it is never defaulted.
+			if !knownOptions.Has(option) || option == v1alpha1.RemoteAddrOption || option == v1alpha1.HostnameOption || !tunnels.Allowed(class, option) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		defaults[key] = value
+	}
+
+	return defaults, nil
+}
+
+// applyDefaults merges the namespace defaults into the service annotations it
+// doesn't set, and records them in the AppliedDefaultsAnnotation. The annotations
+// defaulted earlier are updated to the current namespace defaults unless their
+// value was changed since, in which case the service is assumed to override them.
+// The defaulted annotations removed from the service are recorded as opted out in
+// the OptedOutDefaultsAnnotation, and are no longer defaulted until the service sets
+// them again or the namespace no longer declares them.
+func applyDefaults(svc *corev1.Service, defaults map[string]string) error {
+	applied := make(map[string]string)
+	if v, ok := svc.Annotations[v1alpha1.AppliedDefaultsAnnotation]; ok {
+		// ignore the malformed record, the annotations are then kept as they are.
+		_ = json.Unmarshal([]byte(v), &applied)
+	}
+
+	var optedOutKeys []string
+	if v, ok := svc.Annotations[v1alpha1.OptedOutDefaultsAnnotation]; ok {
+		_ = json.Unmarshal([]byte(v), &optedOutKeys)
+	}
+
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+
+	optedOut := sets.NewString(optedOutKeys...)
+	for key := range optedOut {
+		if _, ok := svc.Annotations[key]; ok {
+			// the service sets the annotation again.
+			optedOut.Delete(key)
+		}
+	}
+
+	for key, value := range applied {
+		current, ok := svc.Annotations[key]
+		if !ok {
+			// the service removed the default.
+			optedOut.Insert(key)
+			delete(applied, key)
+			continue
+		}
+
+		if current != value {
+			// the service overrides the default.
+			delete(applied, key)
+			continue
+		}
+
+		if def, ok := defaults[key]; ok {
+			svc.Annotations[key] = def
+			applied[key] = def
+		} else {
+			// the namespace no longer declares the default.
+			delete(svc.Annotations, key)
+			delete(applied, key)
+		}
+	}
+
+	for key := range optedOut {
+		if _, ok := defaults[key]; !ok {
+			// the namespace no longer declares the default.
+			optedOut.Delete(key)
+		}
+	}
+
+	for key, value := range defaults {
+		if _, ok := svc.Annotations[key]; ok || optedOut.Has(key) {
+			continue
+		}
+
+		if key == corev1.AnnotationLoadBalancerSourceRangesKey && len(svc.Spec.LoadBalancerSourceRanges) > 0 {
+			// the service spec declares its own source ranges.
+			continue
+		}
+
+		svc.Annotations[key] = value
+		applied[key] = value
+	}
+
+	if err := setJSONAnnotation(svc, v1alpha1.OptedOutDefaultsAnnotation, optedOut.List(), optedOut.Len() == 0); err != nil {
+		return err
+	}
+
+	return setJSONAnnotation(svc, v1alpha1.AppliedDefaultsAnnotation, applied, len(applied) == 0)
+}
+
+// setJSONAnnotation sets the service annotation to the JSON encoded value, or removes it when empty.
+func setJSONAnnotation(svc *corev1.Service, key string, value interface{}, empty bool) error {
+	if empty {
+		delete(svc.Annotations, key)
+		return nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	svc.Annotations[key] = string(b)
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+// podWebhookPath is the path the PodWebhook is served on.
+const podWebhookPath = "/mutate--v1-pod"
+
+// PodWebhook injects the public URLs of the tunnels of the services selecting a pod
+// into its containers, as environment variables referencing the ConfigMap the URLs
+// are published in. Only the pods with the InjectTunnelURLsLabel are mutated.
+type PodWebhook struct {
+	Client client.Reader
+	// LoadBalancerClass is the service LoadBalancer class name served
+	// by the default agent when no TunnelClass is defined for it.
+	LoadBalancerClass string
+
+	decoder *admission.Decoder
+}
+
+// SetupWithManager sets up the webhook with the Manager.
+func (w *PodWebhook) SetupWithManager(mgr ctrl.Manager) error {
+	// the pod is handled as an admission request rather than through a CustomDefaulter,
+	// since the pods created by the workloads have their namespace in the request only.
+	mgr.GetWebhookServer().Register(podWebhookPath, &webhook.Admission{Handler: w})
+	return nil
+}
+
+// +kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups=core,resources=pods,verbs=create,versions=v1,name=mpod.k-ngrok.io,admissionReviewVersions=v1
+
+var _ admission.Handler = &PodWebhook{}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (w *PodWebhook) InjectDecoder(d *admission.Decoder) error {
+	w.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (w *PodWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := w.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if pod.Labels[v1alpha1.InjectTunnelURLsLabel] != "true" {
+		return admission.Allowed("")
+	}
+
+	svcs := &corev1.ServiceList{}
+	if err := w.Client.List(ctx, svcs, client.InNamespace(req.Namespace)); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	served, err := tunnels.ServedClasses(ctx, w.Client, w.LoadBalancerClass)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if !served.Has(pointer.StringDeref(svc.Spec.LoadBalancerClass, "")) || len(svc.Spec.Selector) == 0 {
+			continue
+		}
+
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			injectURLs(pod, svc)
+		}
+	}
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// injectURLs adds the environment variables of the public URLs of the tunnels of the
+// service to the containers of the pod. The variables the containers set are kept.
+func injectURLs(pod *corev1.Pod, svc *corev1.Service) {
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		for _, sp := range svc.Spec.Ports {
+			name := tunnels.URLEnvName(svc, sp)
+			if hasEnv(c, name) {
+				continue
+			}
+
+			c.Env = append(c.Env, corev1.EnvVar{
+				Name: name,
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: tunnels.URLsConfigMapName(svc)},
+						Key:                  tunnels.URLKey(sp),
+						// the URL is not published until the tunnel is running.
+						Optional: pointer.Bool(true),
+					},
+				},
+			})
+		}
+	}
+}
+
+func hasEnv(c *corev1.Container, name string) bool {
+	for _, env := range c.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+)
+
+func TestPodWebhook_Handle(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	newService := func(name, class string, ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Type:              corev1.ServiceTypeLoadBalancer,
+				LoadBalancerClass: pointer.String(class),
+				Selector:          map[string]string{"app": "foo"},
+				Ports:             ports,
+			},
+		}
+	}
+
+	urlEnv := func(name, configMap, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+					Key:                  key,
+					Optional:             pointer.Bool(true),
+				},
+			},
+		}
+	}
+
+	svcs := []*corev1.Service{
+		newService("foo", testLoadBalancerClass, corev1.ServicePort{Name: "http", Port: 80}, corev1.ServicePort{Port: 5432}),
+		newService("bar", "example.com/other"),
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		env     []corev1.EnvVar
+		wantEnv []corev1.EnvVar
+	}{
+		{
+			name:   "Pod without the label",
+			labels: map[string]string{"app": "foo"},
+		},
+		{
+			name:   "Pod not selected",
+			labels: map[string]string{"app": "baz", v1alpha1.InjectTunnelURLsLabel: "true"},
+		},
+		{
+			name:   "Inject the URLs of the selecting services",
+			labels: map[string]string{"app": "foo", v1alpha1.InjectTunnelURLsLabel: "true"},
+			wantEnv: []corev1.EnvVar{
+				urlEnv("FOO_HTTP_TUNNEL_URL", "foo-tunnel-urls", "http"),
+				urlEnv("FOO_5432_TUNNEL_URL", "foo-tunnel-urls", "5432"),
+			},
+		},
+		{
+			name:   "Keep the variables set by the container",
+			labels: map[string]string{"app": "foo", v1alpha1.InjectTunnelURLsLabel: "true"},
+			env:    []corev1.EnvVar{{Name: "FOO_HTTP_TUNNEL_URL", Value: "https://foo.example.com"}},
+			wantEnv: []corev1.EnvVar{
+				{Name: "FOO_HTTP_TUNNEL_URL", Value: "https://foo.example.com"},
+				urlEnv("FOO_5432_TUNNEL_URL", "foo-tunnel-urls", "5432"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(scheme)
+			for _, svc := range svcs {
+				builder = builder.WithObjects(svc.DeepCopy())
+			}
+
+			w := &PodWebhook{Client: builder.Build(), LoadBalancerClass: testLoadBalancerClass}
+			decoder, _ := admission.NewDecoder(scheme)
+			_ = w.InjectDecoder(decoder)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{GenerateName: "foo-", Labels: tt.labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app", Env: tt.env}}},
+			}
+
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := w.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			if !resp.Allowed {
+				t.Fatalf("Handle() denied: %v", resp.Result)
+			}
+
+			patched := raw
+			if len(resp.Patches) > 0 {
+				b, err := json.Marshal(resp.Patches)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				patch, err := jsonpatch.DecodePatch(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if patched, err = patch.Apply(raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := &corev1.Pod{}
+			if err := json.Unmarshal(patched, got); err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.wantEnv
+			if want == nil {
+				want = tt.env
+			}
+
+			if env := got.Spec.Containers[0].Env; !reflect.DeepEqual(env, want) {
+				t.Errorf("Handle() env = %v, want %v", env, want)
+			}
+		})
+	}
+}
@@ -19,23 +19,102 @@ package webhooks
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+	"github.com/prksu/kngrok/tunnels"
+)
+
+var (
+	// supportedProtocols is the set of tunnel protocols the ngrok agent supports.
+	supportedProtocols = sets.NewString("tcp", "http", "tls")
+
+	// supportedOAuthProviders is the set of OAuth identity providers ngrok supports.
+	supportedOAuthProviders = sets.NewString("amazon", "facebook", "github", "gitlab", "google", "linkedin", "microsoft", "twitch", v1alpha1.OIDCProvider)
+
+	// supportedPortProtocols is the set of service port protocols ngrok can tunnel.
+	supportedPortProtocols = sets.NewString(string(corev1.ProtocolTCP))
+
+	// knownOptions is the set of tunnel option names.
+	knownOptions = sets.NewString(
+		v1alpha1.ProtocolOption,
+		v1alpha1.RegionOption,
+		v1alpha1.BasicAuthOption,
+		v1alpha1.OAuthProviderOption,
+		v1alpha1.OAuthAllowEmailsOption,
+		v1alpha1.OAuthAllowDomainsOption,
+		v1alpha1.OAuthScopesOption,
+		v1alpha1.OAuthSecretOption,
+		v1alpha1.OIDCIssuerURLOption,
+		v1alpha1.DenySourceRangesOption,
+		v1alpha1.RemoteAddrOption,
+		v1alpha1.HostnameOption,
+		v1alpha1.CNAMETargetOption,
+		v1alpha1.TLSSecretOption,
+	)
+
+	// serviceOptions is the set of tunnel options that can't be overridden for a port.
+	serviceOptions = sets.NewString(v1alpha1.RegionOption)
+
+	// listOptions is the set of tunnel options whose value is a comma-separated list.
+	listOptions = sets.NewString(
+		v1alpha1.OAuthAllowEmailsOption,
+		v1alpha1.OAuthAllowDomainsOption,
+		v1alpha1.OAuthScopesOption,
+		v1alpha1.DenySourceRangesOption,
+	)
 )
 
+// tunnelNameIndexKey is the field index of services by the tunnel names of their ports.
+const tunnelNameIndexKey = ".spec.ports.tunnelName"
+
 type ServiceWebhook struct {
-	Client            client.Reader
+	Client client.Reader
+	// Cache is the cached reader the services are looked up with by their tunnel
+	// names, so that the services of the cluster are not listed on every admission.
+	Cache client.Reader
+	// Agents is the set of agents the tunnels are started on.
+	Agents *ngrok.Agents
+	// LoadBalancerClass is the service LoadBalancer class name served
+	// by the default agent when no TunnelClass is defined for it.
 	LoadBalancerClass string
+	// NamespaceSelector restricts the webhook to services in namespaces
+	// whose labels match. All namespaces are selected when nil or empty.
+	// It should match the namespaceSelector of the webhook configurations.
+	NamespaceSelector labels.Selector
 }
 
 // SetupWithManager sets up the webhook with the Manager.
 func (w *ServiceWebhook) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Service{}, tunnelNameIndexKey, func(obj client.Object) []string {
+		svc := obj.(*corev1.Service)
+		if pointer.StringDeref(svc.Spec.LoadBalancerClass, "") == "" {
+			return nil
+		}
+
+		return tunnelNamesOf(svc)
+	}); err != nil {
+		return err
+	}
+
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(&corev1.Service{}).
 		WithDefaulter(w).
@@ -43,6 +122,28 @@ func (w *ServiceWebhook) SetupWithManager(mgr ctrl.Manager) error {
 		Complete()
 }
 
+// classFor returns the TunnelClass of the service when it has a LoadBalancer class
+// served by the manager and lives in a namespace that matches the NamespaceSelector.
+// It returns nil when the webhook should not act on the service.
+func (w *ServiceWebhook) classFor(ctx context.Context, svc *corev1.Service) (*v1alpha1.TunnelClass, error) {
+	if pointer.StringDeref(svc.Spec.LoadBalancerClass, "") == "" {
+		return nil, nil
+	}
+
+	if w.NamespaceSelector != nil && !w.NamespaceSelector.Empty() {
+		ns := &corev1.Namespace{}
+		if err := w.Client.Get(ctx, client.ObjectKey{Name: svc.Namespace}, ns); err != nil {
+			return nil, err
+		}
+
+		if !w.NamespaceSelector.Matches(labels.Set(ns.GetLabels())) {
+			return nil, nil
+		}
+	}
+
+	return tunnels.ClassFor(ctx, w.Client, w.LoadBalancerClass, svc)
+}
+
 // +kubebuilder:webhook:path=/mutate--v1-service,mutating=true,failurePolicy=fail,sideEffects=None,groups=core,resources=services,verbs=create;update,versions=v1,name=mservice.k-ngrok.io,admissionReviewVersions=v1
 
 var _ webhook.CustomDefaulter = &ServiceWebhook{}
@@ -54,11 +155,25 @@ func (w *ServiceWebhook) Default(ctx context.Context, obj runtime.Object) error
 		return apierrors.NewBadRequest(fmt.Sprintf("expected a Service but got a %T", obj))
 	}
 
-	if w.LoadBalancerClass != pointer.StringDeref(svc.Spec.LoadBalancerClass, "") {
+	class, err := w.classFor(ctx, svc)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	if class == nil {
 		return nil
 	}
 
 	svc.Spec.AllocateLoadBalancerNodePorts = pointer.Bool(false)
+	defaults, err := w.namespaceDefaults(ctx, svc, class)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	if err := applyDefaults(svc, defaults); err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
 	return nil
 }
 
@@ -68,15 +183,714 @@ var _ webhook.CustomValidator = &ServiceWebhook{}
 
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (w *ServiceWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) error {
-	return nil
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a Service but got a %T", obj))
+	}
+
+	if err := w.validate(ctx, svc, nil); err != nil {
+		return err
+	}
+
+	return w.validateQuota(ctx, svc, nil)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (w *ServiceWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
-	return nil
+	svc, ok := newObj.(*corev1.Service)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a Service but got a %T", newObj))
+	}
+
+	old, ok := oldObj.(*corev1.Service)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a Service but got a %T", oldObj))
+	}
+
+	if !svc.DeletionTimestamp.IsZero() || !tunnelsChanged(old, svc) {
+		// the service being deleted, or whose tunnels are unchanged, e.g. when
+		// the controller removes its finalizer, is always allowed, even if a
+		// referenced Secret has been deleted meanwhile.
+		return nil
+	}
+
+	if err := w.validate(ctx, svc, old); err != nil {
+		return err
+	}
+
+	return w.validateQuota(ctx, svc, old)
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (w *ServiceWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) error {
 	return nil
 }
+
+// validate validates the service. On update, the references to the Secrets and to
+// the agents are only validated when they change from the old service, so that an
+// update is not rejected because of a Secret deleted or an agent reconfigured since.
+func (w *ServiceWebhook) validate(ctx context.Context, svc, old *corev1.Service) error {
+	class, err := w.classFor(ctx, svc)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	if class == nil {
+		return nil
+	}
+
+	var oldClass *v1alpha1.TunnelClass
+	if old != nil {
+		// the old service is validated as a new one when its class can't be found.
+		oldClass, _ = w.classFor(ctx, old)
+	}
+
+	var allErrs field.ErrorList
+	annotationsPath := field.NewPath("metadata", "annotations")
+	allErrs = append(allErrs, validateAnnotations(svc, class, annotationsPath)...)
+	allErrs = append(allErrs, validatePorts(svc)...)
+
+	tunnelErrs, err := w.validateTunnelNames(ctx, svc, old)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	allErrs = append(allErrs, tunnelErrs...)
+
+	refErrs, err := w.validateReferences(ctx, svc, class, old, oldClass, annotationsPath)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	allErrs = append(allErrs, refErrs...)
+	allErrs = append(allErrs, validateAuth(svc, class, annotationsPath)...)
+	allErrs = append(allErrs, validateSourceRanges(svc, class, annotationsPath)...)
+	allErrs = append(allErrs, validateRemoteAddrs(svc, class, annotationsPath)...)
+	allErrs = append(allErrs, validateHostnames(svc, class, annotationsPath)...)
+	allErrs = append(allErrs, w.validateTLSTermination(svc, class, old, oldClass, annotationsPath)...)
+
+	if region := tunnels.Region(svc, class); region != "" && !sameAgents(svc, class, old, oldClass) {
+		if _, err := w.Agents.Select(class.Spec.Agent, region, ""); err != nil {
+			regionPath := annotationsPath.Key(v1alpha1.TunnelAnnotation(v1alpha1.RegionOption))
+			allErrs = append(allErrs, field.Invalid(regionPath, region,
+				fmt.Sprintf("%v, the configured agents are connected to %v", err, w.Agents.Regions())))
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("Service").GroupKind(), svc.Name, allErrs)
+}
+
+// validateQuota validates the tunnels of the service don't exceed the tunnel quota
+// of its namespace, counting the tunnels of the other services served by the manager
+// in the namespace. Like ResourceQuota, an update that doesn't increase the tunnels
+// of the service is always allowed.
+func (w *ServiceWebhook) validateQuota(ctx context.Context, svc, old *corev1.Service) error {
+	class, err := w.classFor(ctx, svc)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	if class == nil {
+		return nil
+	}
+
+	requested := len(svc.Spec.Ports)
+	if old != nil {
+		if oldClass, err := w.classFor(ctx, old); err == nil && oldClass != nil && requested <= len(old.Spec.Ports) {
+			return nil
+		}
+	}
+
+	ns := &corev1.Namespace{}
+	if err := w.Client.Get(ctx, client.ObjectKey{Name: svc.Namespace}, ns); err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+			// no quota applies when the namespace can't be read, e.g. the
+			// manager runs with namespace-scoped permissions.
+			return nil
+		}
+
+		return apierrors.NewInternalError(err)
+	}
+
+	v, ok := ns.Annotations[v1alpha1.TunnelQuotaAnnotation]
+	if !ok {
+		return nil
+	}
+
+	gr := corev1.Resource("services")
+	limit, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || limit < 0 {
+		return apierrors.NewForbidden(gr, svc.Name, fmt.Errorf("invalid tunnel quota %q of namespace %s: must be a non-negative integer", v, svc.Namespace))
+	}
+
+	svcs := &corev1.ServiceList{}
+	if err := w.Client.List(ctx, svcs, client.InNamespace(svc.Namespace)); err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	served, err := tunnels.ServedClasses(ctx, w.Client, w.LoadBalancerClass)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	used := 0
+	for _, other := range svcs.Items {
+		if other.Name == svc.Name || !served.Has(pointer.StringDeref(other.Spec.LoadBalancerClass, "")) {
+			continue
+		}
+
+		used += len(other.Spec.Ports)
+	}
+
+	if used+requested > limit {
+		return apierrors.NewForbidden(gr, svc.Name, fmt.Errorf("exceeded tunnel quota of namespace %s: requested: %d, used: %d, limited: %d",
+			svc.Namespace, requested, used, limit))
+	}
+
+	return nil
+}
+
+// validateAnnotations validates the tunnel annotations of the service, and of its ports,
+// are known options allowed by the TunnelClass, and are well-formed.
+func validateAnnotations(svc *corev1.Service, class *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key, value := range svc.Annotations {
+		path := annotationsPath.Key(key)
+		var option string
+		switch portName, portOption, ok := v1alpha1.ParsePortTunnelAnnotation(key); {
+		case strings.HasPrefix(key, v1alpha1.TunnelAnnotationPrefix):
+			option = strings.TrimPrefix(key, v1alpha1.TunnelAnnotationPrefix)
+		case ok:
+			option = portOption
+			if !hasPort(svc, portName) {
+				allErrs = append(allErrs, field.Invalid(path, portName, "must be prefixed with the name of a service port"))
+				continue
+			}
+
+			if serviceOptions.Has(option) {
+				allErrs = append(allErrs, field.Forbidden(path, "may only be set for the whole service"))
+				continue
+			}
+		default:
+			continue
+		}
+
+		if !knownOptions.Has(option) {
+			allErrs = append(allErrs, field.NotSupported(path, option, knownOptions.List()))
+			continue
+		}
+
+		if !tunnels.Allowed(class, option) {
+			allErrs = append(allErrs, field.Forbidden(path,
+				fmt.Sprintf("not allowed by the TunnelClass of LoadBalancer class %q", class.Spec.LoadBalancerClass)))
+		}
+
+		if strings.TrimSpace(value) == "" {
+			allErrs = append(allErrs, field.Invalid(path, value, "must not be empty"))
+			continue
+		}
+
+		switch {
+		case option == v1alpha1.ProtocolOption:
+			if !supportedProtocols.Has(strings.ToLower(value)) {
+				allErrs = append(allErrs, field.NotSupported(path, value, supportedProtocols.List()))
+			}
+		case option == v1alpha1.RegionOption:
+			for _, msg := range validation.IsDNS1123Label(value) {
+				allErrs = append(allErrs, field.Invalid(path, value, msg))
+			}
+		case option == v1alpha1.RemoteAddrOption:
+			if host, port, err := net.SplitHostPort(value); err != nil || host == "" || len(validation.IsValidPortNum(atoi(port))) > 0 {
+				allErrs = append(allErrs, field.Invalid(path, value, "must be a reserved TCP address, e.g. 1.tcp.ngrok.io:20000"))
+			}
+		case option == v1alpha1.HostnameOption || option == v1alpha1.CNAMETargetOption:
+			for _, msg := range validation.IsDNS1123Subdomain(strings.ToLower(value)) {
+				allErrs = append(allErrs, field.Invalid(path, value, msg))
+			}
+		case isSecretReference(option):
+			for _, msg := range validation.IsDNS1123Subdomain(value) {
+				allErrs = append(allErrs, field.Invalid(path, value, "must be a Secret name: "+msg))
+			}
+		case listOptions.Has(option):
+			for _, item := range strings.Split(value, ",") {
+				if strings.TrimSpace(item) == "" {
+					allErrs = append(allErrs, field.Invalid(path, value, "must be a comma-separated list without empty items"))
+					break
+				}
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateReferences validates the Secrets referenced by the tunnel options of the
+// service ports exist in its namespace, and are of the expected type with the expected
+// keys, so a broken reference fails at admission rather than when the tunnel is started.
+// The references the old service already had are not validated again.
+// The Secrets are the only objects referenced by the tunnel options, and always in the
+// namespace of the service.
+func (w *ServiceWebhook) validateReferences(ctx context.Context, svc *corev1.Service, class *v1alpha1.TunnelClass,
+	old *corev1.Service, oldClass *v1alpha1.TunnelClass, annotationsPath *field.Path) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+	checked := sets.NewString()
+	for _, ref := range tunnels.SecretReferences {
+		for _, sp := range svc.Spec.Ports {
+			name, ok := tunnels.PortOption(svc, class, sp, ref.Option)
+			if !ok || len(validation.IsDNS1123Subdomain(name)) > 0 {
+				// the malformed names are reported by validateAnnotations.
+				continue
+			}
+
+			if hasOption(old, oldClass, ref.Option, name) {
+				continue
+			}
+
+			path := optionPath(annotationsPath, svc, class, sp, ref.Option)
+			if checked.Has(path.String()) {
+				continue
+			}
+
+			checked.Insert(path.String())
+			errs, err := w.validateReference(ctx, svc, ref, name, path)
+			if err != nil {
+				return nil, err
+			}
+
+			allErrs = append(allErrs, errs...)
+		}
+	}
+
+	return allErrs, nil
+}
+
+// validateReference validates the Secret with given name referenced by the tunnel option.
+func (w *ServiceWebhook) validateReference(ctx context.Context, svc *corev1.Service, ref tunnels.SecretReference, name string, path *field.Path) (field.ErrorList, error) {
+	secret := &corev1.Secret{}
+	if err := w.Client.Get(ctx, client.ObjectKey{Namespace: svc.Namespace, Name: name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return field.ErrorList{field.NotFound(path, name)}, nil
+		}
+
+		return nil, err
+	}
+
+	if err := ref.Check(secret); err != nil {
+		return field.ErrorList{field.Invalid(path, name, err.Error())}, nil
+	}
+
+	return nil, nil
+}
+
+// tunnelsChanged returns true if the update changes the spec or the tunnel annotations
+// of the service, rather than e.g. its finalizers or the annotations of the controller.
+func tunnelsChanged(old, svc *corev1.Service) bool {
+	return !equality.Semantic.DeepEqual(old.Spec, svc.Spec) || !reflect.DeepEqual(tunnelAnnotations(old), tunnelAnnotations(svc))
+}
+
+// tunnelAnnotations returns the tunnel annotations of the service, and of its ports.
+func tunnelAnnotations(svc *corev1.Service) map[string]string {
+	annotations := make(map[string]string)
+	for key, value := range svc.Annotations {
+		if _, _, ok := v1alpha1.ParsePortTunnelAnnotation(key); ok || strings.HasPrefix(key, v1alpha1.TunnelAnnotationPrefix) {
+			annotations[key] = value
+		}
+	}
+
+	return annotations
+}
+
+// hasOption returns true if the tunnel option has given value for a port of the old
+// service, i.e. the option was already validated when the old service was admitted.
+func hasOption(old *corev1.Service, oldClass *v1alpha1.TunnelClass, option, value string) bool {
+	if old == nil || oldClass == nil {
+		return false
+	}
+
+	for _, sp := range old.Spec.Ports {
+		if v, ok := tunnels.PortOption(old, oldClass, sp, option); ok && v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameAgents returns true if the tunnels of the old service could be started on the
+// same agents, i.e. its TunnelClass agent and its region are unchanged.
+func sameAgents(svc *corev1.Service, class *v1alpha1.TunnelClass, old *corev1.Service, oldClass *v1alpha1.TunnelClass) bool {
+	if old == nil || oldClass == nil {
+		return false
+	}
+
+	return class.Spec.Agent == oldClass.Spec.Agent && tunnels.Region(svc, class) == tunnels.Region(old, oldClass)
+}
+
+// optionPath returns the path of the annotation that sets the tunnel option of the
+// service port, which is the annotation of the port when it overrides the option.
+func optionPath(annotationsPath *field.Path, svc *corev1.Service, class *v1alpha1.TunnelClass, sp corev1.ServicePort, option string) *field.Path {
+	if sp.Name != "" && tunnels.Allowed(class, option) {
+		key := v1alpha1.PortTunnelAnnotation(sp.Name, option)
+		if _, ok := svc.Annotations[key]; ok {
+			return annotationsPath.Key(key)
+		}
+	}
+
+	return annotationsPath.Key(v1alpha1.TunnelAnnotation(option))
+}
+
+// hasPort returns true if the service has a port with given name.
+func hasPort(svc *corev1.Service, name string) bool {
+	for _, sp := range svc.Spec.Ports {
+		if sp.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uniqueErrors returns the errors without the duplicates, since the errors of the
+// service-wide tunnel options are reported for each port.
+func uniqueErrors(errs field.ErrorList) field.ErrorList {
+	seen := sets.NewString()
+	var unique field.ErrorList
+	for _, err := range errs {
+		if !seen.Has(err.Error()) {
+			seen.Insert(err.Error())
+			unique = append(unique, err)
+		}
+	}
+
+	return unique
+}
+
+// isSecretReference returns true if the value of the tunnel option is a Secret name.
+func isSecretReference(option string) bool {
+	_, ok := tunnels.SecretReferenceOf(option)
+	return ok
+}
+
+// validatePorts validates the protocol of the service ports can be tunneled by ngrok.
+func validatePorts(svc *corev1.Service) field.ErrorList {
+	var allErrs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	for i, sp := range svc.Spec.Ports {
+		if sp.Protocol != "" && !supportedPortProtocols.Has(string(sp.Protocol)) {
+			allErrs = append(allErrs, field.NotSupported(portsPath.Index(i).Child("protocol"), sp.Protocol, supportedPortProtocols.List()))
+		}
+	}
+
+	return allErrs
+}
+
+// validateTunnelNames validates the tunnel names of the service ports are valid,
+// and don't collide with the tunnels of the other services. The collisions are
+// not checked again on update when the tunnel names and the LoadBalancer class
+// of the service are unchanged.
+func (w *ServiceWebhook) validateTunnelNames(ctx context.Context, svc, old *corev1.Service) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	names := make(map[string]int)
+	for i, sp := range svc.Spec.Ports {
+		name := tunnels.Name(svc, sp)
+		for _, msg := range validation.IsDNS1123Subdomain(name) {
+			allErrs = append(allErrs, field.Invalid(portsPath.Index(i).Child("name"), sp.Name,
+				fmt.Sprintf("the tunnel name %q is invalid: %s", name, msg)))
+		}
+
+		if j, ok := names[name]; ok {
+			allErrs = append(allErrs, field.Duplicate(portsPath.Index(i).Child("name"),
+				fmt.Sprintf("the tunnel name %q of port %d is used by port %d", name, i, j)))
+		}
+
+		names[name] = i
+	}
+
+	if old != nil && pointer.StringDeref(old.Spec.LoadBalancerClass, "") == pointer.StringDeref(svc.Spec.LoadBalancerClass, "") &&
+		sets.NewString(tunnelNamesOf(old)...).Equal(sets.NewString(tunnelNamesOf(svc)...)) {
+		return allErrs, nil
+	}
+
+	others, err := w.tunnelNames(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, sp := range svc.Spec.Ports {
+		name := tunnels.Name(svc, sp)
+		if other, ok := others[name]; ok {
+			allErrs = append(allErrs, field.Duplicate(portsPath.Index(i).Child("name"),
+				fmt.Sprintf("the tunnel name %q is used by service %s", name, other)))
+		}
+	}
+
+	return allErrs, nil
+}
+
+// tunnelNames returns the tunnel names of the service ports used by the other services
+// served by the manager, with the namespace/name of their service. The services are
+// looked up by the tunnel name index of the Cache.
+func (w *ServiceWebhook) tunnelNames(ctx context.Context, svc *corev1.Service) (map[string]string, error) {
+	served, err := tunnels.ServedClasses(ctx, w.Client, w.LoadBalancerClass)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, name := range tunnelNamesOf(svc) {
+		svcs := &corev1.ServiceList{}
+		if err := w.Cache.List(ctx, svcs, client.MatchingFields{tunnelNameIndexKey: name}); err != nil {
+			return nil, err
+		}
+
+		for i := range svcs.Items {
+			other := &svcs.Items[i]
+			if other.Namespace == svc.Namespace && other.Name == svc.Name {
+				continue
+			}
+
+			if !served.Has(pointer.StringDeref(other.Spec.LoadBalancerClass, "")) {
+				continue
+			}
+
+			if sets.NewString(tunnelNamesOf(other)...).Has(name) {
+				names[name] = client.ObjectKeyFromObject(other).String()
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// tunnelNamesOf returns the tunnel names of the service ports.
+func tunnelNamesOf(svc *corev1.Service) []string {
+	var names []string
+	for _, sp := range svc.Spec.Ports {
+		names = append(names, tunnels.Name(svc, sp))
+	}
+
+	return names
+}
+
+// validateAuth validates the basic auth, OAuth and OIDC tunnel options of the service ports.
+func validateAuth(svc *corev1.Service, class *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, sp := range svc.Spec.Ports {
+		allErrs = append(allErrs, validatePortAuth(svc, class, i, sp, annotationsPath)...)
+	}
+
+	return uniqueErrors(allErrs)
+}
+
+// validatePortAuth validates the basic auth, OAuth and OIDC tunnel options of the service port.
+func validatePortAuth(svc *corev1.Service, class *v1alpha1.TunnelClass, i int, sp corev1.ServicePort, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	pathOf := func(option string) *field.Path {
+		return optionPath(annotationsPath, svc, class, sp, option)
+	}
+
+	_, basicAuth := tunnels.PortOption(svc, class, sp, v1alpha1.BasicAuthOption)
+	provider, oauth := tunnels.PortOption(svc, class, sp, v1alpha1.OAuthProviderOption)
+	if !oauth {
+		for _, option := range []string{
+			v1alpha1.OAuthAllowEmailsOption,
+			v1alpha1.OAuthAllowDomainsOption,
+			v1alpha1.OAuthScopesOption,
+			v1alpha1.OAuthSecretOption,
+			v1alpha1.OIDCIssuerURLOption,
+		} {
+			if _, ok := tunnels.PortOption(svc, class, sp, option); ok {
+				allErrs = append(allErrs, field.Required(pathOf(v1alpha1.OAuthProviderOption),
+					fmt.Sprintf("must be set when %s is set", v1alpha1.TunnelAnnotation(option))))
+			}
+		}
+	}
+
+	if !basicAuth && !oauth {
+		return allErrs
+	}
+
+	if basicAuth && oauth {
+		allErrs = append(allErrs, field.Forbidden(pathOf(v1alpha1.BasicAuthOption),
+			fmt.Sprintf("may not be set together with %s", v1alpha1.TunnelAnnotation(v1alpha1.OAuthProviderOption))))
+	}
+
+	if proto := tunnels.Protocol(svc, class, sp); proto != "http" {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "ports").Index(i), proto,
+			"authentication is only supported by http tunnels"))
+	}
+
+	if !oauth {
+		return allErrs
+	}
+
+	if !supportedOAuthProviders.Has(provider) {
+		allErrs = append(allErrs, field.NotSupported(pathOf(v1alpha1.OAuthProviderOption), provider, supportedOAuthProviders.List()))
+	}
+
+	issuerURL, hasIssuerURL := tunnels.PortOption(svc, class, sp, v1alpha1.OIDCIssuerURLOption)
+	_, hasSecret := tunnels.PortOption(svc, class, sp, v1alpha1.OAuthSecretOption)
+	if provider == v1alpha1.OIDCProvider {
+		if u, err := url.Parse(issuerURL); !hasIssuerURL || err != nil || u.Scheme != "https" || u.Host == "" {
+			allErrs = append(allErrs, field.Invalid(pathOf(v1alpha1.OIDCIssuerURLOption), issuerURL,
+				"must be an https URL of the OIDC issuer"))
+		}
+
+		if !hasSecret {
+			allErrs = append(allErrs, field.Required(pathOf(v1alpha1.OAuthSecretOption),
+				"OIDC requires the Secret of the client credentials"))
+		}
+	} else if hasIssuerURL {
+		allErrs = append(allErrs, field.Forbidden(pathOf(v1alpha1.OIDCIssuerURLOption),
+			fmt.Sprintf("may only be set with the %q provider", v1alpha1.OIDCProvider)))
+	}
+
+	for _, email := range tunnels.List(svc, class, sp, v1alpha1.OAuthAllowEmailsOption) {
+		if !strings.Contains(email, "@") {
+			allErrs = append(allErrs, field.Invalid(pathOf(v1alpha1.OAuthAllowEmailsOption), email, "must be an email address"))
+		}
+	}
+
+	for _, domain := range tunnels.List(svc, class, sp, v1alpha1.OAuthAllowDomainsOption) {
+		if strings.Contains(domain, "@") {
+			allErrs = append(allErrs, field.Invalid(pathOf(v1alpha1.OAuthAllowDomainsOption), domain, "must be an email domain"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateSourceRanges validates the CIDRs of the IP restriction of the service ports.
+func validateSourceRanges(svc *corev1.Service, class *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, cidr := range svc.Spec.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "loadBalancerSourceRanges").Index(i), cidr, "must be a CIDR, e.g. 10.0.0.0/8"))
+		}
+	}
+
+	if len(svc.Spec.LoadBalancerSourceRanges) == 0 {
+		for _, cidr := range tunnels.SourceRanges(svc) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				allErrs = append(allErrs, field.Invalid(annotationsPath.Key(corev1.AnnotationLoadBalancerSourceRangesKey), cidr, "must be a CIDR, e.g. 10.0.0.0/8"))
+			}
+		}
+	}
+
+	for _, sp := range svc.Spec.Ports {
+		path := optionPath(annotationsPath, svc, class, sp, v1alpha1.DenySourceRangesOption)
+		for _, cidr := range tunnels.List(svc, class, sp, v1alpha1.DenySourceRangesOption) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				allErrs = append(allErrs, field.Invalid(path, cidr, "must be a CIDR, e.g. 10.0.0.0/8"))
+			}
+		}
+	}
+
+	return uniqueErrors(allErrs)
+}
+
+// validateRemoteAddrs validates the reserved TCP addresses are only set for the tcp
+// tunnels, and are bound to a single port since a tunnel owns its address.
+func validateRemoteAddrs(svc *corev1.Service, class *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	addrs := make(map[string]int)
+	for i, sp := range svc.Spec.Ports {
+		addr, ok := tunnels.PortOption(svc, class, sp, v1alpha1.RemoteAddrOption)
+		if !ok {
+			continue
+		}
+
+		if proto := tunnels.Protocol(svc, class, sp); proto != "tcp" {
+			allErrs = append(allErrs, field.Invalid(portsPath.Index(i), proto,
+				"a reserved TCP address is only supported by tcp tunnels"))
+		}
+
+		if j, ok := addrs[addr]; ok {
+			allErrs = append(allErrs, field.Duplicate(optionPath(annotationsPath, svc, class, sp, v1alpha1.RemoteAddrOption),
+				fmt.Sprintf("the reserved TCP address %q of port %d is used by port %d", addr, i, j)))
+		}
+
+		addrs[addr] = i
+	}
+
+	return allErrs
+}
+
+// validateHostnames validates the custom hostnames are only set for the http and tls
+// tunnels, and are bound to a single port since a tunnel owns its hostname.
+func validateHostnames(svc *corev1.Service, class *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	hostnames := make(map[string]int)
+	for i, sp := range svc.Spec.Ports {
+		hostname, ok := tunnels.PortOption(svc, class, sp, v1alpha1.HostnameOption)
+		if !ok {
+			continue
+		}
+
+		if proto := tunnels.Protocol(svc, class, sp); proto != "http" && proto != "tls" {
+			allErrs = append(allErrs, field.Invalid(portsPath.Index(i), proto,
+				"a custom hostname is only supported by http and tls tunnels"))
+		}
+
+		hostname = strings.ToLower(hostname)
+		if j, ok := hostnames[hostname]; ok {
+			allErrs = append(allErrs, field.Duplicate(optionPath(annotationsPath, svc, class, sp, v1alpha1.HostnameOption),
+				fmt.Sprintf("the custom hostname %q of port %d is used by port %d", hostname, i, j)))
+		}
+
+		hostnames[hostname] = i
+	}
+
+	return allErrs
+}
+
+// validateTLSTermination validates the certificates are only set for the tls tunnels, and
+// that the agents the tunnels may be started on have a directory to write them to. The
+// agents are not validated again when the certificate and the agents are unchanged.
+func (w *ServiceWebhook) validateTLSTermination(svc *corev1.Service, class *v1alpha1.TunnelClass,
+	old *corev1.Service, oldClass *v1alpha1.TunnelClass, annotationsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	for i, sp := range svc.Spec.Ports {
+		secretName, ok := tunnels.PortOption(svc, class, sp, v1alpha1.TLSSecretOption)
+		if !ok {
+			continue
+		}
+
+		if proto := tunnels.Protocol(svc, class, sp); proto != "tls" {
+			allErrs = append(allErrs, field.Invalid(portsPath.Index(i), proto,
+				"a certificate is only supported by tls tunnels"))
+		}
+
+		if hasOption(old, oldClass, v1alpha1.TLSSecretOption, secretName) && sameAgents(svc, class, old, oldClass) {
+			continue
+		}
+
+		for _, name := range w.Agents.Names(class.Spec.Agent, tunnels.Region(svc, class)) {
+			if config, _ := w.Agents.Config(name); config.CertDir == "" {
+				allErrs = append(allErrs, field.Invalid(optionPath(annotationsPath, svc, class, sp, v1alpha1.TLSSecretOption),
+					secretName,
+					fmt.Sprintf("agent %q has no certificate directory to terminate tls tunnels", name)))
+			}
+		}
+	}
+
+	return uniqueErrors(allErrs)
+}
+
+// atoi returns the integer value of s, or -1 when it is not an integer.
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+
+	return i
+}
@@ -0,0 +1,857 @@
+/*
+Copyright 2022 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
+)
+
+const testLoadBalancerClass = "k-ngrok.io/default"
+
+func newTestSecret(name string, secretType corev1.SecretType, keys ...string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Type:       secretType,
+		Data:       make(map[string][]byte),
+	}
+
+	for _, key := range keys {
+		secret.Data[key] = []byte(key)
+	}
+
+	return secret
+}
+
+func newTestWebhook(objs ...client.Object) *ServiceWebhook {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return &ServiceWebhook{
+		Client: c,
+		Cache:  c,
+		Agents: ngrok.NewAgents(
+			// the default agent built by the manager without --agent.
+			ngrok.DefaultAgentConfig("us"),
+			ngrok.AgentConfig{Name: "eu", Region: "eu"},
+		),
+		LoadBalancerClass: testLoadBalancerClass,
+	}
+}
+
+func newTestService(annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+	if len(ports) == 0 {
+		ports = []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 8080}}
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-svc",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: pointer.String(testLoadBalancerClass),
+			Ports:             ports,
+		},
+	}
+}
+
+func TestServiceWebhook_ValidateCreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []corev1.ServicePort
+		objs        []client.Object
+		wantErr     bool
+	}{
+		{
+			name: "No annotations",
+		},
+		{
+			name:        "Unsupported protocol",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "udp"},
+			wantErr:     true,
+		},
+		{
+			name:        "Region served by an agent",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "eu"},
+		},
+		{
+			name:        "Region of the default agent",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "us"},
+		},
+		{
+			name:        "Region not served by any agent",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "ap"},
+			wantErr:     true,
+		},
+		{
+			name:        "Basic auth on http tunnel",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "auth"},
+			objs:        []client.Object{newTestSecret("auth", corev1.SecretTypeBasicAuth, "username", "password")},
+		},
+		{
+			name:        "Basic auth Secret not found",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "auth"},
+			wantErr:     true,
+		},
+		{
+			name:        "Basic auth Secret of another type",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "auth"},
+			objs:        []client.Object{newTestSecret("auth", corev1.SecretTypeOpaque, "username", "password")},
+			wantErr:     true,
+		},
+		{
+			name:        "Basic auth Secret without password",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "auth"},
+			objs:        []client.Object{newTestSecret("auth", corev1.SecretTypeBasicAuth, "username")},
+			wantErr:     true,
+		},
+		{
+			name:        "Basic auth on tcp tunnel",
+			annotations: map[string]string{"tunnel.k-ngrok.io/basic-auth": "auth"},
+			wantErr:     true,
+		},
+		{
+			name: "OAuth",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":            "http",
+				"tunnel.k-ngrok.io/oauth-provider":      "google",
+				"tunnel.k-ngrok.io/oauth-allow-domains": "example.com",
+			},
+		},
+		{
+			name: "OAuth unsupported provider",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":       "http",
+				"tunnel.k-ngrok.io/oauth-provider": "myspace",
+			},
+			wantErr: true,
+		},
+		{
+			name: "OAuth options without provider",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":           "http",
+				"tunnel.k-ngrok.io/oauth-allow-emails": "foo@example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "OAuth with basic auth",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":       "http",
+				"tunnel.k-ngrok.io/oauth-provider": "github",
+				"tunnel.k-ngrok.io/basic-auth":     "auth",
+			},
+			wantErr: true,
+		},
+		{
+			name: "OIDC",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":        "http",
+				"tunnel.k-ngrok.io/oauth-provider":  "oidc",
+				"tunnel.k-ngrok.io/oidc-issuer-url": "https://accounts.example.com",
+				"tunnel.k-ngrok.io/oauth-secret":    "oidc-client",
+			},
+			objs: []client.Object{newTestSecret("oidc-client", corev1.SecretTypeOpaque, "client-id", "client-secret")},
+		},
+		{
+			name: "OIDC Secret without client secret",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":        "http",
+				"tunnel.k-ngrok.io/oauth-provider":  "oidc",
+				"tunnel.k-ngrok.io/oidc-issuer-url": "https://accounts.example.com",
+				"tunnel.k-ngrok.io/oauth-secret":    "oidc-client",
+			},
+			objs:    []client.Object{newTestSecret("oidc-client", corev1.SecretTypeOpaque, "client-id")},
+			wantErr: true,
+		},
+		{
+			name: "OIDC without issuer and secret",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":       "http",
+				"tunnel.k-ngrok.io/oauth-provider": "oidc",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "Deny source ranges",
+			annotations: map[string]string{"tunnel.k-ngrok.io/deny-source-ranges": "10.0.0.0/8, 192.168.0.0/16"},
+		},
+		{
+			name:        "Invalid deny source ranges",
+			annotations: map[string]string{"tunnel.k-ngrok.io/deny-source-ranges": "10.0.0.0/8,192.168.0.0"},
+			wantErr:     true,
+		},
+		{
+			name:        "Invalid source ranges annotation",
+			annotations: map[string]string{"service.beta.kubernetes.io/load-balancer-source-ranges": "10.0.0.1"},
+			wantErr:     true,
+		},
+		{
+			name:        "Annotation not allowed by TunnelClass",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "eu"},
+			objs: []client.Object{&v1alpha1.TunnelClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: v1alpha1.TunnelClassSpec{
+					LoadBalancerClass:  testLoadBalancerClass,
+					AllowedAnnotations: []string{"protocol"},
+				},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "UDP port",
+			ports:   []corev1.ServicePort{{Protocol: corev1.ProtocolUDP, Port: 53}},
+			wantErr: true,
+		},
+		{
+			name: "SCTP port among TCP ports",
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "sctp", Protocol: corev1.ProtocolSCTP, Port: 9999},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Named ports",
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443},
+			},
+		},
+		{
+			name: "Unnamed port among multiple ports",
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Protocol: corev1.ProtocolTCP, Port: 443},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Tunnel name used by another service",
+			objs: []client.Object{&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Type:              corev1.ServiceTypeLoadBalancer,
+					LoadBalancerClass: pointer.String(testLoadBalancerClass),
+					Ports:             []corev1.ServicePort{{Name: "svc", Protocol: corev1.ProtocolTCP, Port: 80}},
+				},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "Tunnel name used by a service of another class",
+			objs: []client.Object{&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Type:              corev1.ServiceTypeLoadBalancer,
+					LoadBalancerClass: pointer.String("example.com/other"),
+					Ports:             []corev1.ServicePort{{Name: "svc", Protocol: corev1.ProtocolTCP, Port: 80}},
+				},
+			}},
+		},
+		{
+			name:        "Unknown tunnel option",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocl": "http"},
+			wantErr:     true,
+		},
+		{
+			name:        "Empty tunnel option",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": " "},
+			wantErr:     true,
+		},
+		{
+			name:        "Malformed region",
+			annotations: map[string]string{"tunnel.k-ngrok.io/region": "EU West"},
+			wantErr:     true,
+		},
+		{
+			name:        "Malformed Secret name",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": "Basic_Auth"},
+			wantErr:     true,
+		},
+		{
+			name:        "List with empty item",
+			annotations: map[string]string{"tunnel.k-ngrok.io/deny-source-ranges": "10.0.0.0/8,,192.168.0.0/16"},
+			wantErr:     true,
+		},
+		{
+			name: "Per-port options",
+			annotations: map[string]string{
+				"http.tunnel.k-ngrok.io/protocol":   "http",
+				"http.tunnel.k-ngrok.io/basic-auth": "basic-auth",
+				"db.tunnel.k-ngrok.io/remote-addr":  "1.tcp.ngrok.io:20000",
+			},
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "db", Protocol: corev1.ProtocolTCP, Port: 5432},
+			},
+			objs: []client.Object{newTestSecret("basic-auth", corev1.SecretTypeBasicAuth, "username", "password")},
+		},
+		{
+			name: "Per-port basic auth Secret not found",
+			annotations: map[string]string{
+				"http.tunnel.k-ngrok.io/protocol":   "http",
+				"http.tunnel.k-ngrok.io/basic-auth": "basic-auth",
+			},
+			ports:   []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			wantErr: true,
+		},
+		{
+			name: "Service-wide basic auth on a port overridden to tcp",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":    "http",
+				"tunnel.k-ngrok.io/basic-auth":  "basic-auth",
+				"db.tunnel.k-ngrok.io/protocol": "tcp",
+			},
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "db", Protocol: corev1.ProtocolTCP, Port: 5432},
+			},
+			objs:    []client.Object{newTestSecret("basic-auth", corev1.SecretTypeBasicAuth, "username", "password")},
+			wantErr: true,
+		},
+		{
+			name:        "Per-port option of unknown port",
+			annotations: map[string]string{"https.tunnel.k-ngrok.io/protocol": "http"},
+			ports:       []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			wantErr:     true,
+		},
+		{
+			name:        "Per-port region",
+			annotations: map[string]string{"http.tunnel.k-ngrok.io/region": "eu"},
+			ports:       []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			wantErr:     true,
+		},
+		{
+			name:        "Per-port unsupported protocol",
+			annotations: map[string]string{"http.tunnel.k-ngrok.io/protocol": "udp"},
+			ports:       []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			wantErr:     true,
+		},
+		{
+			name:        "Malformed remote address",
+			annotations: map[string]string{"tunnel.k-ngrok.io/remote-addr": "1.tcp.ngrok.io"},
+			wantErr:     true,
+		},
+		{
+			name: "Remote address on http tunnel",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":    "http",
+				"tunnel.k-ngrok.io/remote-addr": "1.tcp.ngrok.io:20000",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "Remote address shared by ports",
+			annotations: map[string]string{"tunnel.k-ngrok.io/remote-addr": "1.tcp.ngrok.io:20000"},
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "db", Protocol: corev1.ProtocolTCP, Port: 5432},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Custom hostname",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":     "http",
+				"tunnel.k-ngrok.io/hostname":     "api.dev.example.com",
+				"tunnel.k-ngrok.io/cname-target": "2jfc1d.cname.ngrok.io",
+			},
+		},
+		{
+			name: "Malformed custom hostname",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol": "http",
+				"tunnel.k-ngrok.io/hostname": "https://api.dev.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "Custom hostname on tcp tunnel",
+			annotations: map[string]string{"tunnel.k-ngrok.io/hostname": "api.dev.example.com"},
+			wantErr:     true,
+		},
+		{
+			name: "Custom hostname shared by ports",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol": "http",
+				"tunnel.k-ngrok.io/hostname": "api.dev.example.com",
+			},
+			ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "admin", Protocol: corev1.ProtocolTCP, Port: 8080},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(tt.objs...)
+			if err := w.ValidateCreate(context.Background(), newTestService(tt.annotations, tt.ports...)); (err != nil) != tt.wantErr {
+				t.Errorf("ServiceWebhook.ValidateCreate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceWebhook_ValidateTLSTermination(t *testing.T) {
+	secret := newTestSecret("tls", corev1.SecretTypeTLS, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		certDir     string
+		wantErr     bool
+	}{
+		{
+			name: "Terminated by the agent",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":   "tls",
+				"tunnel.k-ngrok.io/tls-secret": "tls",
+			},
+			certDir: "/var/run/ngrok/certs",
+		},
+		{
+			name:        "Passed through",
+			annotations: map[string]string{"tunnel.k-ngrok.io/protocol": "tls"},
+		},
+		{
+			name: "Agent without certificate directory",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":   "tls",
+				"tunnel.k-ngrok.io/tls-secret": "tls",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Certificate on http tunnel",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":   "http",
+				"tunnel.k-ngrok.io/tls-secret": "tls",
+			},
+			certDir: "/var/run/ngrok/certs",
+			wantErr: true,
+		},
+		{
+			name: "Secret not of type kubernetes.io/tls",
+			annotations: map[string]string{
+				"tunnel.k-ngrok.io/protocol":   "tls",
+				"tunnel.k-ngrok.io/tls-secret": "basic-auth",
+			},
+			certDir: "/var/run/ngrok/certs",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(secret, newTestSecret("basic-auth", corev1.SecretTypeBasicAuth, "username", "password"))
+			agent, _ := w.Agents.Get(ngrok.DefaultAgentName)
+			w.Agents.Add(ngrok.AgentConfig{Name: ngrok.DefaultAgentName, Region: "us", CertDir: tt.certDir}, agent)
+			if err := w.ValidateCreate(context.Background(), newTestService(tt.annotations)); (err != nil) != tt.wantErr {
+				t.Errorf("ServiceWebhook.ValidateCreate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceWebhook_ValidateQuota(t *testing.T) {
+	namespace := func(quota string) *corev1.Namespace {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+		if quota != "" {
+			ns.Annotations = map[string]string{v1alpha1.TunnelQuotaAnnotation: quota}
+		}
+
+		return ns
+	}
+
+	other := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: pointer.String(testLoadBalancerClass),
+			Ports:             []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}
+
+	twoPorts := []corev1.ServicePort{
+		{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+		{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443},
+	}
+
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		old     *corev1.Service
+		svc     *corev1.Service
+		wantErr bool
+	}{
+		{
+			name: "No quota",
+			objs: []client.Object{namespace(""), other},
+			svc:  newTestService(nil, twoPorts...),
+		},
+		{
+			name: "Within quota",
+			objs: []client.Object{namespace("2"), other},
+			svc:  newTestService(nil),
+		},
+		{
+			name:    "Exceeds quota",
+			objs:    []client.Object{namespace("2"), other},
+			svc:     newTestService(nil, twoPorts...),
+			wantErr: true,
+		},
+		{
+			name:    "Invalid quota",
+			objs:    []client.Object{namespace("two"), other},
+			svc:     newTestService(nil),
+			wantErr: true,
+		},
+		{
+			name:    "Update increasing the tunnels beyond quota",
+			objs:    []client.Object{namespace("2"), other},
+			old:     newTestService(nil),
+			svc:     newTestService(nil, twoPorts...),
+			wantErr: true,
+		},
+		{
+			name: "Update not increasing the tunnels beyond quota",
+			objs: []client.Object{namespace("1"), other},
+			old:  newTestService(nil, twoPorts...),
+			svc:  newTestService(map[string]string{"tunnel.k-ngrok.io/region": "eu"}, twoPorts...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(tt.objs...)
+			var err error
+			if tt.old != nil {
+				err = w.ValidateUpdate(context.Background(), tt.old, tt.svc)
+			} else {
+				err = w.ValidateCreate(context.Background(), tt.svc)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ServiceWebhook.validateQuota() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceWebhook_ValidateUpdate(t *testing.T) {
+	port := func(port int32) corev1.ServicePort {
+		return corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: port}
+	}
+
+	basicAuth := func(name string) map[string]string {
+		return map[string]string{"tunnel.k-ngrok.io/protocol": "http", "tunnel.k-ngrok.io/basic-auth": name}
+	}
+
+	region := func(region string) map[string]string {
+		return map[string]string{"tunnel.k-ngrok.io/region": region}
+	}
+
+	tlsSecret := map[string]string{"tunnel.k-ngrok.io/protocol": "tls", "tunnel.k-ngrok.io/tls-secret": "tls"}
+
+	deleting := newTestService(basicAuth("deleted"))
+	deleting.DeletionTimestamp = &metav1.Time{}
+	deleting.Finalizers = []string{"service.k-ngrok.io/controller"}
+
+	finalized := newTestService(basicAuth("deleted"))
+	finalized.Finalizers = []string{"service.k-ngrok.io/controller"}
+
+	tests := []struct {
+		name    string
+		old     *corev1.Service
+		svc     *corev1.Service
+		wantErr bool
+	}{
+		{
+			name: "Finalizer removed from the service being deleted",
+			old:  deleting,
+			svc: func() *corev1.Service {
+				svc := deleting.DeepCopy()
+				svc.Finalizers = nil
+				return svc
+			}(),
+		},
+		{
+			name: "Metadata-only update",
+			old:  finalized,
+			svc: func() *corev1.Service {
+				svc := finalized.DeepCopy()
+				svc.Finalizers = nil
+				svc.Annotations["service.k-ngrok.io/tunnels"] = "{}"
+				return svc
+			}(),
+		},
+		{
+			name: "Unchanged reference to a deleted Secret",
+			old:  newTestService(basicAuth("deleted"), port(8080)),
+			svc:  newTestService(basicAuth("deleted"), port(8081)),
+		},
+		{
+			name:    "Changed reference to a missing Secret",
+			old:     newTestService(basicAuth("deleted"), port(8080)),
+			svc:     newTestService(basicAuth("missing"), port(8080)),
+			wantErr: true,
+		},
+		{
+			name: "Unchanged region no agent is connected to anymore",
+			old:  newTestService(region("ap"), port(8080)),
+			svc:  newTestService(region("ap"), port(8081)),
+		},
+		{
+			name:    "Changed region no agent is connected to",
+			old:     newTestService(region("eu"), port(8080)),
+			svc:     newTestService(region("ap"), port(8080)),
+			wantErr: true,
+		},
+		{
+			name: "Unchanged certificate on an agent without certificate directory",
+			old:  newTestService(tlsSecret, port(8443)),
+			svc:  newTestService(tlsSecret, port(9443)),
+		},
+		{
+			name:    "Added certificate on an agent without certificate directory",
+			old:     newTestService(map[string]string{"tunnel.k-ngrok.io/protocol": "tls"}, port(8443)),
+			svc:     newTestService(tlsSecret, port(8443)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(newTestSecret("tls", corev1.SecretTypeTLS, corev1.TLSCertKey, corev1.TLSPrivateKeyKey))
+			if err := w.ValidateUpdate(context.Background(), tt.old, tt.svc); (err != nil) != tt.wantErr {
+				t.Errorf("ServiceWebhook.ValidateUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// countingReader counts the lists of the reader.
+type countingReader struct {
+	client.Reader
+	lists int
+}
+
+func (r *countingReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	r.lists++
+	return r.Reader.List(ctx, list, opts...)
+}
+
+func TestServiceWebhook_ValidateUpdateTunnelNames(t *testing.T) {
+	// the service was admitted before the other service took its tunnel name
+	// "default-test-svc-web", e.g. while the webhook was unavailable.
+	other := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: pointer.String(testLoadBalancerClass),
+			Ports: []corev1.ServicePort{
+				{Name: "svc-web", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "svc-admin", Protocol: corev1.ProtocolTCP, Port: 8080},
+			},
+		},
+	}
+
+	web := corev1.ServicePort{Name: "web", Protocol: corev1.ProtocolTCP, Port: 80}
+	admin := corev1.ServicePort{Name: "admin", Protocol: corev1.ProtocolTCP, Port: 8080}
+	metrics := corev1.ServicePort{Name: "metrics", Protocol: corev1.ProtocolTCP, Port: 9090}
+	tests := []struct {
+		name      string
+		old       *corev1.Service
+		svc       *corev1.Service
+		wantLists bool
+		wantErr   bool
+	}{
+		{
+			name: "Unchanged tunnel names",
+			old:  newTestService(nil, web),
+			svc:  newTestService(map[string]string{"tunnel.k-ngrok.io/region": "eu"}, corev1.ServicePort{Name: "web", Protocol: corev1.ProtocolTCP, Port: 8000}),
+		},
+		{
+			name:      "Added tunnel name",
+			old:       newTestService(nil, web),
+			svc:       newTestService(nil, web, metrics),
+			wantLists: true,
+			// the collision of the unchanged tunnel name is reported too.
+			wantErr: true,
+		},
+		{
+			name:      "Renamed port to a used tunnel name",
+			old:       newTestService(nil, metrics, web),
+			svc:       newTestService(nil, metrics, admin),
+			wantLists: true,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(other)
+			cache := &countingReader{Reader: w.Cache}
+			w.Cache = cache
+			if err := w.ValidateUpdate(context.Background(), tt.old, tt.svc); (err != nil) != tt.wantErr {
+				t.Errorf("ServiceWebhook.ValidateUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if (cache.lists > 0) != tt.wantLists {
+				t.Errorf("ServiceWebhook.ValidateUpdate() listed the services %d times, wantLists %v", cache.lists, tt.wantLists)
+			}
+		})
+	}
+}
+
+func TestServiceWebhook_Default(t *testing.T) {
+	const (
+		protocol     = "tunnel.k-ngrok.io/protocol"
+		region       = "tunnel.k-ngrok.io/region"
+		sourceRanges = "service.beta.kubernetes.io/load-balancer-source-ranges"
+		applied      = "service.k-ngrok.io/applied-defaults"
+		optedOut     = "service.k-ngrok.io/opted-out-defaults"
+	)
+
+	namespace := func(annotations map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+	}
+
+	tests := []struct {
+		name         string
+		objs         []client.Object
+		annotations  map[string]string
+		sourceRanges []string
+		want         map[string]string
+	}{
+		{
+			name: "No namespace defaults",
+			objs: []client.Object{namespace(nil)},
+			want: map[string]string{},
+		},
+		{
+			name: "Namespace defaults",
+			objs: []client.Object{namespace(map[string]string{protocol: "http", sourceRanges: "10.0.0.0/8", "example.com/team": "a"})},
+			want: map[string]string{
+				protocol:     "http",
+				sourceRanges: "10.0.0.0/8",
+				applied:      `{"service.beta.kubernetes.io/load-balancer-source-ranges":"10.0.0.0/8","tunnel.k-ngrok.io/protocol":"http"}`,
+			},
+		},
+		{
+			name:        "Service overrides namespace default",
+			objs:        []client.Object{namespace(map[string]string{protocol: "http"})},
+			annotations: map[string]string{protocol: "tcp"},
+			want:        map[string]string{protocol: "tcp"},
+		},
+		{
+			name:         "Service spec overrides namespace source ranges",
+			objs:         []client.Object{namespace(map[string]string{sourceRanges: "10.0.0.0/8"})},
+			sourceRanges: []string{"192.168.0.0/16"},
+			want:         map[string]string{},
+		},
+		{
+			name:        "Applied default follows namespace default",
+			objs:        []client.Object{namespace(map[string]string{protocol: "tls"})},
+			annotations: map[string]string{protocol: "http", applied: `{"tunnel.k-ngrok.io/protocol":"http"}`},
+			want:        map[string]string{protocol: "tls", applied: `{"tunnel.k-ngrok.io/protocol":"tls"}`},
+		},
+		{
+			name:        "Applied default removed from namespace",
+			objs:        []client.Object{namespace(nil)},
+			annotations: map[string]string{protocol: "http", applied: `{"tunnel.k-ngrok.io/protocol":"http"}`},
+			want:        map[string]string{},
+		},
+		{
+			name:        "Applied default changed by the service",
+			objs:        []client.Object{namespace(map[string]string{protocol: "http"})},
+			annotations: map[string]string{protocol: "tcp", applied: `{"tunnel.k-ngrok.io/protocol":"http"}`},
+			want:        map[string]string{protocol: "tcp"},
+		},
+		{
+			name:        "Applied default removed by the service",
+			objs:        []client.Object{namespace(map[string]string{protocol: "http", region: "eu"})},
+			annotations: map[string]string{region: "eu", applied: `{"tunnel.k-ngrok.io/protocol":"http","tunnel.k-ngrok.io/region":"eu"}`},
+			want: map[string]string{
+				region:   "eu",
+				applied:  `{"tunnel.k-ngrok.io/region":"eu"}`,
+				optedOut: `["tunnel.k-ngrok.io/protocol"]`,
+			},
+		},
+		{
+			name:        "Opted-out default is not applied again",
+			objs:        []client.Object{namespace(map[string]string{protocol: "http"})},
+			annotations: map[string]string{optedOut: `["tunnel.k-ngrok.io/protocol"]`},
+			want:        map[string]string{optedOut: `["tunnel.k-ngrok.io/protocol"]`},
+		},
+		{
+			name:        "Opted-out default set again by the service",
+			objs:        []client.Object{namespace(map[string]string{protocol: "http"})},
+			annotations: map[string]string{protocol: "tcp", optedOut: `["tunnel.k-ngrok.io/protocol"]`},
+			want:        map[string]string{protocol: "tcp"},
+		},
+		{
+			name:        "Opted-out default removed from namespace",
+			objs:        []client.Object{namespace(nil)},
+			annotations: map[string]string{optedOut: `["tunnel.k-ngrok.io/protocol"]`},
+			want:        map[string]string{},
+		},
+		{
+			name: "Namespace default not allowed by TunnelClass",
+			objs: []client.Object{
+				namespace(map[string]string{protocol: "http", region: "eu"}),
+				&v1alpha1.TunnelClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "default"},
+					Spec: v1alpha1.TunnelClassSpec{
+						LoadBalancerClass:  testLoadBalancerClass,
+						AllowedAnnotations: []string{"protocol"},
+					},
+				},
+			},
+			want: map[string]string{protocol: "http", applied: `{"tunnel.k-ngrok.io/protocol":"http"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWebhook(tt.objs...)
+			svc := newTestService(tt.annotations)
+			svc.Spec.LoadBalancerSourceRanges = tt.sourceRanges
+			if err := w.Default(context.Background(), svc); err != nil {
+				t.Fatalf("ServiceWebhook.Default() unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(svc.Annotations, tt.want) {
+				t.Errorf("ServiceWebhook.Default() annotations = %v, want %v", svc.Annotations, tt.want)
+			}
+		})
+	}
+}
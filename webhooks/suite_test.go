@@ -37,6 +37,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/prksu/kngrok/api/v1alpha1"
+	"github.com/prksu/kngrok/ngrok"
 )
 
 // These tests use Ginkgo (BDD-style Go testing framework). Refer to
@@ -75,6 +78,9 @@ var _ = BeforeSuite(func() {
 	err = admissionv1beta1.AddToScheme(scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = v1alpha1.AddToScheme(scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	cfg, err = testenv.Start()
 	Expect(err).NotTo(HaveOccurred())
 	Expect(cfg).NotTo(BeNil())
@@ -97,7 +103,9 @@ var _ = BeforeSuite(func() {
 	})
 	Expect(err).NotTo(HaveOccurred())
 
-	err = (&ServiceWebhook{}).SetupWithManager(mgr)
+	err = (&ServiceWebhook{
+		Agents: ngrok.NewAgents(ngrok.DefaultAgentConfig("us")),
+	}).SetupWithManager(mgr)
 	Expect(err).NotTo(HaveOccurred())
 
 	// +kubebuilder::scaffold:webhook